@@ -12,6 +12,9 @@ import (
 )
 
 func NewAnnotateDataset(dataset skyhook.Dataset, inputs []skyhook.Dataset, tool string, params string) (*DBAnnotateDataset, error) {
+	if err := (&DBDataset{Dataset: dataset}).checkMutable(); err != nil {
+		return nil, err
+	}
 	inputIDs := make([]string, len(inputs))
 	for i, input := range inputs {
 		inputIDs[i] = strconv.Itoa(input.ID)
@@ -162,6 +165,15 @@ func init() {
 		}
 
 		ds := &DBDataset{Dataset: annoset.Dataset}
+		if err := ds.checkMutable(); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		// the repack may move or remove the item's file
+		if isRepacking(ds.ID, -1) {
+			http.Error(w, "dataset is being repacked, try again once the repack job finishes", 400)
+			return
+		}
 		item := ds.GetItem(request.Key)
 		buf := bytes.NewBuffer([]byte(request.Data))
 		data, err := skyhook.DecodeData(annoset.Dataset.DataType, request.Format, request.Metadata, buf)
@@ -176,6 +188,11 @@ func init() {
 				http.Error(w, err.Error(), 400)
 				return
 			}
+		} else if item.Provider != nil && *item.Provider == "shard" {
+			if err := item.unpackWithData(request.Format, request.Metadata, data); err != nil {
+				http.Error(w, err.Error(), 400)
+				return
+			}
 		} else {
 			item.SetMetadata(request.Format, request.Metadata)
 			err := item.UpdateData(data)
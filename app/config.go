@@ -1,5 +1,9 @@
 package app
 
+import (
+	"time"
+)
+
 // Global config object, set by main.go
 var Config struct {
 	// URL where main program can be reached.
@@ -12,4 +16,31 @@ var Config struct {
 	// Optional instance ID.
 	// If set, the worker should launch container in a subdirectory with this name.
 	InstanceID string
+	// Maximum number of containers that we may use on WorkerURL at once.
+	// A single worker should generally only run one container, but a worker pool
+	// can run one on each of its workers.
+	WorkerCapacity int
+	// Maximum number of independent nodes that RunNode executes concurrently.
+	NodeParallelism int
+	// Default policy for retrying failed tasks.
+	// It can be overridden at each exec node.
+	RetryPolicy RetryPolicy
+	// Whether to run ops that declare InProcess in the coordinator, rather than
+	// allocating a container for them.
+	InProcess bool
+	// Ops (by ID) to run in the coordinator regardless of InProcess.
+	// They must declare InProcess too, see CheckInProcessOps.
+	InProcessOps map[string]bool
+	// Size in bytes at which job logs are rotated and compressed, or 0 to
+	// never rotate.
+	JobLogMaxSize int64
+	// Logs of jobs that ended longer ago than this are deleted, or never if 0.
+	JobLogRetention time.Duration
+	// If set, new datasets store their items in this S3 bucket, under S3Prefix.
+	// Connection settings are taken from the environment (see skyhook.S3Config).
+	S3Bucket string
+	S3Prefix string
+	// How often to delete computed datasets that are no longer referenced, or
+	// never if 0 (they can still be deleted manually via /datasets-gc).
+	DatasetGCInterval time.Duration
 }
@@ -4,6 +4,7 @@ import (
 	"github.com/skyhookml/skyhookml/skyhook"
 
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 
@@ -18,6 +19,24 @@ func (item *DBItem) Handle(format string, w http.ResponseWriter, r *http.Request
 		http.ServeFile(w, r, fname)
 		return
 	}
+	// stream items in remote storage directly if they don't need to be converted
+	if open := item.GetProvider().Open; format == item.Format && open != nil && (format == "jpeg" || format == "png" || format == "mp4") {
+		rd, err := open(item.Item)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		defer rd.Close()
+		if format == "jpeg" {
+			w.Header().Set("Content-Type", "image/jpeg")
+		} else if format == "png" {
+			w.Header().Set("Content-Type", "image/png")
+		} else {
+			w.Header().Set("Content-Type", "video/mp4")
+		}
+		io.Copy(w, rd)
+		return
+	}
 
 	data, err := item.LoadData()
 	if err != nil {
@@ -82,6 +101,10 @@ func init() {
 			http.Error(w, "no such dataset", 404)
 			return
 		}
+		if dataset.Type == "snapshot" && GetSnapshotByDatasetID(dataset.ID) != nil {
+			http.Error(w, "delete the snapshot instead of its dataset", 400)
+			return
+		}
 		dataset.Delete()
 	}).Methods("DELETE")
 
@@ -111,7 +134,6 @@ func init() {
 			http.Error(w, "no such dataset", 404)
 			return
 		}
-
 		item := skyhook.Item{
 			Key: key,
 			Ext: ext,
@@ -158,7 +180,10 @@ func init() {
 	})).Methods("GET")
 
 	Router.HandleFunc("/datasets/{ds_id}/items/{item_key}", handleItem(func(w http.ResponseWriter, r *http.Request, dataset *DBDataset, item *DBItem) {
-		item.Delete()
+		if err := item.Delete(); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
 	})).Methods("DELETE")
 
 	Router.HandleFunc("/datasets/{ds_id}/items/{item_key}/get", handleItem(func(w http.ResponseWriter, r *http.Request, dataset *DBDataset, item *DBItem) {
@@ -49,10 +49,13 @@ func GetDataset(id int) *DBDataset {
 	}
 }
 
+// Find a computed dataset by its execution graph hash.
+// Several datasets may share a hash (e.g. if a computed dataset was imported),
+// in which case we prefer one that is done so that its outputs can be reused.
 func FindDataset(hash string) *DBDataset {
-	rows := db.Query(DatasetQuery + " WHERE hash = ?", hash)
+	rows := db.Query(DatasetQuery + " WHERE hash = ? ORDER BY done DESC, id", hash)
 	datasets := datasetListHelper(rows)
-	if len(datasets) == 1 {
+	if len(datasets) >= 1 {
 		return datasets[0]
 	} else {
 		return nil
@@ -215,7 +218,23 @@ func (ds *DBDataset) ListItems() []*DBItem {
 	return items
 }
 
+// Snapshot datasets are immutable once created, see snapshot.go.
+func (ds *DBDataset) checkMutable() error {
+	if ds.Type == "snapshot" {
+		return fmt.Errorf("snapshots cannot be modified")
+	}
+	return nil
+}
+
 func (ds *DBDataset) AddItem(item skyhook.Item) (*DBItem, error) {
+	if err := ds.checkMutable(); err != nil {
+		return nil, err
+	}
+	if item.Provider == nil {
+		if storage := ds.GetStorage(); storage != nil {
+			storage.SetItemProvider(ds.Dataset, &item)
+		}
+	}
 	db := ds.getDB()
 	// We use underlying Exec directly here since it is expected that we may encounter
 	// a unique key constraint error.
@@ -266,13 +285,33 @@ func (ds *DBDataset) WriteItem(key string, data skyhook.Data) (*DBItem, error) {
 }
 
 func (ds *DBDataset) Delete() {
-	ds.Clear()
+	ds.clear()
 	db.Exec("DELETE FROM datasets WHERE id = ?", ds.ID)
 	db.Exec("DELETE FROM exec_ds_refs WHERE dataset_id = ?", ds.ID)
+	db.Exec("DELETE FROM dataset_imports WHERE dataset_id = ?", ds.ID)
+	ds.SetStorage(nil)
+	// snapshots of this dataset are kept as standalone datasets since nodes may
+	// be pinned to them, and are garbage collected once no node is (see dataset_gc.go)
+	db.Exec("DELETE FROM dataset_snapshots WHERE dataset_id = ? OR snapshot_dataset_id = ?", ds.ID, ds.ID)
 }
 
 // Clear the dataset without deleting it.
-func (ds *DBDataset) Clear() {
+func (ds *DBDataset) Clear() error {
+	if err := ds.checkMutable(); err != nil {
+		return err
+	}
+	ds.clear()
+	return nil
+}
+
+func (ds *DBDataset) clear() {
+	dropResumeStatesForOutput(ds.ID)
+	// items in remote storage are not removed with the local directory
+	for _, item := range ds.ListItems() {
+		if item.Provider != nil && item.GetProvider().Remove != nil {
+			item.Item.Remove()
+		}
+	}
 	ds.Dataset.Remove()
 	UncacheDB(ds.DBFname())
 }
@@ -298,10 +337,15 @@ func (ds *DBDataset) SetDone(done bool) {
 	db.Exec("UPDATE datasets SET done = ? WHERE id = ?", done, ds.ID)
 }
 
-func (item *DBItem) Delete() {
-	db := (&DBDataset{Dataset: item.Dataset}).getDB()
-	db.Exec("DELETE FROM items WHERE k = ?", item.Key)
+func (item *DBItem) Delete() error {
+	item.Load()
+	ds := &DBDataset{Dataset: item.Dataset}
+	if err := ds.checkMutable(); err != nil {
+		return err
+	}
+	ds.getDB().Exec("DELETE FROM items WHERE k = ?", item.Key)
 	item.Item.Remove()
+	return nil
 }
 
 func (item *DBItem) Load() {
@@ -312,13 +356,10 @@ func (item *DBItem) Load() {
 	item.loaded = true
 }
 
-// Set metadata based on the file.
-func (item *DBItem) SetMetadataFromFile() error {
+// Set metadata based on the specified file containing the item's data.
+// For items in local files, this is usually item.Fname().
+func (item *DBItem) SetMetadataFromFile(fname string) error {
 	item.Load()
-	fname := item.Fname()
-	if fname == "" {
-		return fmt.Errorf("could not set metadata from file in dataset not supporting filename")
-	}
 	format, metadata, err := skyhook.DataImpls[item.Dataset.DataType].GetDefaultMetadata(fname)
 	if err != nil {
 		return err
@@ -340,5 +381,9 @@ func NewDataset(name string, t string, dataType skyhook.DataType, hash *string)
 	res := db.Exec("INSERT INTO datasets (name, type, data_type, hash, done) VALUES (?, ?, ?, ?, ?)", name, t, dataType, hash, done)
 	id := res.LastInsertId()
 	log.Printf("[dataset %d-%s] created new dataset, data_type=%v", id, name, dataType)
-	return GetDataset(id)
+	ds := GetDataset(id)
+	if storage := GetDefaultStorage(); storage != nil {
+		ds.SetStorage(storage)
+	}
+	return ds
 }
@@ -0,0 +1,224 @@
+package app
+
+import (
+	"github.com/skyhookml/skyhookml/skyhook"
+
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Garbage collection of computed datasets that are no longer used.
+// When exec nodes are edited or deleted, their old output datasets remain
+// until they are collected here. Snapshot datasets are collected too once the
+// dataset they were taken of is deleted and no node is pinned to them.
+// Imported datasets are never collected, even if they are computed datasets,
+// since they have no other copy.
+
+type OrphanDataset struct {
+	Dataset skyhook.Dataset
+	// Total size of the files in the dataset directory.
+	Bytes int64
+	// Size of files that are not shared with other datasets, i.e. the space
+	// that deleting the dataset frees.
+	ReclaimableBytes int64
+}
+
+type DatasetGCReport struct {
+	Datasets []OrphanDataset
+	Bytes int64
+	ReclaimableBytes int64
+}
+
+// Prevent concurrent collections, e.g. manual and scheduled.
+var datasetGCMu sync.Mutex
+
+// Returns IDs of datasets that are referenced by an exec node, workspace,
+// annotate dataset, or snapshot, or that were imported by the user.
+// If onlyID is set, only that dataset is checked.
+func findReferencedDatasets(onlyID int) map[int]bool {
+	referenced := make(map[int]bool)
+	add := func(id int) {
+		if onlyID == 0 || id == onlyID {
+			referenced[id] = true
+		}
+	}
+	addRows := func(q string, col string) {
+		var args []interface{}
+		if onlyID != 0 {
+			if strings.Contains(q, " WHERE ") {
+				q += " AND "
+			} else {
+				q += " WHERE "
+			}
+			q += col + " = ?"
+			args = append(args, onlyID)
+		}
+		rows := db.Query(q, args...)
+		for rows.Next() {
+			var id int
+			rows.Scan(&id)
+			add(id)
+		}
+	}
+	addRows("SELECT r.dataset_id FROM exec_ds_refs AS r, exec_nodes AS n WHERE r.node_id = n.id", "r.dataset_id")
+	addRows("SELECT dataset_id FROM ws_datasets", "dataset_id")
+	addRows("SELECT dataset_id FROM dataset_snapshots", "dataset_id")
+	addRows("SELECT snapshot_dataset_id FROM dataset_snapshots", "snapshot_dataset_id")
+	addRows("SELECT dataset_id FROM dataset_imports", "dataset_id")
+
+	// annotate inputs and node parents are encoded in one column, so when
+	// checking one dataset we find candidates with LIKE and then check them
+	var annosets []*DBAnnotateDataset
+	var nodes []*DBExecNode
+	if onlyID == 0 {
+		annosets = ListAnnotateDatasets()
+		nodes = ListExecNodes()
+	} else {
+		pattern := "%" + strconv.Itoa(onlyID) + "%"
+		annosets = annotateDatasetListHelper(db.Query(AnnotateDatasetQuery + " WHERE a.dataset_id = ? OR a.inputs LIKE ?", onlyID, pattern))
+		nodes = execNodeListHelper(db.Query(ExecNodeQuery + " WHERE parents LIKE ?", pattern))
+	}
+	for _, annoset := range annosets {
+		add(annoset.Dataset.ID)
+		for _, input := range annoset.Inputs {
+			add(input.ID)
+		}
+	}
+	// datasets may also be used directly as parents
+	for _, node := range nodes {
+		for _, plist := range node.Parents {
+			for _, parent := range plist {
+				if parent.Type == "d" {
+					add(parent.ID)
+				}
+			}
+		}
+	}
+	return referenced
+}
+
+func getReferencedDatasets() map[int]bool {
+	return findReferencedDatasets(0)
+}
+
+func isDatasetReferenced(id int) bool {
+	return findReferencedDatasets(id)[id]
+}
+
+// Find computed and snapshot datasets that are not referenced anywhere.
+func FindOrphanDatasets() DatasetGCReport {
+	referenced := getReferencedDatasets()
+	report := DatasetGCReport{Datasets: []OrphanDataset{}}
+	for _, ds := range ListDatasets() {
+		if (ds.Type != "computed" && ds.Type != "snapshot") || referenced[ds.ID] {
+			continue
+		}
+		bytes, reclaimable := ds.DiskUsage()
+		report.Datasets = append(report.Datasets, OrphanDataset{
+			Dataset: ds.Dataset,
+			Bytes: bytes,
+			ReclaimableBytes: reclaimable,
+		})
+		report.Bytes += bytes
+		report.ReclaimableBytes += reclaimable
+	}
+	return report
+}
+
+// Delete computed and snapshot datasets that are not referenced anywhere.
+// Returns the datasets that were deleted, or if dryRun is set, the datasets
+// that would be deleted.
+func CollectDatasets(dryRun bool, opts ImportOptions) (DatasetGCReport, error) {
+	datasetGCMu.Lock()
+	defer datasetGCMu.Unlock()
+
+	report := FindOrphanDatasets()
+	if dryRun {
+		return report, nil
+	}
+	deleted := DatasetGCReport{Datasets: []OrphanDataset{}}
+	opts.SetTasks(len(report.Datasets))
+	for _, orphan := range report.Datasets {
+		// check again in case the dataset was used since we found it
+		if isDatasetReferenced(orphan.Dataset.ID) {
+			opts.CompletedTask(fmt.Sprintf("Skipped %s since it is now in use", orphan.Dataset.Name), 1)
+			continue
+		}
+		ds := GetDataset(orphan.Dataset.ID)
+		if ds == nil {
+			continue
+		}
+		ds.Delete()
+		deleted.Datasets = append(deleted.Datasets, orphan)
+		deleted.Bytes += orphan.Bytes
+		deleted.ReclaimableBytes += orphan.ReclaimableBytes
+		log.Printf("[dataset-gc] deleted dataset %d-%s (%d bytes)", ds.ID, ds.Name, orphan.Bytes)
+		if opts.CompletedTask(fmt.Sprintf("Deleted %s (%d bytes)", ds.Name, orphan.Bytes), 1) {
+			return deleted, fmt.Errorf("stopped by user")
+		}
+	}
+	opts.CompletedTask(fmt.Sprintf("Deleted %d datasets, reclaiming about %d bytes", len(deleted.Datasets), deleted.ReclaimableBytes), 0)
+	return deleted, nil
+}
+
+// Periodically delete orphaned computed datasets, if Config.DatasetGCInterval is set.
+func StartDatasetGC() {
+	if Config.DatasetGCInterval <= 0 {
+		return
+	}
+	go func() {
+		for {
+			time.Sleep(Config.DatasetGCInterval)
+			report, err := CollectDatasets(false, ImportOptions{})
+			if err != nil {
+				log.Printf("[dataset-gc] error collecting datasets: %v", err)
+			} else if len(report.Datasets) > 0 {
+				log.Printf("[dataset-gc] deleted %d orphaned datasets", len(report.Datasets))
+			}
+		}
+	}()
+}
+
+func init() {
+	// Dry run: report the datasets that would be deleted.
+	Router.HandleFunc("/datasets-gc", func(w http.ResponseWriter, r *http.Request) {
+		skyhook.JsonResponse(w, FindOrphanDatasets())
+	}).Methods("GET")
+
+	Router.HandleFunc("/datasets-gc", func(w http.ResponseWriter, r *http.Request) {
+		job := NewJob(
+			"Delete Orphaned Datasets",
+			"dataset-gc",
+			"consoleprogress",
+			"",
+		)
+		progressJobOp := &ProgressJobOp{}
+		jobOp := &AppJobOp{
+			Job: job,
+			TailOp: &skyhook.TailJobOp{},
+			WrappedJobOps: map[string]skyhook.JobOp{
+				"progress": progressJobOp,
+			},
+		}
+		job.AttachOp(jobOp)
+		opts := ImportOptions{
+			AppJobOp: jobOp,
+			ProgressJobOp: progressJobOp,
+		}
+
+		log.Printf("[dataset-gc] user requested deletion of orphaned datasets")
+		go func() {
+			_, err := CollectDatasets(false, opts)
+			if err != nil {
+				log.Printf("[dataset-gc] error collecting datasets: %v", err)
+			}
+			opts.AppJobOp.SetDone(err)
+		}()
+		skyhook.JsonResponse(w, job)
+	}).Methods("POST")
+}
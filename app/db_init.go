@@ -17,13 +17,31 @@ func InitDB(init bool) {
 		db.Exec(`CREATE TABLE IF NOT EXISTS datasets (
 			id INTEGER PRIMARY KEY ASC,
 			name TEXT,
-			-- 'data' or 'computed'
+			-- 'data', 'computed', or 'snapshot'
 			type TEXT,
 			data_type TEXT,
 			-- only set if computed
 			hash TEXT,
 			done INTEGER DEFAULT 1
 		)`)
+		db.Exec(`CREATE TABLE IF NOT EXISTS dataset_snapshots (
+			id INTEGER PRIMARY KEY ASC,
+			dataset_id INTEGER REFERENCES datasets(id),
+			name TEXT,
+			-- the immutable dataset holding the items in the snapshot
+			snapshot_dataset_id INTEGER REFERENCES datasets(id),
+			created TIMESTAMP,
+			UNIQUE(dataset_id, name)
+		)`)
+		db.Exec(`CREATE TABLE IF NOT EXISTS dataset_imports (
+			-- imported datasets are kept by garbage collection even if no node refers to them
+			dataset_id INTEGER PRIMARY KEY REFERENCES datasets(id)
+		)`)
+		db.Exec(`CREATE TABLE IF NOT EXISTS dataset_storage (
+			dataset_id INTEGER PRIMARY KEY,
+			-- JSON-encoded DatasetStorage
+			config TEXT
+		)`)
 		db.Exec(`CREATE TABLE IF NOT EXISTS annotate_datasets (
 			id INTEGER PRIMARY KEY ASC,
 			dataset_id INTEGER REFERENCES datasets(id),
@@ -52,6 +70,42 @@ func InitDB(init bool) {
 			dataset_id INTEGER,
 			UNIQUE(node_id, dataset_id)
 		)`)
+		db.Exec(`CREATE TABLE IF NOT EXISTS exec_retry_policies (
+			node_id INTEGER PRIMARY KEY,
+			-- JSON-encoded RetryPolicy
+			policy TEXT
+		)`)
+		db.Exec(`CREATE TABLE IF NOT EXISTS exec_failed_keys (
+			node_id INTEGER,
+			k TEXT,
+			error TEXT,
+			UNIQUE(node_id, k)
+		)`)
+		db.Exec(`CREATE TABLE IF NOT EXISTS job_resume_states (
+			job_id INTEGER PRIMARY KEY,
+			node_id INTEGER,
+			name TEXT,
+			-- JSON-encoded skyhook.Runnable
+			runnable TEXT,
+			-- JSON-encoded list of all skyhook.ExecTask in the run
+			tasks TEXT,
+			will_be_done INTEGER,
+			retry TEXT
+		)`)
+		db.Exec(`CREATE TABLE IF NOT EXISTS job_completed_keys (
+			job_id INTEGER,
+			k TEXT,
+			UNIQUE(job_id, k)
+		)`)
+		db.Exec(`CREATE TABLE IF NOT EXISTS job_resume_datasets (
+			job_id INTEGER,
+			dataset_id INTEGER,
+			-- 1 for output datasets, 0 for input datasets
+			output INTEGER,
+			-- for input datasets, fingerprint of the items when the run started
+			fingerprint TEXT,
+			UNIQUE(job_id, dataset_id)
+		)`)
 		db.Exec(`CREATE TABLE IF NOT EXISTS workspaces (
 			name TEXT PRIMARY KEY
 		)`)
@@ -121,7 +175,9 @@ func InitDB(init bool) {
 	// now run some database cleanup steps
 
 	// mark jobs that are still running as error
+	// exec node runs among them can be resumed via /jobs/{id}/resume
 	db.Exec("UPDATE jobs SET error = 'terminated', done = 1 WHERE done = 0")
 
-	// delete temporary datasetsTODO
+	// computed datasets that are no longer referenced are deleted by the
+	// dataset GC (see StartDatasetGC and /datasets-gc)
 }
@@ -9,6 +9,7 @@ import (
 	"math/rand"
 	"net/http"
 	"sync"
+	"time"
 
 	"github.com/gorilla/mux"
 )
@@ -58,6 +59,9 @@ type ExecRunOptions struct {
 	// If force, we run even if outputs were already available.
 	Force bool
 
+	// Priority of the container request.
+	Priority int
+
 	// Whether to try incremental execution at this node.
 	// If false, we throw error if parent datasets are not done.
 	Incremental bool
@@ -81,6 +85,14 @@ type RunData struct {
 	JobOp *AppJobOp
 	ProgressJobOp *ProgressJobOp
 
+	// How to retry tasks that fail.
+	Retry RetryPolicy
+	// If set, we record keys of tasks that failed permanently at this node, so
+	// that they can be re-computed later.
+	ExecNode *DBExecNode
+	// Priority of the container request, e.g. skyhook.PriorityInteractive.
+	Priority int
+
 	// Saved error if any
 	Error error
 }
@@ -94,8 +106,7 @@ func (rd *RunData) SetJob(name string, metadata string) {
 	// initialize job
 	// if the node doesn't provide a custom JobOp, we use "consoleprogress" view
 	// otherwise the view for the job is the ExecOp's name
-	opImpl := rd.Node.GetOp()
-	nodeJobOp, nodeView := opImpl.GetJobOp(rd.Node)
+	_, nodeView := rd.Node.GetOp().GetJobOp(rd.Node)
 	jobView := "consoleprogress"
 	if nodeView != "" {
 		jobView = nodeView
@@ -106,7 +117,12 @@ func (rd *RunData) SetJob(name string, metadata string) {
 		jobView,
 		metadata,
 	)
+	rd.AttachJob(job)
+}
 
+// Populate JobOp/ProgressJobOp using an existing Job.
+func (rd *RunData) AttachJob(job *DBJob) {
+	nodeJobOp, _ := rd.Node.GetOp().GetJobOp(rd.Node)
 	rd.ProgressJobOp = &ProgressJobOp{}
 	rd.JobOp = &AppJobOp{
 		Job: job,
@@ -245,6 +261,9 @@ func (node *DBExecNode) PrepareRun(opts ExecRunOptions) (*RunData, error) {
 		Node: runnable,
 		Tasks: tasks,
 		WillBeDone: willBeDone,
+		Retry: node.GetRetryPolicy(),
+		ExecNode: node,
+		Priority: opts.Priority,
 	}
 	rd.SetJob(fmt.Sprintf("Exec Node %s", node.Name), fmt.Sprintf("%d", node.ID))
 	return rd, nil
@@ -253,43 +272,33 @@ func (node *DBExecNode) PrepareRun(opts ExecRunOptions) (*RunData, error) {
 func (rd *RunData) Run() error {
 	name := rd.Name
 
-	// get container corresponding to rd.Node.Op
-	log.Printf("[exec-node %s] [run] acquiring container", name)
-	rd.JobOp.Update([]string{"Acquiring worker"})
-	if err := AcquireWorker(rd.JobOp); err != nil {
-		rd.Error = err
-		return err
+	// small ops may run in the coordinator, others need a container
+	var executor taskExecutor
+	var err error
+	if rd.IsInProcess() {
+		executor, err = rd.startInProcess()
+	} else {
+		executor, err = rd.startContainer()
 	}
-	defer ReleaseWorker()
-	containerInfo, err := AcquireContainer(rd.Node, rd.JobOp)
 	if err != nil {
 		rd.Error = err
 		return err
 	}
-	log.Printf("[exec-node %s] [run] ... acquired container %s at %s", name, containerInfo.UUID, containerInfo.BaseURL)
-	defer ReleaseWorker()
-
-	// we want to de-allocate the container in two cases:
-	// (1) when we return from this function
-	// (2) if user requests to stop this job
-	// we achieve this as follows:
-	// - associate cleanup func with the JobOp
-	// - on return, call AppJobOp.Cleanup to only de-allocate if it hasn't been de-allocated already
-	// this is possible because AppJobOp will take care of unsetting CleanupFunc whenever it's called
-	rd.JobOp.SetCleanupFunc(func() {
-		err := skyhook.JsonPost(Config.WorkerURL, "/container/end", skyhook.EndRequest{containerInfo.UUID}, nil)
-		if err != nil {
-			log.Printf("[exec-node %s] [run] error ending exec container: %v", name, err)
-		}
-	})
-	defer rd.JobOp.Cleanup()
+	defer executor.Close()
+
+	// persist the tasks so that we can resume if the coordinator is restarted
+	rd.saveResumeState()
 
-	nthreads := containerInfo.Parallelism
+	nthreads := executor.Parallelism()
 	log.Printf("[exec-node %s] [run] running %d tasks in %d threads", name, len(rd.Tasks), nthreads)
 	rd.ProgressJobOp.SetTotal(len(rd.Tasks))
 
 	counter := 0
-	var applyErr error
+	// set when a task fails permanently and rd.Retry does not allow partial
+	// completion, so that no more tasks are started
+	aborted := false
+	// keys of tasks that failed permanently
+	failed := make(map[string]error)
 	var mu sync.Mutex
 	var wg sync.WaitGroup
 	for i := 0; i < nthreads; i++ {
@@ -299,7 +308,7 @@ func (rd *RunData) Run() error {
 			for !rd.JobOp.IsStopping() {
 				// get next task
 				mu.Lock()
-				if counter >= len(rd.Tasks) || applyErr != nil {
+				if counter >= len(rd.Tasks) || aborted {
 					mu.Unlock()
 					break
 				}
@@ -307,16 +316,25 @@ func (rd *RunData) Run() error {
 				counter++
 				mu.Unlock()
 
-				log.Printf("[exec-node %s] [run] apply on %s", name, task.Key)
-				err := skyhook.JsonPost(containerInfo.BaseURL, "/exec/task", skyhook.ExecTaskRequest{task}, nil)
+				attempt, err := rd.applyTask(executor, task)
 
 				if err != nil {
 					mu.Lock()
-					applyErr = err
+					failed[task.Key] = err
+					if rd.Retry.IsPartialAllowed() {
+						rd.ProgressJobOp.Increment()
+						rd.JobOp.Update([]string{fmt.Sprintf("giving up on key [%s] after %d attempts: %v", task.Key, attempt, err)})
+						mu.Unlock()
+						continue
+					}
+					// other threads finish their current task before we return
+					rd.JobOp.Update([]string{fmt.Sprintf("error applying on key [%s] (attempt %d): %v", task.Key, attempt, err)})
+					aborted = true
 					mu.Unlock()
 					break
 				}
 
+				rd.markTaskCompleted(task.Key)
 				mu.Lock()
 				rd.ProgressJobOp.Increment()
 				rd.JobOp.Update([]string{fmt.Sprintf("finished applying on key [%s]", task.Key)})
@@ -326,11 +344,36 @@ func (rd *RunData) Run() error {
 	}
 	wg.Wait()
 
-	if applyErr != nil {
-		rd.Error = applyErr
-		return applyErr
+	// record failed keys among the tasks that we got to
+	// (all tasks that were started have finished by now)
+	if rd.ExecNode != nil {
+		rd.ExecNode.UpdateFailedKeys(rd.Tasks[0:counter], failed)
 	}
 
+	if aborted {
+		rd.Error = TaskError{FailedKeys: failed}
+		return rd.Error
+	}
+
+	// if some tasks failed, the outputs are incomplete, so we shouldn't mark
+	// them done, but we keep the outputs that were computed successfully
+	if len(failed) > 0 {
+		log.Printf("[exec-node %s] [run] %d of %d tasks failed permanently", name, len(failed), len(rd.Tasks))
+		rd.Error = PartialError{
+			FailedKeys: failed,
+			NumTasks: len(rd.Tasks),
+		}
+		return rd.Error
+	}
+
+	// if we were stopped, keep the state around so the user can resume later
+	// the outputs are incomplete, so they must not be marked done
+	if rd.JobOp.IsStopping() {
+		rd.Error = fmt.Errorf("stopped by user")
+		return rd.Error
+	}
+	rd.clearResumeState()
+
 	// update dataset states
 	if rd.WillBeDone {
 		for _, ds := range rd.Node.OutputDatasets {
@@ -342,6 +385,50 @@ func (rd *RunData) Run() error {
 	return nil
 }
 
+// Apply the op on one task, retrying according to rd.Retry.
+// Returns the number of attempts made along with the last error, if any.
+func (rd *RunData) applyTask(executor taskExecutor, task skyhook.ExecTask) (int, error) {
+	attempt := 1
+	for {
+		log.Printf("[exec-node %s] [run] apply on %s", rd.Name, task.Key)
+		err := executor.Apply(task)
+		if err == nil {
+			return attempt, nil
+		}
+
+		// If we couldn't reach the container, check whether the worker still
+		// has it, e.g. the pool reports an error if the worker died.
+		// In that case there's no point retrying.
+		if GetErrorClass(err) == RetryNetwork {
+			if checkErr := executor.Check(); checkErr != nil {
+				return attempt, fmt.Errorf("container is no longer available (%v): %w", checkErr, err)
+			}
+		}
+
+		if !rd.Retry.ShouldRetry(err, attempt) {
+			return attempt, err
+		}
+
+		backoff := rd.Retry.GetBackoff(attempt)
+		log.Printf("[exec-node %s] [run] apply on %s failed (attempt %d/%d), retrying in %v: %v", rd.Name, task.Key, attempt, rd.Retry.MaxAttempts, backoff, err)
+		rd.JobOp.Update([]string{fmt.Sprintf("applying on key [%s] failed (attempt %d/%d), retrying in %v: %v", task.Key, attempt, rd.Retry.MaxAttempts, backoff, err)})
+
+		// wait for the backoff, but stop early if the job is stopped
+		deadline := time.Now().Add(backoff)
+		for time.Now().Before(deadline) {
+			if rd.JobOp.IsStopping() {
+				return attempt, err
+			}
+			remaining := time.Until(deadline)
+			if remaining > 100*time.Millisecond {
+				remaining = 100*time.Millisecond
+			}
+			time.Sleep(remaining)
+		}
+		attempt++
+	}
+}
+
 // Get some number of incremental outputs from this node.
 type IncrementalOptions struct {
 	// Number of random outputs to compute at this node.
@@ -352,6 +439,8 @@ type IncrementalOptions struct {
 	// MultiExecJob to update during incremental execution.
 	// For non-incremental ancestors, we pass this JobOp to RunNode.
 	JobOp *MultiExecJobOp
+	// Priority of container requests.
+	Priority int
 }
 func (node *DBExecNode) Incremental(opts IncrementalOptions) error {
 	isIncremental := func(node *DBExecNode) bool {
@@ -408,6 +497,7 @@ func (node *DBExecNode) Incremental(opts IncrementalOptions) error {
 		for _, cur := range nonIncremental {
 			RunNode(cur, RunNodeOptions{
 				JobOp: opts.JobOp,
+				Priority: opts.Priority,
 			})
 		}
 	}
@@ -574,9 +664,10 @@ func (node *DBExecNode) Incremental(opts IncrementalOptions) error {
 			curOutputKeys := neededOutputKeys[cur.ID]
 			log.Printf("[exec-node %s] [incremental] computing %d output keys at node %s", node.Name, len(curOutputKeys), cur.Name)
 
-			rd, err := node.PrepareRun(ExecRunOptions{
+			rd, err := cur.PrepareRun(ExecRunOptions{
 				Incremental: true,
 				LimitOutputKeys: curOutputKeys,
+				Priority: opts.Priority,
 			})
 			if err != nil {
 				return err
@@ -707,6 +798,21 @@ func init() {
 			return
 		}
 
+		// By default, if datasets with the same execution graph hash were already
+		// computed (possibly by a node in another workspace), we reuse them.
+		// Force can be set to re-compute the node anyway.
+		var params struct {
+			Force bool
+			// Priority of container requests, e.g. skyhook.PriorityBatch for
+			// long-running jobs.
+			Priority int
+		}
+		if r.ContentLength > 0 {
+			if err := skyhook.ParseJsonRequest(w, r, &params); err != nil {
+				return
+			}
+		}
+
 		// initialize job for this run
 		job := NewJob(
 			fmt.Sprintf("Exec Tree %s", node.Name),
@@ -719,8 +825,9 @@ func init() {
 
 		go func() {
 			err := RunNode(node, RunNodeOptions{
-				Force: true,
+				Force: params.Force,
 				JobOp: jobOp,
+				Priority: params.Priority,
 			})
 			job.UpdateState(jobOp.Encode())
 			if err != nil {
@@ -762,7 +869,7 @@ func init() {
 
 	Router.HandleFunc("/exec-nodes/{node_id}/incremental", func(w http.ResponseWriter, r *http.Request) {
 		var params struct {
-			// One of random, dataset, or direct.
+			// One of random, dataset, direct, or failed.
 			Mode string
 			// Random mode: number of outputs to compute.
 			Count int
@@ -770,6 +877,9 @@ func init() {
 			ParentSpec skyhook.ExecParent
 			// Direct mode: list of keys to compute.
 			Keys []string
+			// Priority of container requests.
+			// Defaults to interactive since the user is usually waiting on the outputs.
+			Priority *int
 		}
 		if err := skyhook.ParseJsonRequest(w, r, &params); err != nil {
 			return
@@ -782,11 +892,23 @@ func init() {
 			return
 		}
 
-		var opts IncrementalOptions
+		opts := IncrementalOptions{
+			Priority: skyhook.PriorityInteractive,
+		}
+		if params.Priority != nil {
+			opts.Priority = *params.Priority
+		}
 		if params.Mode == "random" {
 			opts.Count = params.Count
 		} else if params.Mode == "direct" {
 			opts.Keys = params.Keys
+		} else if params.Mode == "failed" {
+			// Re-compute keys that failed permanently in earlier runs.
+			opts.Keys = node.GetFailedKeys()
+			if len(opts.Keys) == 0 {
+				http.Error(w, "there are no failed keys to re-compute at this node", 400)
+				return
+			}
 		} else if params.Mode == "dataset" {
 			// If mode is dataset, we need to get the items in the dataset and determine
 			// the concrete list of keys that we should compute.
@@ -868,6 +990,9 @@ func init() {
 			Node: node,
 			Tasks: tasks,
 			WillBeDone: true,
+			Retry: Config.RetryPolicy,
+			// anonymous runs come from the UI, where the user waits for the result
+			Priority: skyhook.PriorityInteractive,
 		}
 		rd.SetJob(node.Name, "")
 		go func() {
@@ -223,5 +223,7 @@ func (node *DBExecNode) Delete() {
 	// remove reference to this node from children
 	DeleteBrokenReferences(node, nil)
 
+	db.Exec("DELETE FROM exec_retry_policies WHERE node_id = ?", node.ID)
+	db.Exec("DELETE FROM exec_failed_keys WHERE node_id = ?", node.ID)
 	db.Exec("DELETE FROM exec_nodes WHERE id = ?", node.ID)
 }
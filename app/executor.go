@@ -0,0 +1,175 @@
+package app
+
+import (
+	"github.com/skyhookml/skyhookml/skyhook"
+
+	"fmt"
+	"log"
+	"runtime/debug"
+	"sync"
+)
+
+// A taskExecutor applies the tasks of a RunData.
+// Tasks either run in a container allocated on the worker, or in-process for
+// small ops (see RunData.IsInProcess).
+type taskExecutor interface {
+	// Number of tasks that should be applied concurrently.
+	Parallelism() int
+	Apply(task skyhook.ExecTask) error
+	// Returns error if the executor is no longer usable, in which case there is
+	// no point retrying tasks.
+	Check() error
+	// Release resources associated with the executor.
+	Close()
+}
+
+// Error returned by an in-process ExecOp.Apply.
+// It is classified like an error reported by a container (RetryApply).
+type ApplyError struct {
+	Err error
+}
+
+func (e ApplyError) Error() string {
+	return e.Err.Error()
+}
+
+func (e ApplyError) Unwrap() error {
+	return e.Err
+}
+
+type containerExecutor struct {
+	info ContainerInfo
+	jobOp *AppJobOp
+}
+
+func (e containerExecutor) Parallelism() int {
+	return e.info.Parallelism
+}
+
+func (e containerExecutor) Apply(task skyhook.ExecTask) error {
+	return skyhook.JsonPost(e.info.BaseURL, "/exec/task", skyhook.ExecTaskRequest{Task: task}, nil)
+}
+
+func (e containerExecutor) Check() error {
+	var statusResponse skyhook.StatusResponse
+	return skyhook.JsonPost(Config.WorkerURL, "/container/status", skyhook.StatusRequest{UUID: e.info.UUID}, &statusResponse)
+}
+
+func (e containerExecutor) Close() {
+	e.jobOp.Cleanup()
+	ReleaseWorker()
+}
+
+// Acquire a worker and container for this RunData.
+func (rd *RunData) startContainer() (taskExecutor, error) {
+	name := rd.Name
+
+	// get container corresponding to rd.Node.Op
+	log.Printf("[exec-node %s] [run] acquiring container", name)
+	rd.JobOp.Update([]string{"Acquiring worker"})
+	if err := AcquireWorker(rd.JobOp, rd.Priority); err != nil {
+		return nil, err
+	}
+	containerInfo, err := AcquireContainer(rd.Node, rd.Priority, rd.JobOp)
+	if err != nil {
+		ReleaseWorker()
+		return nil, err
+	}
+	log.Printf("[exec-node %s] [run] ... acquired container %s at %s", name, containerInfo.UUID, containerInfo.BaseURL)
+
+	// we want to de-allocate the container in two cases:
+	// (1) when we are done with the executor
+	// (2) if user requests to stop this job
+	// we achieve this as follows:
+	// - associate cleanup func with the JobOp
+	// - on Close, call AppJobOp.Cleanup to only de-allocate if it hasn't been de-allocated already
+	// this is possible because AppJobOp will take care of unsetting CleanupFunc whenever it's called
+	rd.JobOp.SetCleanupFunc(func() {
+		err := skyhook.JsonPost(Config.WorkerURL, "/container/end", skyhook.EndRequest{UUID: containerInfo.UUID}, nil)
+		if err != nil {
+			log.Printf("[exec-node %s] [run] error ending exec container: %v", name, err)
+		}
+	})
+
+	return containerExecutor{
+		info: containerInfo,
+		jobOp: rd.JobOp,
+	}, nil
+}
+
+type inProcessExecutor struct {
+	op skyhook.ExecOp
+	mu sync.Mutex
+	closed bool
+}
+
+func (e *inProcessExecutor) Parallelism() int {
+	return e.op.Parallelism()
+}
+
+// Apply the task, converting any panic in the op into an error so that it
+// doesn't bring down the coordinator.
+func (e *inProcessExecutor) Apply(task skyhook.ExecTask) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("[in-process] panic applying on %s: %v\n%s", task.Key, r, debug.Stack())
+			err = ApplyError{fmt.Errorf("panic: %v", r)}
+		}
+	}()
+	if err := e.op.Apply(task); err != nil {
+		return ApplyError{err}
+	}
+	return nil
+}
+
+func (e *inProcessExecutor) Check() error {
+	return nil
+}
+
+func (e *inProcessExecutor) Close() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed {
+		return
+	}
+	e.closed = true
+	e.op.Close()
+}
+
+// Returns an error if Config.InProcessOps names an op that does not exist or
+// does not declare InProcess, e.g. ops that need a GPU or their container image.
+func CheckInProcessOps() error {
+	for opName := range Config.InProcessOps {
+		provider := skyhook.ExecOpProviders[opName]
+		if provider == nil {
+			return fmt.Errorf("in-process op %s does not exist", opName)
+		}
+		if !provider.IsInProcess() {
+			return fmt.Errorf("op %s cannot run in-process since it needs a container", opName)
+		}
+	}
+	return nil
+}
+
+// Returns whether this RunData should be executed in the coordinator instead
+// of in a container.
+// Ops in Config.InProcessOps always run in-process, and ops that declare
+// InProcess do so if Config.InProcess is set.
+func (rd *RunData) IsInProcess() bool {
+	opName := rd.Node.Op
+	if Config.InProcessOps[opName] {
+		return true
+	}
+	return Config.InProcess && rd.Node.GetOp().IsInProcess()
+}
+
+// Prepare the op in-process.
+func (rd *RunData) startInProcess() (taskExecutor, error) {
+	log.Printf("[exec-node %s] [run] preparing op %s in-process", rd.Name, rd.Node.Op)
+	rd.JobOp.Update([]string{"Running in-process"})
+	op, err := rd.Node.GetOp().Prepare(Config.CoordinatorURL, rd.Node)
+	if err != nil {
+		return nil, fmt.Errorf("error preparing node: %w", err)
+	}
+	return &inProcessExecutor{op: op}, nil
+}
@@ -5,6 +5,7 @@ import (
 
 	"fmt"
 	"log"
+	"strconv"
 )
 
 func (node *DBExecNode) GetGraphID() skyhook.GraphID {
@@ -76,18 +77,66 @@ func (node *DBExecNode) Hash() string {
 	return hashes[node.GetGraphID()]
 }
 
+// Returns an error if a job other than jobID is running any of the specified
+// nodes, which maps from node ID to name.
+// Jobs that run nodes are either MultiExec jobs, whose metadata lists the node
+// IDs, or resumed ExecNode jobs (see PrepareResume), whose metadata is the ID.
+func checkNodeConflicts(nodes map[int]string, jobID int) error {
+	conflictErr := func(id int) error {
+		return fmt.Errorf("another job has a conflict on node %s, wait for that job to finish and try again", nodes[id])
+	}
+
+	rows := db.Query("SELECT metadata FROM jobs WHERE done = 0 AND type = 'multiexec' AND id != ?", jobID)
+	for rows.Next() {
+		var metadataRaw string
+		rows.Scan(&metadataRaw)
+		var ids []int
+		skyhook.JsonUnmarshal([]byte(metadataRaw), &ids)
+		for _, id := range ids {
+			if nodes[id] == "" {
+				continue
+			}
+			rows.Close()
+			return conflictErr(id)
+		}
+	}
+
+	rows = db.Query("SELECT metadata FROM jobs WHERE done = 0 AND type = 'execnode' AND id != ?", jobID)
+	for rows.Next() {
+		var metadataRaw string
+		rows.Scan(&metadataRaw)
+		id, err := strconv.Atoi(metadataRaw)
+		if err != nil || nodes[id] == "" {
+			continue
+		}
+		rows.Close()
+		return conflictErr(id)
+	}
+
+	return nil
+}
+
 // Run the specified node, while running ancestors first if needed.
 type RunNodeOptions struct {
 	// If force, we run even if outputs were already available.
+	// Otherwise, outputs computed earlier under the same execution graph hash are
+	// reused, including ones computed by identical nodes in other workspaces.
 	Force bool
 	// If NoRunTree, we do not run if the parents of targetNode are not available.
 	NoRunTree bool
 	// MultiExecJobOp to update with jobs for each ExecNode run.
 	JobOp *MultiExecJobOp
+	// Priority of container requests, e.g. skyhook.PriorityInteractive.
+	Priority int
 }
 func RunNode(targetNode *DBExecNode, opts RunNodeOptions) error {
 	if targetNode.IsDone() && !opts.Force {
-		log.Printf("[run-tree %s] this node is already done", targetNode.Name)
+		log.Printf("[run-tree %s] this node is already done, reusing outputs with hash %s", targetNode.Name, targetNode.Hash())
+		if opts.JobOp != nil {
+			graph := targetNode.GetGraph()
+			vnode, _ := graph[targetNode.GetGraphID()].(*skyhook.VirtualNode)
+			opts.JobOp.ChangePlan([]*skyhook.VirtualNode{vnode}, 1, 0)
+		}
 		return nil
 	}
 
@@ -217,133 +266,188 @@ func RunNode(targetNode *DBExecNode, opts RunNodeOptions) error {
 		}
 
 		// Check for conflicts.
-		rows := db.Query("SELECT metadata FROM jobs WHERE done = 0 AND type = 'multiexec' AND id != ?", jobID)
-		for rows.Next() {
-			var metadataRaw string
-			rows.Scan(&metadataRaw)
-			var ids []int
-			skyhook.JsonUnmarshal([]byte(metadataRaw), &ids)
-			for _, id := range ids {
-				if ourIDSet[id] == "" {
-					continue
-				}
-				rows.Close()
-				return fmt.Errorf("another job has a conflict on node %s, wait for that job to finish and try again", ourIDSet[id])
-			}
-		}
-
-		return nil
+		return checkNodeConflicts(ourIDSet, jobID)
 	}()
 	if conflictErr != nil {
 		return conflictErr
 	}
 
-	// repeatedly run needed nodes where parents are all available
-	// until all nodes are done
-	for len(needed) > 0 {
-		for id, cur := range needed {
-			vnode := cur.(*skyhook.VirtualNode)
-			// are parents available?
-			// also collect the parent datasets here from ready
-			avail := true
-			parentDatasets := make(map[string][]*DBDataset)
-			for name, plist := range vnode.Parents {
-				parentDatasets[name] = make([]*DBDataset, len(plist))
-				for i, vparent := range plist {
-					if ready[vparent.GraphID] == nil {
-						avail = false
-						break
-					}
-					parentDatasets[name][i] = ready[vparent.GraphID][vparent.Name]
+	// Repeatedly dispatch needed nodes where parents are all available, until
+	// all nodes are done. Independent nodes run concurrently, up to
+	// Config.NodeParallelism at a time; each node additionally waits in
+	// AcquireWorker until the worker has capacity for another container.
+	// If a node fails, we stop dispatching new nodes, but let the nodes that are
+	// already running finish so that their outputs can be reused later.
+	parallelism := Config.NodeParallelism
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	type runResult struct {
+		id skyhook.GraphID
+		outputDatasets map[string]*DBDataset
+		err error
+	}
+	// map from GraphID of running nodes to their ExecNode job
+	running := make(map[skyhook.GraphID]*skyhook.Job)
+	resultCh := make(chan runResult)
+	var runErr error
+
+	// Try to start the needed node with the specified GraphID.
+	// Returns true if the execution graph changed because the node resolved into
+	// a subgraph, in which case the caller should re-check which nodes are ready.
+	dispatch := func(id skyhook.GraphID, vnode *skyhook.VirtualNode) (bool, error) {
+		// are parents available?
+		// also collect the parent datasets here from ready
+		parentDatasets := make(map[string][]*DBDataset)
+		for name, plist := range vnode.Parents {
+			parentDatasets[name] = make([]*DBDataset, len(plist))
+			for i, vparent := range plist {
+				if ready[vparent.GraphID] == nil {
+					return false, nil
 				}
+				parentDatasets[name][i] = ready[vparent.GraphID][vparent.Name]
 			}
-			if !avail {
-				continue
-			}
+		}
 
-			// enumerate items
-			// we need these for Resolve/GetTasks
-			parentItems := make(map[string][][]skyhook.Item)
-			for name, dslist := range parentDatasets {
-				parentItems[name] = make([][]skyhook.Item, len(dslist))
-				for i, ds := range dslist {
-					var skItems []skyhook.Item
-					for _, item := range ds.ListItems() {
-						skItems = append(skItems, item.Item)
-					}
-					parentItems[name][i] = skItems
+		// enumerate items
+		// we need these for Resolve/GetTasks
+		parentItems := make(map[string][][]skyhook.Item)
+		for name, dslist := range parentDatasets {
+			parentItems[name] = make([][]skyhook.Item, len(dslist))
+			for i, ds := range dslist {
+				var skItems []skyhook.Item
+				for _, item := range ds.ListItems() {
+					skItems = append(skItems, item.Item)
 				}
+				parentItems[name][i] = skItems
 			}
+		}
 
-			// make sure this node doesn't Resolve to something else if needed
-			subgraph := vnode.GetOp().Resolve(vnode, ToSkyhookInputDatasets(parentDatasets), parentItems)
-			if subgraph != nil {
-				// this vnode wants to be dynamically replaced with the new subgraph
-				// we need to incorporate the subgraph into our graph
-				log.Printf("[run-tree %s] node %s resolved into a subgraph of size %d, adding to our graph of size %d", targetNode.Name, vnode.Name, len(subgraph), len(graph))
-				IncorporateIntoGraph(graph, subgraph)
-				log.Printf("[run-tree %s] ... graph grew to size %d", targetNode.Name, len(graph))
-
-				// we also need to populate ready and missing with any new nodes
-				// so we call populateReadyMissing with anything that's not already there
-				populateReadyMissing()
-
-				// parents and stuff may have changed now
-				// so we need to re-evaluate whether parent datasets are available
-				// so: skip processing for now
-				continue
-			}
+		// make sure this node doesn't Resolve to something else if needed
+		subgraph := vnode.GetOp().Resolve(vnode, ToSkyhookInputDatasets(parentDatasets), parentItems)
+		if subgraph != nil {
+			// this vnode wants to be dynamically replaced with the new subgraph
+			// we need to incorporate the subgraph into our graph
+			log.Printf("[run-tree %s] node %s resolved into a subgraph of size %d, adding to our graph of size %d", targetNode.Name, vnode.Name, len(subgraph), len(graph))
+			IncorporateIntoGraph(graph, subgraph)
+			log.Printf("[run-tree %s] ... graph grew to size %d", targetNode.Name, len(graph))
+
+			// we also need to populate ready and missing with any new nodes
+			// so we call populateReadyMissing with anything that's not already there
+			populateReadyMissing()
+			return true, nil
+		}
 
-			log.Printf("[run-tree %s] running node %s", targetNode.Name, vnode.Name)
+		log.Printf("[run-tree %s] running node %s", targetNode.Name, vnode.Name)
 
-			// get output datasets
-			origNode := dbExecNodes[vnode.OrigNode.ID]
-			var outputDatasets map[string]*DBDataset
-			if vnode.VirtualKey == "" {
-				outputDatasets, _ = origNode.GetDatasets(true)
-			} else {
-				outputDatasets = origNode.GetVirtualDatasets(vnode)
-			}
-			for _, ds := range outputDatasets {
-				ds.Clear()
-				ds.SetDone(false)
-			}
+		// get output datasets
+		origNode := dbExecNodes[vnode.OrigNode.ID]
+		var outputDatasets map[string]*DBDataset
+		if vnode.VirtualKey == "" {
+			outputDatasets, _ = origNode.GetDatasets(true)
+		} else {
+			outputDatasets = origNode.GetVirtualDatasets(vnode)
+		}
+		for _, ds := range outputDatasets {
+			ds.Clear()
+			ds.SetDone(false)
+		}
 
-			// load runnable
-			runnable := vnode.GetRunnable(ToSkyhookInputDatasets(parentDatasets), ToSkyhookOutputDatasets(outputDatasets))
+		// load runnable
+		runnable := vnode.GetRunnable(ToSkyhookInputDatasets(parentDatasets), ToSkyhookOutputDatasets(outputDatasets))
 
-			// Initialize job.
-			rd := &RunData{
-				Name: vnode.Name,
-				Node: runnable,
-				WillBeDone: true,
-			}
-			rd.SetJob(fmt.Sprintf("Exec Node %s", vnode.Name), fmt.Sprintf("%d", vnode.OrigNode.ID))
-			// if MultiExecJobOp is provided, we need to update it with the current job
-			if opts.JobOp != nil {
-				opts.JobOp.SetPlanFromGraph(graph, ready, needed, vnode)
-				opts.JobOp.ChangeJob(rd.JobOp.Job.Job)
+		// Initialize job.
+		rd := &RunData{
+			Name: vnode.Name,
+			Node: runnable,
+			WillBeDone: true,
+			Retry: origNode.GetRetryPolicy(),
+			Priority: opts.Priority,
+		}
+		// failed keys are only meaningful for the node itself, not for
+		// virtual nodes that it may produce when resolved
+		if vnode.VirtualKey == "" {
+			rd.ExecNode = origNode
+		}
+		rd.SetJob(fmt.Sprintf("Exec Node %s", vnode.Name), fmt.Sprintf("%d", vnode.OrigNode.ID))
+		running[id] = &rd.JobOp.Job.Job
+		// if MultiExecJobOp is provided, we need to update it with the current job
+		if opts.JobOp != nil {
+			opts.JobOp.SetPlanFromGraph(graph, ready, needed, running)
+			opts.JobOp.ChangeJob(rd.JobOp.Job.Job)
+		}
+
+		// Get tasks.
+		// We do this after initializing RunData so that we can log any error to the AppJobOp.
+		var err error
+		rd.Tasks, err = runnable.GetOp().GetTasks(runnable, parentItems)
+		if err != nil {
+			delete(running, id)
+			rd.JobOp.SetDone(err)
+			return false, err
+		}
+
+		// Run the node in the background.
+		go func() {
+			err := rd.Run()
+			rd.SetDone()
+			resultCh <- runResult{
+				id: id,
+				outputDatasets: outputDatasets,
+				err: err,
 			}
+		}()
+		return false, nil
+	}
 
-			// Get tasks.
-			// We do this after initializing RunData so that we can log any error to the AppJobOp.
-			var err error
-			rd.Tasks, err = runnable.GetOp().GetTasks(runnable, parentItems)
-			if err != nil {
-				rd.JobOp.SetDone(err)
-				return err
+	for len(needed) > 0 {
+		// Start as many nodes as we can.
+		changed := false
+		if runErr == nil {
+			for id, cur := range needed {
+				if len(running) >= parallelism {
+					break
+				}
+				if running[id] != nil {
+					continue
+				}
+				resolved, err := dispatch(id, cur.(*skyhook.VirtualNode))
+				if err != nil {
+					runErr = err
+					break
+				}
+				changed = changed || resolved
 			}
+		}
 
-			// Run the node.
-			err = rd.Run()
-			rd.SetDone()
-			if err != nil {
-				return err
+		if changed {
+			// The graph changed, so there may be new nodes that we can start.
+			continue
+		} else if len(running) == 0 {
+			if runErr != nil {
+				break
 			}
+			return fmt.Errorf("no node is ready to run but %d nodes are still needed", len(needed))
+		}
 
-			delete(needed, id)
-			ready[id] = outputDatasets
+		// Wait for a node to finish.
+		res := <-resultCh
+		delete(running, res.id)
+		if res.err != nil {
+			if runErr == nil {
+				runErr = res.err
+			}
+		} else {
+			delete(needed, res.id)
+			ready[res.id] = res.outputDatasets
 		}
+		if opts.JobOp != nil {
+			opts.JobOp.SetPlanFromGraph(graph, ready, needed, running)
+		}
+	}
+
+	if runErr != nil {
+		return runErr
 	}
 
 	// update plan for last time if needed
@@ -73,6 +73,9 @@ func ImportDataset(path string, opts ImportOptions) error {
 	// create a new dataset and the directory, and copy the sqlite3
 	ds := NewDataset(rawds.Name, rawds.Type, rawds.DataType, rawds.Hash)
 	opts.AppJobOp.Job.UpdateMetadata(strconv.Itoa(ds.ID))
+	// no node refers to imported computed datasets, so mark them to keep
+	// them from being garbage collected
+	db.Exec("INSERT INTO dataset_imports (dataset_id) VALUES (?)", ds.ID)
 	ds.Mkdir()
 	if err := skyhook.CopyFile(srcDBFname, ds.DBFname()); err != nil {
 		ds.Delete()
@@ -82,8 +85,37 @@ func ImportDataset(path string, opts ImportOptions) error {
 	// now copy or symlink all the other files
 	items := ds.ListItems()
 	opts.SetTasks(len(items))
+	copiedShards := make(map[string]bool)
 	for _, item := range items {
+		// items in shards need to point to the shard in the new dataset
+		// the shard itself is copied the first time we see it
+		if item.Provider != nil && *item.Provider == "shard" {
+			var loc skyhook.ShardLocation
+			skyhook.JsonUnmarshal([]byte(*item.ProviderInfo), &loc)
+			loc.Dataset = ds.ID
+			ds.getDB().Exec("UPDATE items SET provider_info = ? WHERE k = ?", string(skyhook.JsonMarshal(loc)), item.Key)
+			if !copiedShards[loc.Shard] {
+				srcFname := filepath.Join(path, loc.Shard)
+				if err := skyhook.CopyOrSymlink(srcFname, loc.Fname(), opts.Symlink); err != nil {
+					ds.Delete()
+					return fmt.Errorf("error adding %s: %v", srcFname, err)
+				}
+				copiedShards[loc.Shard] = true
+			}
+			if opts.CompletedTask("", 1) {
+				return fmt.Errorf("stopped by user")
+			}
+			continue
+		}
+
 		dstFname := item.Fname()
+		if dstFname == "" {
+			// items in remote storage keep referring to the same objects
+			if opts.CompletedTask("", 1) {
+				return fmt.Errorf("stopped by user")
+			}
+			continue
+		}
 		srcFname := filepath.Join(path, filepath.Base(dstFname))
 		err := skyhook.CopyOrSymlink(srcFname, dstFname, opts.Symlink)
 		if err != nil {
@@ -195,7 +227,7 @@ func (ds *DBDataset) ImportIntoFileDataset(fnames []string, opts ImportOptions)
 				return err
 			}
 
-			err = skyhook.CopyOrSymlink(path, item.Fname(), opts.Symlink)
+			err = item.CopyFrom(path, opts.Symlink)
 			if err != nil {
 				return err
 			}
@@ -257,11 +289,11 @@ func (ds *DBDataset) ImportFiles(fnames []string, opts ImportOptions) error {
 		}
 
 		// copy the file
-		if err := skyhook.CopyOrSymlink(fname, item.Fname(), opts.Symlink); err != nil {
+		if err := item.CopyFrom(fname, opts.Symlink); err != nil {
 			return err
 		}
 
-		if err := item.SetMetadataFromFile(); err != nil {
+		if err := item.SetMetadataFromFile(fname); err != nil {
 			return err
 		}
 
@@ -494,6 +526,10 @@ func init() {
 			http.Error(w, "no such dataset", 404)
 			return
 		}
+		if err := dataset.checkMutable(); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
 
 		r.ParseForm()
 		mode := r.Form.Get("mode")
@@ -8,6 +8,7 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"os"
 	"sync"
 
 	"github.com/gorilla/mux"
@@ -77,6 +78,18 @@ func (j *DBJob) SetDone(error string) {
 	db.Exec("UPDATE jobs SET done = 1, error = ? WHERE id = ?", error, j.ID)
 }
 
+// Mark a job that previously ended as running again.
+// Returns false if the job is already running.
+func (j *DBJob) Reopen() bool {
+	res := db.Exec("UPDATE jobs SET done = 0, error = '' WHERE id = ? AND done = 1", j.ID)
+	if res.RowsAffected() == 0 {
+		return false
+	}
+	j.Done = false
+	j.Error = ""
+	return true
+}
+
 // A JobOp that wraps a TailOp for console, plus arbitrary number of other JobOps.
 // It also provides functionality for stopping via mutex/condition.
 type AppJobOp struct {
@@ -94,6 +107,16 @@ type AppJobOp struct {
 	// we also call this on SetDone
 	CleanupFunc func()
 
+	// full log of console lines, see job_log.go
+	logFile *os.File
+	logOpened bool
+	numLogLines int
+	// bytes in the active log, and index of the last rotated segment
+	logSize int64
+	logSegment int
+	// channels of /jobs/{id}/stream clients
+	subscribers map[chan JobStreamEvent]bool
+
 	mu sync.Mutex
 	cond *sync.Cond
 }
@@ -106,6 +129,11 @@ type AppJobState struct {
 func (op *AppJobOp) Encode() string {
 	op.mu.Lock()
 	defer op.mu.Unlock()
+	return op.encode()
+}
+
+// Caller must have the lock.
+func (op *AppJobOp) encode() string {
 	// we only need to compute LastWrappedDatas if it isn't set yet
 	if op.LastWrappedDatas == nil {
 		op.LastWrappedDatas = make(map[string]string)
@@ -132,6 +160,17 @@ func (op *AppJobOp) Update(lines []string) {
 		wrapped.Update(lines)
 		op.LastWrappedDatas[name] = wrapped.Encode()
 	}
+
+	firstLine := op.appendLog(lines)
+	datas := make(map[string]string)
+	for name, data := range op.LastWrappedDatas {
+		datas[name] = data
+	}
+	op.publish(JobStreamEvent{
+		FirstLine: firstLine,
+		Lines: lines,
+		Datas: datas,
+	})
 }
 
 func (op *AppJobOp) ReadFrom(r io.Reader) {
@@ -195,6 +234,16 @@ func (op *AppJobOp) SetDone(err error) {
 		}
 	}
 	op.Job.UpdateState(op.Encode())
+
+	// Notify stream clients and release the log.
+	op.mu.Lock()
+	op.publish(JobStreamEvent{Job: GetJob(op.Job.ID)})
+	for ch := range op.subscribers {
+		close(ch)
+	}
+	op.subscribers = nil
+	op.closeLog()
+	op.mu.Unlock()
 }
 
 func (op *AppJobOp) IsStopping() bool {
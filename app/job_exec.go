@@ -12,21 +12,29 @@ type MultiExecJobOp struct {
 	mu sync.Mutex
 	Job *DBJob
 
-	// current wrapped job (current ExecJob)
+	// current wrapped job (most recently started ExecJob)
 	CurJob *skyhook.Job
 
 	// current execution plan
 	// the field can change but the slice itself must not
 	Plan []*skyhook.VirtualNode
 
-	// which index in the plan are we executing next (or right now)?
+	// Nodes in the plan before PlanIndex are done, and the next NumRunning nodes
+	// are being executed right now.
 	PlanIndex int
+	NumRunning int
+
+	// ExecJobs of the running nodes, in the same order as they appear in Plan.
+	// This is only set by SetPlanFromGraph.
+	RunningJobs []*skyhook.Job
 }
 
 type MultiExecJobState struct {
 	CurJob *skyhook.Job
 	Plan []*skyhook.VirtualNode
 	PlanIndex int
+	NumRunning int
+	RunningJobs []*skyhook.Job
 }
 
 func (op *MultiExecJobOp) Encode() string {
@@ -36,6 +44,8 @@ func (op *MultiExecJobOp) Encode() string {
 		CurJob: op.CurJob,
 		Plan: op.Plan,
 		PlanIndex: op.PlanIndex,
+		NumRunning: op.NumRunning,
+		RunningJobs: op.RunningJobs,
 	}))
 }
 
@@ -48,10 +58,12 @@ func (op *MultiExecJobOp) Stop() error {
 
 // Set the plan.
 // The plan must be immutable.
-func (op *MultiExecJobOp) ChangePlan(plan []*skyhook.VirtualNode, planIndex int) {
+func (op *MultiExecJobOp) ChangePlan(plan []*skyhook.VirtualNode, planIndex int, numRunning int) {
 	op.mu.Lock()
 	op.Plan = plan
 	op.PlanIndex = planIndex
+	op.NumRunning = numRunning
+	op.RunningJobs = nil
 	op.mu.Unlock()
 }
 
@@ -62,14 +74,15 @@ func (op *MultiExecJobOp) ChangeJob(job skyhook.Job) {
 }
 
 // Get a []*skyhook.VirtualNode plan based on current execution graph and related state.
-func (op *MultiExecJobOp) SetPlanFromGraph(graph skyhook.ExecutionGraph, ready map[skyhook.GraphID]map[string]*DBDataset, needed map[skyhook.GraphID]skyhook.Node, cur *skyhook.VirtualNode) {
+// running maps from GraphIDs of the nodes that are currently running to their ExecJobs.
+func (op *MultiExecJobOp) SetPlanFromGraph(graph skyhook.ExecutionGraph, ready map[skyhook.GraphID]map[string]*DBDataset, needed map[skyhook.GraphID]skyhook.Node, running map[skyhook.GraphID]*skyhook.Job) {
 	var plan []*skyhook.VirtualNode
 	addGraphID := func(gid skyhook.GraphID) {
 		vnode, ok := graph[gid].(*skyhook.VirtualNode)
 		if !ok {
 			return
 		}
-		if vnode == cur {
+		if running[gid] != nil {
 			return
 		}
 		plan = append(plan, vnode)
@@ -78,13 +91,24 @@ func (op *MultiExecJobOp) SetPlanFromGraph(graph skyhook.ExecutionGraph, ready m
 		addGraphID(gid)
 	}
 	planIndex := len(plan)
-	if cur != nil {
-		plan = append(plan, cur)
+	var runningJobs []*skyhook.Job
+	for gid, job := range running {
+		vnode, ok := graph[gid].(*skyhook.VirtualNode)
+		if !ok {
+			continue
+		}
+		plan = append(plan, vnode)
+		runningJobs = append(runningJobs, job)
 	}
 	for gid := range needed {
 		addGraphID(gid)
 	}
-	op.ChangePlan(plan, planIndex)
+	op.mu.Lock()
+	op.Plan = plan
+	op.PlanIndex = planIndex
+	op.NumRunning = len(runningJobs)
+	op.RunningJobs = runningJobs
+	op.mu.Unlock()
 }
 
 // Used in DBExecNode.Incremental.
@@ -102,8 +126,10 @@ func (op *MultiExecJobOp) SetPlanFromMap(nodes map[int]*DBExecNode, done map[int
 	}
 	planIndex := len(plan)
 	// Add pending ones.
+	numRunning := 0
 	if curID != -1 {
 		addNode(nodes[curID])
+		numRunning = 1
 	}
 	for id, node := range nodes {
 		if done[id] || id == curID {
@@ -111,5 +137,5 @@ func (op *MultiExecJobOp) SetPlanFromMap(nodes map[int]*DBExecNode, done map[int
 		}
 		addNode(node)
 	}
-	op.ChangePlan(plan, planIndex)
+	op.ChangePlan(plan, planIndex, numRunning)
 }
@@ -0,0 +1,512 @@
+package app
+
+import (
+	"github.com/skyhookml/skyhookml/skyhook"
+
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// AppJobOp writes every console line to a log file, so that the complete output
+// is available even after TailOp drops old lines and after restart.
+// Once the log exceeds Config.JobLogMaxSize bytes, it is rotated to {id}.log.N
+// (N=1, 2, ...) and compressed in the background to {id}.log.N.gz.
+
+// Returns the path of the active log of a job.
+func GetJobLogPath(jobID int) string {
+	return filepath.Join("data", "jobs", fmt.Sprintf("%d.log", jobID))
+}
+
+// Returns paths of the segments of a job's log, oldest first.
+// The last segment is the active (uncompressed) log, if it exists.
+func getJobLogSegments(jobID int) []string {
+	base := GetJobLogPath(jobID)
+	fnames, _ := filepath.Glob(base + ".*")
+	rotated := make(map[int]string)
+	for _, fname := range fnames {
+		suffix := strings.TrimPrefix(fname, base+".")
+		isCompressed := strings.HasSuffix(suffix, ".gz")
+		idx, err := strconv.Atoi(strings.TrimSuffix(suffix, ".gz"))
+		if err != nil {
+			// e.g. .gz.tmp from in-progress compression
+			continue
+		}
+		// if compression just finished, both files may exist
+		if _, ok := rotated[idx]; ok && !isCompressed {
+			continue
+		}
+		rotated[idx] = fname
+	}
+	var indices []int
+	for idx := range rotated {
+		indices = append(indices, idx)
+	}
+	sort.Ints(indices)
+	var segments []string
+	for _, idx := range indices {
+		segments = append(segments, rotated[idx])
+	}
+	if _, err := os.Stat(base); err == nil {
+		segments = append(segments, base)
+	}
+	return segments
+}
+
+type gzipReadCloser struct {
+	*gzip.Reader
+	file *os.File
+}
+
+func (r gzipReadCloser) Close() error {
+	r.Reader.Close()
+	return r.file.Close()
+}
+
+func openJobLogSegment(fname string) (io.ReadCloser, error) {
+	file, err := os.Open(fname)
+	if os.IsNotExist(err) && !strings.HasSuffix(fname, ".gz") {
+		// the segment may have been compressed after we listed it
+		fname += ".gz"
+		file, err = os.Open(fname)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(fname, ".gz") {
+		return file, nil
+	}
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return gzipReadCloser{gz, file}, nil
+}
+
+// Reads the concatenation of log segments, decompressing as needed.
+type jobLogReader struct {
+	segments []string
+	cur io.ReadCloser
+}
+
+func (r *jobLogReader) Read(p []byte) (int, error) {
+	for {
+		if r.cur == nil {
+			if len(r.segments) == 0 {
+				return 0, io.EOF
+			}
+			rc, err := openJobLogSegment(r.segments[0])
+			if err != nil {
+				return 0, err
+			}
+			r.segments = r.segments[1:]
+			r.cur = rc
+		}
+		n, err := r.cur.Read(p)
+		if err == io.EOF {
+			r.cur.Close()
+			r.cur = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+func (r *jobLogReader) Close() error {
+	if r.cur == nil {
+		return nil
+	}
+	err := r.cur.Close()
+	r.cur = nil
+	return err
+}
+
+// Open the full log of a job, across rotated segments.
+// The log is empty if the job has no log.
+func OpenJobLog(jobID int) io.ReadCloser {
+	return &jobLogReader{segments: getJobLogSegments(jobID)}
+}
+
+// Returns the uncompressed size of the log segments.
+// For compressed segments, we use the size recorded in the gzip trailer, which
+// is exact since segments are much smaller than 4 GB.
+func getJobLogSize(segments []string) int64 {
+	var size int64
+	for _, fname := range segments {
+		if !strings.HasSuffix(fname, ".gz") {
+			if fi, err := os.Stat(fname); err == nil {
+				size += fi.Size()
+				continue
+			}
+			fname += ".gz"
+		}
+		file, err := os.Open(fname)
+		if err != nil {
+			continue
+		}
+		var trailer [4]byte
+		if fi, err := file.Stat(); err == nil && fi.Size() >= 4 {
+			if _, err := file.ReadAt(trailer[:], fi.Size()-4); err == nil {
+				size += int64(binary.LittleEndian.Uint32(trailer[:]))
+			}
+		}
+		file.Close()
+	}
+	return size
+}
+
+// Read lines of a job's log, starting from the specified line.
+func ReadJobLog(jobID int, from int) ([]string, error) {
+	r := OpenJobLog(jobID)
+	defer r.Close()
+	var lines []string
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 16*1024*1024)
+	for counter := 0; scanner.Scan(); counter++ {
+		if counter < from {
+			continue
+		}
+		lines = append(lines, scanner.Text())
+	}
+	return lines, scanner.Err()
+}
+
+// Returns the number of lines in a job's log.
+func countJobLogLines(jobID int) (int, error) {
+	r := OpenJobLog(jobID)
+	defer r.Close()
+	buf := make([]byte, 64*1024)
+	count := 0
+	for {
+		n, err := r.Read(buf)
+		count += bytes.Count(buf[0:n], []byte{'\n'})
+		if err == io.EOF {
+			return count, nil
+		} else if err != nil {
+			return count, err
+		}
+	}
+}
+
+// Compress a rotated log segment.
+// The uncompressed segment is removed only after the compressed one is in
+// place, so readers always see one of them.
+func compressJobLogSegment(fname string) error {
+	src, err := os.Open(fname)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	tmpFname := fname + ".gz.tmp"
+	dst, err := os.Create(tmpFname)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(dst)
+	_, err = io.Copy(gz, src)
+	if err == nil {
+		err = gz.Close()
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpFname, fname+".gz")
+	}
+	if err != nil {
+		os.Remove(tmpFname)
+		return err
+	}
+	return os.Remove(fname)
+}
+
+// Append lines to the job log, opening it first if needed.
+// Returns the index of the first appended line in the log.
+// Errors are logged but otherwise ignored, since the log is not essential for
+// running the job.
+// Caller must have the lock.
+func (op *AppJobOp) appendLog(lines []string) int {
+	if !op.logOpened {
+		op.openLog()
+	}
+	firstLine := op.numLogLines
+	op.numLogLines += len(lines)
+	if op.logFile == nil || len(lines) == 0 {
+		return firstLine
+	}
+	n, err := op.logFile.WriteString(strings.Join(lines, "\n") + "\n")
+	if err != nil {
+		log.Printf("[job %d] error writing log: %v", op.Job.ID, err)
+	}
+	op.logSize += int64(n)
+	if Config.JobLogMaxSize > 0 && op.logSize >= Config.JobLogMaxSize {
+		op.rotateLog()
+	}
+	return firstLine
+}
+
+// Caller must have the lock.
+func (op *AppJobOp) openLog() {
+	op.logOpened = true
+	// if the job is being resumed, we continue the existing log
+	var err error
+	op.numLogLines, err = countJobLogLines(op.Job.ID)
+	if err != nil {
+		log.Printf("[job %d] error reading existing log: %v", op.Job.ID, err)
+	}
+	for _, fname := range getJobLogSegments(op.Job.ID) {
+		suffix := strings.TrimPrefix(fname, GetJobLogPath(op.Job.ID)+".")
+		if idx, err := strconv.Atoi(strings.TrimSuffix(suffix, ".gz")); err == nil && idx > op.logSegment {
+			op.logSegment = idx
+		}
+	}
+
+	fname := GetJobLogPath(op.Job.ID)
+	if err := os.MkdirAll(filepath.Dir(fname), 0755); err != nil {
+		log.Printf("[job %d] error creating log directory: %v", op.Job.ID, err)
+		return
+	}
+	op.logFile, err = os.OpenFile(fname, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Printf("[job %d] error opening log: %v", op.Job.ID, err)
+		return
+	}
+	if fi, err := op.logFile.Stat(); err == nil {
+		op.logSize = fi.Size()
+	}
+}
+
+// Move the active log to a new segment and start a new active log.
+// Caller must have the lock.
+func (op *AppJobOp) rotateLog() {
+	op.closeLog()
+	fname := GetJobLogPath(op.Job.ID)
+	op.logSegment++
+	segmentFname := fmt.Sprintf("%s.%d", fname, op.logSegment)
+	if err := os.Rename(fname, segmentFname); err != nil {
+		log.Printf("[job %d] error rotating log: %v", op.Job.ID, err)
+	} else {
+		go func() {
+			if err := compressJobLogSegment(segmentFname); err != nil {
+				log.Printf("[job %d] error compressing log segment %s: %v", op.Job.ID, segmentFname, err)
+			}
+		}()
+	}
+	var err error
+	op.logFile, err = os.OpenFile(fname, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Printf("[job %d] error opening log: %v", op.Job.ID, err)
+	}
+	op.logSize = 0
+}
+
+// Caller must have the lock.
+func (op *AppJobOp) closeLog() {
+	if op.logFile != nil {
+		op.logFile.Close()
+		op.logFile = nil
+	}
+}
+
+// Delete logs of jobs that are no longer running and were last written more
+// than Config.JobLogRetention ago, along with logs of jobs that were deleted.
+// The state persisted to resume these jobs (see resume.go) is deleted too.
+// Returns the number of jobs whose logs were deleted.
+func PruneJobLogs() int {
+	fnames, _ := filepath.Glob(filepath.Join("data", "jobs", "*.log*"))
+	// map from job ID to the last modification time of its segments
+	lastModified := make(map[int]time.Time)
+	for _, fname := range fnames {
+		prefix := strings.SplitN(filepath.Base(fname), ".", 2)[0]
+		jobID, err := strconv.Atoi(prefix)
+		if err != nil {
+			continue
+		}
+		fi, err := os.Stat(fname)
+		if err != nil {
+			continue
+		}
+		if fi.ModTime().After(lastModified[jobID]) {
+			lastModified[jobID] = fi.ModTime()
+		}
+	}
+
+	count := 0
+	for jobID, t := range lastModified {
+		job := GetJob(jobID)
+		if job != nil && (!job.Done || time.Since(t) < Config.JobLogRetention) {
+			continue
+		}
+		matches, _ := filepath.Glob(GetJobLogPath(jobID) + "*")
+		for _, fname := range matches {
+			if err := os.Remove(fname); err != nil {
+				log.Printf("[job %d] error pruning log %s: %v", jobID, fname, err)
+			}
+		}
+		// jobs that were not resumed within the retention are not resumable
+		deleteResumeState(jobID)
+		count++
+	}
+	pruneResumeStates()
+	return count
+}
+
+// Periodically prune job logs, if Config.JobLogRetention is set.
+func StartJobLogPruner() {
+	if Config.JobLogRetention <= 0 {
+		return
+	}
+	go func() {
+		for {
+			if count := PruneJobLogs(); count > 0 {
+				log.Printf("[job-log] pruned logs of %d jobs", count)
+			}
+			time.Sleep(time.Hour)
+		}
+	}()
+}
+
+// Parse a Range header with a single byte range, e.g. "bytes=0-99", "bytes=100-"
+// or "bytes=-100".
+// Returns the start offset and length, or ok=false if the range is invalid or
+// not satisfiable.
+func parseByteRange(s string, size int64) (start int64, length int64, ok bool) {
+	if !strings.HasPrefix(s, "bytes=") || strings.Contains(s, ",") {
+		return 0, 0, false
+	}
+	parts := strings.SplitN(strings.TrimPrefix(s, "bytes="), "-", 2)
+	if len(parts) != 2 {
+		return 0, 0, false
+	}
+	if parts[0] == "" {
+		// suffix range
+		n, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil || n <= 0 {
+			return 0, 0, false
+		}
+		if n > size {
+			n = size
+		}
+		return size-n, n, size > 0
+	}
+	start, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || start < 0 || start >= size {
+		return 0, 0, false
+	}
+	end := size-1
+	if parts[1] != "" {
+		end, err = strconv.ParseInt(parts[1], 10, 64)
+		if err != nil || end < start {
+			return 0, 0, false
+		}
+		if end > size-1 {
+			end = size-1
+		}
+	}
+	return start, end-start+1, true
+}
+
+func init() {
+	// Get the full log of a job as text.
+	// Supports single byte ranges (Range header), and filtering lines by a regular
+	// expression with ?grep=pattern. With grep, the response is not ranged, and:
+	// - ?i=1 makes the match case-insensitive
+	// - ?v=1 selects non-matching lines instead
+	// - ?n=1 prefixes each line with its (1-based) line number
+	// ?download=1 serves the log as an attachment.
+	Router.HandleFunc("/jobs/{job_id}/log", func(w http.ResponseWriter, r *http.Request) {
+		jobID := skyhook.ParseInt(mux.Vars(r)["job_id"])
+		if GetJob(jobID) == nil {
+			http.Error(w, "no such job", 404)
+			return
+		}
+		query := r.URL.Query()
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if query.Get("download") == "1" {
+			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"job-%d.log\"", jobID))
+		}
+
+		segments := getJobLogSegments(jobID)
+		rd := &jobLogReader{segments: segments}
+		defer rd.Close()
+
+		if pattern := query.Get("grep"); pattern != "" {
+			if query.Get("i") == "1" {
+				pattern = "(?i)" + pattern
+			}
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid pattern: %v", err), 400)
+				return
+			}
+			invert := query.Get("v") == "1"
+			lineNumbers := query.Get("n") == "1"
+			bw := bufio.NewWriter(w)
+			scanner := bufio.NewScanner(rd)
+			scanner.Buffer(nil, 16*1024*1024)
+			for counter := 1; scanner.Scan(); counter++ {
+				line := scanner.Text()
+				if re.MatchString(line) == invert {
+					continue
+				}
+				if lineNumbers {
+					fmt.Fprintf(bw, "%d:", counter)
+				}
+				bw.WriteString(line)
+				bw.WriteString("\n")
+			}
+			if err := scanner.Err(); err != nil {
+				log.Printf("[job %d] error reading log: %v", jobID, err)
+			}
+			bw.Flush()
+			return
+		}
+
+		size := getJobLogSize(segments)
+		w.Header().Set("Accept-Ranges", "bytes")
+		start, length := int64(0), size
+		status := http.StatusOK
+		if rangeHeader := r.Header.Get("Range"); rangeHeader != "" {
+			var ok bool
+			start, length, ok = parseByteRange(rangeHeader, size)
+			if !ok {
+				w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+				http.Error(w, "invalid range", http.StatusRequestedRangeNotSatisfiable)
+				return
+			}
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, start+length-1, size))
+			status = http.StatusPartialContent
+		}
+		if _, err := io.CopyN(io.Discard, rd, start); err != nil {
+			http.Error(w, fmt.Sprintf("error reading log: %v", err), 500)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+		w.WriteHeader(status)
+		if r.Method == "HEAD" {
+			return
+		}
+		if _, err := io.CopyN(w, rd, length); err != nil {
+			log.Printf("[job %d] error serving log: %v", jobID, err)
+		}
+	}).Methods("GET", "HEAD")
+}
@@ -0,0 +1,235 @@
+package app
+
+import (
+	"github.com/skyhookml/skyhookml/skyhook"
+
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// An update pushed to /jobs/{id}/stream clients.
+type JobStreamEvent struct {
+	// Index of the first element of Lines within the full job log.
+	FirstLine int
+	Lines []string
+	// Encoded state of the wrapped JobOps, e.g. progress.
+	Datas map[string]string
+	// Set only on the last event, when the job is done.
+	Job *DBJob
+}
+
+// Subscribe to updates of this job.
+// The channel is closed when the job is done, or if the client doesn't keep up.
+func (op *AppJobOp) Subscribe() chan JobStreamEvent {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	ch := make(chan JobStreamEvent, 256)
+	if op.Stopped {
+		close(ch)
+		return ch
+	}
+	if op.subscribers == nil {
+		op.subscribers = make(map[chan JobStreamEvent]bool)
+	}
+	op.subscribers[ch] = true
+	return ch
+}
+
+func (op *AppJobOp) Unsubscribe(ch chan JobStreamEvent) {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	if op.subscribers[ch] {
+		delete(op.subscribers, ch)
+		close(ch)
+	}
+}
+
+// Returns the encoded state along with the number of lines in the full log.
+func (op *AppJobOp) getStreamState() (string, int) {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	return op.encode(), op.numLogLines
+}
+
+// Send event to subscribers.
+// Subscribers whose buffer is full are dropped; they can reconnect and resume
+// from the last line they received.
+// Caller must have the lock.
+func (op *AppJobOp) publish(event JobStreamEvent) {
+	for ch := range op.subscribers {
+		select {
+		case ch <- event:
+		default:
+			delete(op.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// Write a Server-Sent Event.
+func writeSSE(w io.Writer, event string, id string, data interface{}) {
+	if id != "" {
+		fmt.Fprintf(w, "id: %s\n", id)
+	}
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, skyhook.JsonMarshal(data))
+}
+
+func init() {
+	// Stream job updates as Server-Sent Events.
+	// Events:
+	// - state: the current job state, same as /jobs/{id}/state, sent first
+	// - update: a JobStreamEvent with new console lines and wrapped JobOp datas
+	// - done: the DBJob, after which the stream ends
+	// update events have the line count as ID, so that clients reconnecting with
+	// Last-Event-ID (or ?since=N) get the lines they missed from the full log.
+	Router.HandleFunc("/jobs/{job_id}/stream", func(w http.ResponseWriter, r *http.Request) {
+		jobID := skyhook.ParseInt(mux.Vars(r)["job_id"])
+		job := GetJob(jobID)
+		if job == nil {
+			http.Error(w, "no such job", 404)
+			return
+		}
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming is not supported", 500)
+			return
+		}
+
+		since := -1
+		if s := r.Header.Get("Last-Event-ID"); s != "" {
+			since, _ = strconv.Atoi(s)
+		} else if s := r.URL.Query().Get("since"); s != "" {
+			since, _ = strconv.Atoi(s)
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+
+		// Subscribe before getting the current state so we don't miss lines.
+		jobMu.Lock()
+		jobOp := runningJobs[jobID]
+		jobMu.Unlock()
+		appOp, _ := jobOp.(*AppJobOp)
+		var ch chan JobStreamEvent
+		if appOp != nil && !job.Done {
+			ch = appOp.Subscribe()
+			defer appOp.Unsubscribe(ch)
+		}
+
+		// Determine the initial state.
+		getState := func() string {
+			if !job.Done && jobOp != nil {
+				return jobOp.Encode()
+			}
+			state := job.GetState()
+			if state == "" {
+				state = "null"
+			}
+			return state
+		}
+		var state string
+		sentLines := 0
+		if appOp != nil && !job.Done {
+			state, sentLines = appOp.getStreamState()
+		} else {
+			state = getState()
+		}
+		if since < 0 {
+			writeSSE(w, "state", "", struct{
+				Job *DBJob
+				State string
+			}{job, state})
+		} else {
+			// The client is reconnecting, so instead of the state (which would
+			// duplicate the tail lines), replay the lines that the client missed.
+			lines, err := ReadJobLog(jobID, since)
+			if err != nil {
+				log.Printf("[job %d] error reading log for stream: %v", jobID, err)
+			}
+			// The state only has datas for AppJobOp jobs, so ignore decode errors.
+			var appState AppJobState
+			json.Unmarshal([]byte(state), &appState)
+			sentLines = since + len(lines)
+			writeSSE(w, "update", strconv.Itoa(sentLines), JobStreamEvent{
+				FirstLine: since,
+				Lines: lines,
+				Datas: appState.Datas,
+			})
+		}
+		flusher.Flush()
+
+		if job.Done {
+			writeSSE(w, "done", "", job)
+			flusher.Flush()
+			return
+		}
+
+		// For jobs that don't support subscription, we poll the state instead.
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		lastKeepalive := time.Now()
+		for {
+			select {
+			case event, ok := <-ch:
+				if !ok {
+					// Either the job finished, or we fell behind and the client
+					// should reconnect.
+					if job = GetJob(jobID); job.Done {
+						writeSSE(w, "done", "", job)
+						flusher.Flush()
+					}
+					return
+				}
+				if event.Job != nil {
+					writeSSE(w, "done", "", event.Job)
+					flusher.Flush()
+					return
+				}
+				// Skip lines that the client already has.
+				if skip := sentLines - event.FirstLine; skip > 0 {
+					if skip >= len(event.Lines) {
+						event.Lines = nil
+					} else {
+						event.Lines = event.Lines[skip:]
+					}
+					event.FirstLine = sentLines
+				}
+				sentLines = event.FirstLine + len(event.Lines)
+				writeSSE(w, "update", strconv.Itoa(sentLines), event)
+				flusher.Flush()
+			case <-ticker.C:
+				if appOp == nil {
+					job = GetJob(jobID)
+					if newState := getState(); newState != state {
+						state = newState
+						writeSSE(w, "state", "", struct{
+							Job *DBJob
+							State string
+						}{job, state})
+						flusher.Flush()
+					}
+					if job.Done {
+						writeSSE(w, "done", "", job)
+						flusher.Flush()
+						return
+					}
+				} else if time.Since(lastKeepalive) > 15*time.Second {
+					// Comment lines keep proxies from closing idle connections.
+					fmt.Fprintf(w, ": keepalive\n\n")
+					flusher.Flush()
+					lastKeepalive = time.Now()
+				}
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}).Methods("GET")
+}
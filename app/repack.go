@@ -0,0 +1,392 @@
+package app
+
+import (
+	"github.com/skyhookml/skyhookml/skyhook"
+
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Default maximum size of each shard when packing a dataset into shards.
+const DefaultShardSize int64 = 1024*1024*1024
+
+// Returns the index that the next new shard in the dataset should use.
+func (ds *DBDataset) nextShardIndex() (int, error) {
+	shards, err := ds.ListShards()
+	if err != nil {
+		return 0, err
+	}
+	next := 0
+	for _, shard := range shards {
+		var idx int
+		if _, err := fmt.Sscanf(shard, "shard-%d.tar", &idx); err != nil {
+			continue
+		}
+		if idx >= next {
+			next = idx+1
+		}
+	}
+	return next, nil
+}
+
+// Files and shards in a dataset directory that items in other datasets point
+// at, e.g. through the reference or shard providers, so repacking the dataset
+// must not remove them.
+type externalRefs struct {
+	Files map[string]bool
+	Shards map[string]bool
+}
+
+func (refs externalRefs) add(ds skyhook.Dataset, item skyhook.Item) {
+	if item.Provider == nil {
+		if item.Dataset.ID == ds.ID {
+			refs.Files[item.Fname()] = true
+		}
+		return
+	}
+	switch *item.Provider {
+	case "reference":
+		if strings.HasPrefix(*item.ProviderInfo, ds.Dirname()+"/") {
+			refs.Files[*item.ProviderInfo] = true
+		}
+	case "shard":
+		var loc skyhook.ShardLocation
+		skyhook.JsonUnmarshal([]byte(*item.ProviderInfo), &loc)
+		if loc.Dataset == ds.ID {
+			refs.Shards[loc.Shard] = true
+		}
+	default:
+		// virtual providers store the wrapped item as JSON
+		var wrapped skyhook.Item
+		if err := json.Unmarshal([]byte(*item.ProviderInfo), &wrapped); err == nil && wrapped.Dataset.ID != 0 {
+			refs.add(ds, wrapped)
+		}
+	}
+}
+
+func (ds *DBDataset) getExternalRefs() externalRefs {
+	refs := externalRefs{
+		Files: make(map[string]bool),
+		Shards: make(map[string]bool),
+	}
+	for _, other := range ListDatasets() {
+		if other.ID == ds.ID {
+			continue
+		}
+		rows := other.getDB().Query(ItemQuery + " WHERE provider IS NOT NULL")
+		for _, item := range itemListHelper(rows) {
+			item.Dataset = other.Dataset
+			refs.add(ds.Dataset, item.Item)
+		}
+	}
+	return refs
+}
+
+// Returns whether a repack job other than jobID is running on the dataset.
+func isRepacking(dsID int, jobID int) bool {
+	var count int
+	db.QueryRow("SELECT COUNT(*) FROM jobs WHERE done = 0 AND type = 'repack' AND metadata = ? AND id != ?", strconv.Itoa(dsID), jobID).Scan(&count)
+	return count > 0
+}
+
+// Returns an error if a job other than jobID may be writing to the dataset,
+// i.e. another repack of it or a run of an exec node that outputs to it.
+// As in RunNode, the caller first creates its job and then checks for
+// conflicts, so that two conflicting jobs cannot both proceed.
+func (ds *DBDataset) checkRepackConflicts(jobID int) error {
+	if isRepacking(ds.ID, jobID) {
+		return fmt.Errorf("dataset %s is already being repacked", ds.Name)
+	}
+	nodes := make(map[int]string)
+	rows := db.Query("SELECT n.id, n.name FROM exec_ds_refs AS r, exec_nodes AS n WHERE r.node_id = n.id AND r.dataset_id = ?", ds.ID)
+	for rows.Next() {
+		var id int
+		var name string
+		rows.Scan(&id, &name)
+		nodes[id] = name
+	}
+	return checkNodeConflicts(nodes, jobID)
+}
+
+// Pack items that are stored in local files into new shard files.
+// Items in other providers (e.g. references or remote storage) are left as is,
+// and so are items whose files other datasets point at.
+// The index is only updated after each shard is complete, and then the
+// original files are removed, so the dataset stays readable if this fails.
+// Items whose files change while they are packed are left as files.
+func (ds *DBDataset) RepackToShards(shardSize int64, opts ImportOptions) error {
+	if ds.DataType == skyhook.VideoType {
+		return fmt.Errorf("video datasets cannot be packed into shards")
+	}
+	if shardSize <= 0 {
+		shardSize = DefaultShardSize
+	}
+	nextShard, err := ds.nextShardIndex()
+	if err != nil {
+		return err
+	}
+
+	refs := ds.getExternalRefs()
+	var items []*DBItem
+	var skipped int
+	for _, item := range ds.ListItems() {
+		if item.Provider != nil {
+			continue
+		}
+		if refs.Files[item.Fname()] {
+			skipped++
+			continue
+		}
+		items = append(items, item)
+	}
+	log.Printf("[repack] packing %d items in %s into shards (skipping %d referenced by other datasets)", len(items), ds.Name, skipped)
+	opts.SetTasks(len(items))
+
+	type packedItem struct {
+		Key string
+		Fname string
+		// the file when it was packed
+		Info os.FileInfo
+		Location skyhook.ShardLocation
+	}
+	var writer *skyhook.ShardWriter
+	var pending []packedItem
+	finishShard := func() error {
+		if writer == nil {
+			return nil
+		}
+		if err := writer.Close(); err != nil {
+			return fmt.Errorf("error writing shard %s: %v", writer.Name, err)
+		}
+		// skip items that were written while we packed them, since the shard
+		// may have a partial or outdated copy
+		var packed []packedItem
+		for _, p := range pending {
+			fi, err := os.Stat(p.Fname)
+			if err != nil || !os.SameFile(fi, p.Info) || fi.Size() != p.Info.Size() || !fi.ModTime().Equal(p.Info.ModTime()) {
+				log.Printf("[repack] item %s in %s changed while packing it, leaving it as a file", p.Key, ds.Name)
+				continue
+			}
+			packed = append(packed, p)
+		}
+		ds.getDB().Transaction(func(tx Tx) {
+			for _, p := range packed {
+				tx.Exec(
+					"UPDATE items SET provider = 'shard', provider_info = ? WHERE k = ?",
+					string(skyhook.JsonMarshal(p.Location)), p.Key,
+				)
+			}
+		})
+		for _, p := range packed {
+			skyhook.RemoveItemFile(p.Fname)
+		}
+		opts.CompletedTask(fmt.Sprintf("Packed %d items into %s", len(packed), writer.Name), 0)
+		writer = nil
+		pending = nil
+		return nil
+	}
+
+	for _, item := range items {
+		if writer != nil && writer.Size() >= shardSize {
+			if err := finishShard(); err != nil {
+				return err
+			}
+		}
+		if writer == nil {
+			writer, err = skyhook.CreateShard(ds.Dataset, skyhook.ShardName(nextShard))
+			if err != nil {
+				return err
+			}
+			nextShard++
+		}
+
+		fname := item.Fname()
+		file, err := os.Open(fname)
+		if err != nil {
+			return fmt.Errorf("error reading item %s: %v", item.Key, err)
+		}
+		fi, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return err
+		}
+		loc, err := writer.Add(item.Key+"."+item.Ext, file, fi.Size())
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("error packing item %s: %v", item.Key, err)
+		}
+		pending = append(pending, packedItem{item.Key, fname, fi, loc})
+
+		if opts.CompletedTask("", 1) {
+			// keep the items that were already packed
+			if err := finishShard(); err != nil {
+				return err
+			}
+			return fmt.Errorf("stopped by user")
+		}
+	}
+	return finishShard()
+}
+
+// Unpack items in shards into one local file per item.
+// Shard files in the dataset directory are removed once all items are
+// unpacked, except those that items in other datasets still point at.
+func (ds *DBDataset) RepackToFiles(opts ImportOptions) error {
+	var items []*DBItem
+	for _, item := range ds.ListItems() {
+		if item.Provider != nil && *item.Provider == "shard" {
+			items = append(items, item)
+		}
+	}
+	log.Printf("[repack] unpacking %d items in %s into files", len(items), ds.Name)
+	opts.SetTasks(len(items))
+	ds.Mkdir()
+	db := ds.getDB()
+
+	for _, item := range items {
+		rd, err := item.GetProvider().Open(item.Item)
+		if err != nil {
+			return fmt.Errorf("error reading item %s: %v", item.Key, err)
+		}
+		fileItem := item.Item
+		fileItem.Provider = nil
+		fileItem.ProviderInfo = nil
+		err = skyhook.WriteItemFile(fileItem.Fname(), func(w io.Writer) error {
+			_, err := io.Copy(w, rd)
+			return err
+		})
+		rd.Close()
+		if err != nil {
+			return fmt.Errorf("error unpacking item %s: %v", item.Key, err)
+		}
+		db.Exec("UPDATE items SET provider = NULL, provider_info = NULL WHERE k = ?", item.Key)
+
+		if opts.CompletedTask("", 1) {
+			return fmt.Errorf("stopped by user")
+		}
+	}
+
+	shards, err := ds.ListShards()
+	if err != nil {
+		return err
+	}
+	refs := ds.getExternalRefs()
+	var removed int
+	for _, shard := range shards {
+		if refs.Shards[shard] {
+			continue
+		}
+		os.Remove(skyhook.ShardLocation{Dataset: ds.ID, Shard: shard}.Fname())
+		removed++
+	}
+	opts.CompletedTask(fmt.Sprintf("Unpacked %d items and removed %d shards (%d kept for other datasets)", len(items), removed, len(shards)-removed), 0)
+	return nil
+}
+
+// Replace the data of an item in a shard by moving it out into a local file.
+// The old data stays in the shard until the dataset is repacked or deleted.
+func (item *DBItem) unpackWithData(format string, metadata string, data skyhook.Data) error {
+	item.Load()
+	fileItem := item.Item
+	fileItem.Format = format
+	fileItem.Metadata = metadata
+	fileItem.Provider = nil
+	fileItem.ProviderInfo = nil
+	if err := fileItem.UpdateData(data); err != nil {
+		return err
+	}
+	db := (&DBDataset{Dataset: item.Dataset}).getDB()
+	db.Exec(
+		"UPDATE items SET format = ?, metadata = ?, provider = NULL, provider_info = NULL WHERE k = ?",
+		format, metadata, item.Key,
+	)
+	item.Item = fileItem
+	return nil
+}
+
+func init() {
+	Router.HandleFunc("/datasets/{ds_id}/repack", func(w http.ResponseWriter, r *http.Request) {
+		dsID := skyhook.ParseInt(mux.Vars(r)["ds_id"])
+		dataset := GetDataset(dsID)
+		if dataset == nil {
+			http.Error(w, "no such dataset", 404)
+			return
+		}
+		if err := dataset.checkMutable(); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		if !dataset.Done {
+			http.Error(w, "dataset is still being computed", 400)
+			return
+		}
+
+		r.ParseForm()
+		// "shards" to pack items into shard files, or "files" to unpack them
+		layout := r.PostForm.Get("layout")
+		if layout != "shards" && layout != "files" {
+			http.Error(w, "layout must be shards or files", 400)
+			return
+		}
+		// maximum shard size in MB
+		var shardSize int64
+		if str := r.PostForm.Get("shard_size"); str != "" {
+			mb, err := strconv.ParseInt(str, 10, 64)
+			if err != nil || mb <= 0 {
+				http.Error(w, "invalid shard size", 400)
+				return
+			}
+			shardSize = mb*1024*1024
+		}
+
+		job := NewJob(
+			fmt.Sprintf("Repack %s", dataset.Name),
+			"repack",
+			"consoleprogress",
+			strconv.Itoa(dataset.ID),
+		)
+		progressJobOp := &ProgressJobOp{}
+		jobOp := &AppJobOp{
+			Job: job,
+			TailOp: &skyhook.TailJobOp{},
+			WrappedJobOps: map[string]skyhook.JobOp{
+				"progress": progressJobOp,
+			},
+		}
+		if err := dataset.checkRepackConflicts(job.ID); err != nil {
+			job.SetDone(err.Error())
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		job.AttachOp(jobOp)
+		opts := ImportOptions{
+			AppJobOp: jobOp,
+			ProgressJobOp: progressJobOp,
+		}
+
+		log.Printf("[repack] user requested repack of dataset %s into %s", dataset.Name, layout)
+		go func() {
+			var err error
+			if layout == "shards" {
+				err = dataset.RepackToShards(shardSize, opts)
+			} else {
+				err = dataset.RepackToFiles(opts)
+			}
+			if err == nil {
+				log.Printf("[repack] repack of %s succeeded", dataset.Name)
+			} else {
+				log.Printf("[repack] repack of %s failed: %v", dataset.Name, err)
+			}
+			opts.AppJobOp.SetDone(err)
+		}()
+		skyhook.JsonResponse(w, job)
+	}).Methods("POST")
+}
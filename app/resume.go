@@ -0,0 +1,274 @@
+package app
+
+import (
+	"github.com/skyhookml/skyhookml/skyhook"
+
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/gorilla/mux"
+)
+
+// State persisted for a RunData while it is running, so that the run can be
+// resumed if the coordinator is restarted before it completes.
+type ResumeState struct {
+	JobID int
+	// Exec node corresponding to the run, or 0 if RunData.ExecNode is not set.
+	NodeID int
+	Name string
+	Node skyhook.Runnable
+	// All tasks that the run was started with.
+	Tasks []skyhook.ExecTask
+	WillBeDone bool
+	Retry RetryPolicy
+	// Keys of tasks that were completed successfully.
+	CompletedKeys map[string]bool
+}
+
+// Returns the tasks that still need to be applied.
+func (state ResumeState) GetPendingTasks() []skyhook.ExecTask {
+	var tasks []skyhook.ExecTask
+	for _, task := range state.Tasks {
+		if state.CompletedKeys[task.Key] {
+			continue
+		}
+		tasks = append(tasks, task)
+	}
+	return tasks
+}
+
+func GetResumeState(jobID int) *ResumeState {
+	rows := db.Query("SELECT node_id, name, runnable, tasks, will_be_done, retry FROM job_resume_states WHERE job_id = ?", jobID)
+	if !rows.Next() {
+		return nil
+	}
+	state := ResumeState{
+		JobID: jobID,
+		CompletedKeys: make(map[string]bool),
+	}
+	var runnable, tasks, retry string
+	rows.Scan(&state.NodeID, &state.Name, &runnable, &tasks, &state.WillBeDone, &retry)
+	rows.Close()
+	skyhook.JsonUnmarshal([]byte(runnable), &state.Node)
+	skyhook.JsonUnmarshal([]byte(tasks), &state.Tasks)
+	skyhook.JsonUnmarshal([]byte(retry), &state.Retry)
+
+	rows = db.Query("SELECT k FROM job_completed_keys WHERE job_id = ?", jobID)
+	for rows.Next() {
+		var key string
+		rows.Scan(&key)
+		state.CompletedKeys[key] = true
+	}
+	return &state
+}
+
+// Returns a fingerprint of the items in a dataset, which changes when items
+// are added, removed, or rewritten.
+func datasetFingerprint(ds *DBDataset) string {
+	h := sha256.New()
+	for _, item := range ds.ListItems() {
+		fmt.Fprintf(h, "%s\x00%s\x00%s\x00%s\x00", item.Key, item.Ext, item.Format, item.Metadata)
+		if item.Provider != nil {
+			fmt.Fprintf(h, "%s\x00%s\x00", *item.Provider, *item.ProviderInfo)
+		}
+		if fname := item.Fname(); fname != "" {
+			if fi, err := os.Stat(fname); err == nil {
+				fmt.Fprintf(h, "%d\x00%d\x00", fi.Size(), fi.ModTime().UnixNano())
+			}
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Returns an error if an input dataset of the state changed since the run
+// started, in which case the completed tasks may be stale.
+func (state ResumeState) checkInputs() error {
+	rows := db.Query("SELECT dataset_id, fingerprint FROM job_resume_datasets WHERE job_id = ? AND output = 0", state.JobID)
+	fingerprints := make(map[int]string)
+	for rows.Next() {
+		var id int
+		var fingerprint string
+		rows.Scan(&id, &fingerprint)
+		fingerprints[id] = fingerprint
+	}
+	for _, dslist := range state.Node.InputDatasets {
+		for _, ds := range dslist {
+			dbDataset := GetDataset(ds.ID)
+			if dbDataset == nil {
+				return fmt.Errorf("input dataset %s no longer exists", ds.Name)
+			}
+			if fingerprint, ok := fingerprints[ds.ID]; !ok || fingerprint != datasetFingerprint(dbDataset) {
+				return fmt.Errorf("input dataset %s changed since the job was interrupted", ds.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// Persist the tasks of this RunData so that it can be resumed later.
+// Keys of tasks completed in earlier runs under the same job are kept.
+func (rd *RunData) saveResumeState() {
+	var nodeID int
+	if rd.ExecNode != nil {
+		nodeID = rd.ExecNode.ID
+	}
+	db.Exec(
+		"INSERT OR REPLACE INTO job_resume_states (job_id, node_id, name, runnable, tasks, will_be_done, retry) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		rd.JobOp.Job.ID, nodeID, rd.Name,
+		string(skyhook.JsonMarshal(rd.Node)), string(skyhook.JsonMarshal(rd.Tasks)),
+		rd.WillBeDone, string(skyhook.JsonMarshal(rd.Retry)),
+	)
+
+	// record the datasets, so that we can detect changed inputs on resume, and
+	// drop the state if the outputs are cleared (see DBDataset.Clear)
+	db.Exec("DELETE FROM job_resume_datasets WHERE job_id = ?", rd.JobOp.Job.ID)
+	for _, dslist := range rd.Node.InputDatasets {
+		for _, ds := range dslist {
+			dbDataset := GetDataset(ds.ID)
+			if dbDataset == nil {
+				continue
+			}
+			db.Exec(
+				"INSERT OR REPLACE INTO job_resume_datasets (job_id, dataset_id, output, fingerprint) VALUES (?, ?, 0, ?)",
+				rd.JobOp.Job.ID, ds.ID, datasetFingerprint(dbDataset),
+			)
+		}
+	}
+	for _, ds := range rd.Node.OutputDatasets {
+		db.Exec(
+			"INSERT OR REPLACE INTO job_resume_datasets (job_id, dataset_id, output, fingerprint) VALUES (?, ?, 1, '')",
+			rd.JobOp.Job.ID, ds.ID,
+		)
+	}
+}
+
+func (rd *RunData) markTaskCompleted(key string) {
+	db.Exec("INSERT OR IGNORE INTO job_completed_keys (job_id, k) VALUES (?, ?)", rd.JobOp.Job.ID, key)
+}
+
+// Remove the persisted state once the run completes successfully.
+func (rd *RunData) clearResumeState() {
+	deleteResumeState(rd.JobOp.Job.ID)
+}
+
+func deleteResumeState(jobID int) {
+	db.Exec("DELETE FROM job_resume_states WHERE job_id = ?", jobID)
+	db.Exec("DELETE FROM job_completed_keys WHERE job_id = ?", jobID)
+	db.Exec("DELETE FROM job_resume_datasets WHERE job_id = ?", jobID)
+}
+
+// Drop the persisted state of runs that write to the dataset, since their
+// completed keys are no longer in the dataset once it is cleared.
+func dropResumeStatesForOutput(dsID int) {
+	rows := db.Query("SELECT job_id FROM job_resume_datasets WHERE dataset_id = ? AND output = 1", dsID)
+	var jobIDs []int
+	for rows.Next() {
+		var jobID int
+		rows.Scan(&jobID)
+		jobIDs = append(jobIDs, jobID)
+	}
+	for _, jobID := range jobIDs {
+		deleteResumeState(jobID)
+	}
+}
+
+// Remove persisted state of jobs that no longer exist.
+func pruneResumeStates() {
+	for _, table := range []string{"job_resume_states", "job_completed_keys", "job_resume_datasets"} {
+		db.Exec(fmt.Sprintf("DELETE FROM %s WHERE job_id NOT IN (SELECT id FROM jobs)", table))
+	}
+}
+
+// Prepare to resume the run associated with this job.
+// The RunData re-uses the job, and only includes the tasks that were not
+// completed yet. Its outputs are written to the existing output datasets.
+// Only the node of this job is resumed: if the job was started as part of a
+// MultiExec job, nodes that depend on it are not run afterwards.
+func (j *DBJob) PrepareResume() (*RunData, error) {
+	if !j.Done {
+		return nil, fmt.Errorf("job is still running")
+	}
+
+	state := GetResumeState(j.ID)
+	if state == nil {
+		return nil, fmt.Errorf("job cannot be resumed, either because it completed or because it is not an exec node run")
+	}
+
+	// Make sure the output datasets have not been deleted or re-computed since
+	// the run was interrupted. If they were cleared, the state was dropped.
+	for name, ds := range state.Node.OutputDatasets {
+		dbDataset := GetDataset(ds.ID)
+		if dbDataset == nil {
+			return nil, fmt.Errorf("output dataset %s no longer exists", name)
+		} else if dbDataset.Done {
+			return nil, fmt.Errorf("output dataset %s was already completed by another run", name)
+		}
+	}
+	if err := state.checkInputs(); err != nil {
+		return nil, err
+	}
+
+	// Make sure that no other job is writing to the output datasets.
+	// As in RunNode, we first mark our job as running and then check for
+	// conflicts, so that a concurrent RunNode or resume cannot both proceed.
+	prevError := j.Error
+	if !j.Reopen() {
+		return nil, fmt.Errorf("job is still running")
+	}
+	if state.NodeID != 0 {
+		if err := checkNodeConflicts(map[int]string{state.NodeID: state.Name}, j.ID); err != nil {
+			j.SetDone(prevError)
+			return nil, err
+		}
+	}
+
+	rd := &RunData{
+		Name: state.Name,
+		Node: state.Node,
+		Tasks: state.GetPendingTasks(),
+		WillBeDone: state.WillBeDone,
+		Retry: state.Retry,
+	}
+	if state.NodeID != 0 {
+		rd.ExecNode = GetExecNode(state.NodeID)
+	}
+
+	// Restore the console output from the interrupted run.
+	var prevState AppJobState
+	if raw := j.GetState(); raw != "" {
+		skyhook.JsonUnmarshal([]byte(raw), &prevState)
+	}
+	rd.AttachJob(j)
+	rd.JobOp.TailOp.Lines = prevState.Lines
+	rd.JobOp.Update([]string{fmt.Sprintf("Resuming job with %d of %d tasks remaining.", len(rd.Tasks), len(state.Tasks))})
+	return rd, nil
+}
+
+func init() {
+	Router.HandleFunc("/jobs/{job_id}/resume", func(w http.ResponseWriter, r *http.Request) {
+		jobID := skyhook.ParseInt(mux.Vars(r)["job_id"])
+		job := GetJob(jobID)
+		if job == nil {
+			http.Error(w, "no such job", 404)
+			return
+		}
+		rd, err := job.PrepareResume()
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		log.Printf("[job %d] resuming %s with %d remaining tasks", job.ID, rd.Name, len(rd.Tasks))
+		go func() {
+			err := rd.Run()
+			rd.SetDone()
+			if err != nil {
+				log.Printf("[job %d] error resuming %s: %v", job.ID, rd.Name, err)
+			}
+		}()
+		skyhook.JsonResponse(w, GetJob(jobID))
+	}).Methods("POST")
+}
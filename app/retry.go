@@ -0,0 +1,241 @@
+package app
+
+import (
+	"github.com/skyhookml/skyhookml/skyhook"
+
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Classes of errors that may be encountered when applying a task.
+const (
+	// The container could not be reached, e.g. because it crashed.
+	RetryNetwork string = "network"
+	// The container reported an error while applying the op on the task.
+	RetryApply string = "apply"
+)
+
+// Controls whether and how RunData.Run retries failed tasks.
+type RetryPolicy struct {
+	// Maximum number of times to try each task.
+	// Zero means to use the global policy, and one means never retry.
+	MaxAttempts int
+	// Seconds to wait before the first retry.
+	// The delay doubles after each attempt, up to MaxBackoff.
+	Backoff float64
+	MaxBackoff float64
+	// Error classes (RetryNetwork or RetryApply) that should be retried.
+	// If empty, all errors are retried.
+	RetryOn []string
+	// If set, tasks that fail permanently do not abort the node. Instead, the
+	// remaining tasks are still applied, and the node finishes with a
+	// PartialError whose keys can be re-computed later.
+	AllowPartial *bool
+}
+
+// Returns a policy where fields that are not set in this policy are taken from
+// the other policy.
+func (p RetryPolicy) Merge(other RetryPolicy) RetryPolicy {
+	if p.MaxAttempts == 0 {
+		p.MaxAttempts = other.MaxAttempts
+	}
+	if p.Backoff == 0 {
+		p.Backoff = other.Backoff
+	}
+	if p.MaxBackoff == 0 {
+		p.MaxBackoff = other.MaxBackoff
+	}
+	if len(p.RetryOn) == 0 {
+		p.RetryOn = other.RetryOn
+	}
+	if p.AllowPartial == nil {
+		p.AllowPartial = other.AllowPartial
+	}
+	return p
+}
+
+func (p RetryPolicy) IsPartialAllowed() bool {
+	return p.AllowPartial != nil && *p.AllowPartial
+}
+
+// Returns how long to wait before retrying a task that failed on the
+// specified attempt (starting from 1).
+func (p RetryPolicy) GetBackoff(attempt int) time.Duration {
+	backoff := p.Backoff * math.Pow(2, float64(attempt-1))
+	if p.MaxBackoff > 0 && backoff > p.MaxBackoff {
+		backoff = p.MaxBackoff
+	}
+	return time.Duration(backoff*float64(time.Second))
+}
+
+// Returns whether a task that failed with err on the specified attempt should
+// be tried again.
+func (p RetryPolicy) ShouldRetry(err error, attempt int) bool {
+	if attempt >= p.MaxAttempts {
+		return false
+	}
+	if len(p.RetryOn) == 0 {
+		return true
+	}
+	class := GetErrorClass(err)
+	for _, s := range p.RetryOn {
+		if s == class {
+			return true
+		}
+	}
+	return false
+}
+
+// Determine the class of an error from applying a task.
+func GetErrorClass(err error) string {
+	var httpErr skyhook.HttpError
+	var applyErr ApplyError
+	if errors.As(err, &httpErr) || errors.As(err, &applyErr) {
+		return RetryApply
+	}
+	return RetryNetwork
+}
+
+// Error returned by RunData.Run when some tasks failed permanently, but
+// RetryPolicy.AllowPartial is set so the other tasks were still completed.
+type PartialError struct {
+	// Map from keys of failed tasks to the last error on that task.
+	FailedKeys map[string]error
+	NumTasks int
+}
+
+// Returns the failed keys in sorted order.
+func (e PartialError) Keys() []string {
+	var keys []string
+	for key := range e.FailedKeys {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (e PartialError) Error() string {
+	return fmt.Sprintf("partial: %d of %d tasks failed permanently, failed keys: %s", len(e.FailedKeys), e.NumTasks, strings.Join(e.Keys(), ", "))
+}
+
+// Error returned by RunData.Run when tasks failed permanently and
+// RetryPolicy.AllowPartial is not set. No new tasks are started after the
+// first failure, but tasks that were already running may fail too.
+type TaskError struct {
+	// Map from keys of failed tasks to the last error on that task.
+	FailedKeys map[string]error
+}
+
+func (e TaskError) Error() string {
+	var keys []string
+	for key := range e.FailedKeys {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, key := range keys {
+		parts = append(parts, fmt.Sprintf("[%s]: %v", key, e.FailedKeys[key]))
+	}
+	return fmt.Sprintf("error applying on %d keys: %s", len(keys), strings.Join(parts, "; "))
+}
+
+// Get the retry policy configured at this node.
+// Fields that are not set should be taken from the global policy.
+func (node *DBExecNode) getNodeRetryPolicy() RetryPolicy {
+	var policy RetryPolicy
+	rows := db.Query("SELECT policy FROM exec_retry_policies WHERE node_id = ?", node.ID)
+	if rows.Next() {
+		var raw string
+		rows.Scan(&raw)
+		rows.Close()
+		skyhook.JsonUnmarshal([]byte(raw), &policy)
+	}
+	return policy
+}
+
+// Get the retry policy configured at this node, merged with the global one.
+func (node *DBExecNode) GetRetryPolicy() RetryPolicy {
+	return node.getNodeRetryPolicy().Merge(Config.RetryPolicy)
+}
+
+func (node *DBExecNode) SetRetryPolicy(policy RetryPolicy) {
+	db.Exec(
+		"INSERT OR REPLACE INTO exec_retry_policies (node_id, policy) VALUES (?, ?)",
+		node.ID, string(skyhook.JsonMarshal(policy)),
+	)
+}
+
+// Returns the keys of tasks at this node that failed permanently in earlier runs.
+func (node *DBExecNode) GetFailedKeys() []string {
+	keys := []string{}
+	rows := db.Query("SELECT k FROM exec_failed_keys WHERE node_id = ? ORDER BY k", node.ID)
+	for rows.Next() {
+		var key string
+		rows.Scan(&key)
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// Update the failed keys at this node after running the specified tasks.
+// failed maps from keys that failed to the error.
+func (node *DBExecNode) UpdateFailedKeys(tasks []skyhook.ExecTask, failed map[string]error) {
+	db.Transaction(func(tx Tx) {
+		for _, task := range tasks {
+			if err, ok := failed[task.Key]; ok {
+				tx.Exec("INSERT OR REPLACE INTO exec_failed_keys (node_id, k, error) VALUES (?, ?, ?)", node.ID, task.Key, err.Error())
+			} else {
+				tx.Exec("DELETE FROM exec_failed_keys WHERE node_id = ? AND k = ?", node.ID, task.Key)
+			}
+		}
+	})
+}
+
+func init() {
+	Router.HandleFunc("/exec-nodes/{node_id}/retry-policy", func(w http.ResponseWriter, r *http.Request) {
+		nodeID := skyhook.ParseInt(mux.Vars(r)["node_id"])
+		node := GetExecNode(nodeID)
+		if node == nil {
+			http.Error(w, "no such exec node", 404)
+			return
+		}
+		skyhook.JsonResponse(w, node.getNodeRetryPolicy())
+	}).Methods("GET")
+
+	Router.HandleFunc("/exec-nodes/{node_id}/retry-policy", func(w http.ResponseWriter, r *http.Request) {
+		nodeID := skyhook.ParseInt(mux.Vars(r)["node_id"])
+		node := GetExecNode(nodeID)
+		if node == nil {
+			http.Error(w, "no such exec node", 404)
+			return
+		}
+		var policy RetryPolicy
+		if err := skyhook.ParseJsonRequest(w, r, &policy); err != nil {
+			return
+		}
+		for _, class := range policy.RetryOn {
+			if class != RetryNetwork && class != RetryApply {
+				http.Error(w, fmt.Sprintf("unknown error class %s", class), 400)
+				return
+			}
+		}
+		node.SetRetryPolicy(policy)
+	}).Methods("POST")
+
+	Router.HandleFunc("/exec-nodes/{node_id}/failed-keys", func(w http.ResponseWriter, r *http.Request) {
+		nodeID := skyhook.ParseInt(mux.Vars(r)["node_id"])
+		node := GetExecNode(nodeID)
+		if node == nil {
+			http.Error(w, "no such exec node", 404)
+			return
+		}
+		skyhook.JsonResponse(w, node.GetFailedKeys())
+	}).Methods("GET")
+}
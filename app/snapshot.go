@@ -0,0 +1,538 @@
+package app
+
+import (
+	"github.com/skyhookml/skyhookml/skyhook"
+
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// A named, immutable copy of the items in a dataset.
+// The items are stored in a separate dataset of type "snapshot", so exec
+// nodes can use a snapshot as a parent like any other dataset.
+type DatasetSnapshot struct {
+	ID int
+	DatasetID int
+	Name string
+	SnapshotDatasetID int
+	Created time.Time
+}
+
+const SnapshotQuery = "SELECT id, dataset_id, name, snapshot_dataset_id, created FROM dataset_snapshots"
+
+func snapshotListHelper(rows *Rows) []DatasetSnapshot {
+	snapshots := []DatasetSnapshot{}
+	for rows.Next() {
+		var s DatasetSnapshot
+		rows.Scan(&s.ID, &s.DatasetID, &s.Name, &s.SnapshotDatasetID, &s.Created)
+		snapshots = append(snapshots, s)
+	}
+	return snapshots
+}
+
+func (ds *DBDataset) ListSnapshots() []DatasetSnapshot {
+	rows := db.Query(SnapshotQuery + " WHERE dataset_id = ? ORDER BY id", ds.ID)
+	return snapshotListHelper(rows)
+}
+
+func (ds *DBDataset) GetSnapshot(name string) *DatasetSnapshot {
+	rows := db.Query(SnapshotQuery + " WHERE dataset_id = ? AND name = ?", ds.ID, name)
+	snapshots := snapshotListHelper(rows)
+	if len(snapshots) == 1 {
+		return &snapshots[0]
+	} else {
+		return nil
+	}
+}
+
+// Returns the snapshot whose items are stored in the dataset, if any.
+func GetSnapshotByDatasetID(dsID int) *DatasetSnapshot {
+	rows := db.Query(SnapshotQuery + " WHERE snapshot_dataset_id = ?", dsID)
+	snapshots := snapshotListHelper(rows)
+	if len(snapshots) == 1 {
+		return &snapshots[0]
+	} else {
+		return nil
+	}
+}
+
+func GetSnapshotByID(id int) *DatasetSnapshot {
+	rows := db.Query(SnapshotQuery + " WHERE id = ?", id)
+	snapshots := snapshotListHelper(rows)
+	if len(snapshots) == 1 {
+		return &snapshots[0]
+	} else {
+		return nil
+	}
+}
+
+// Insert an item row directly, without applying the dataset storage.
+func (ds *DBDataset) insertItem(item skyhook.Item) {
+	ds.getDB().Exec(
+		"INSERT OR REPLACE INTO items (k, ext, format, metadata, provider, provider_info) VALUES (?, ?, ?, ?, ?, ?)",
+		item.Key, item.Ext, item.Format, item.Metadata, item.Provider, item.ProviderInfo,
+	)
+}
+
+// Copy the items of src into dst, sharing the underlying data where possible.
+// Local files (including references) are hard-linked. Items are always
+// replaced rather than overwritten in place (see skyhook.WriteItemFile), so
+// this is copy-on-write: later updates to either dataset do not affect the other.
+// Shard files are immutable once written so they are hard-linked too, while
+// objects in S3 are copied on the server since they can be overwritten.
+// Items in virtual providers wrap other items that may change later, so they
+// are materialized into local files.
+func copyItems(src *DBDataset, dst *DBDataset) error {
+	dst.Mkdir()
+	// map from shard filename in src to the shard name in dst
+	shardNames := make(map[string]string)
+	nextShard, err := dst.nextShardIndex()
+	if err != nil {
+		return err
+	}
+
+	for _, item := range src.ListItems() {
+		newItem := item.Item
+		newItem.Dataset = dst.Dataset
+		var provider string
+		if item.Provider != nil {
+			provider = *item.Provider
+		}
+
+		if provider == "" || provider == "reference" {
+			newItem.Provider = nil
+			newItem.ProviderInfo = nil
+			// link the file that an imported symlink points to, not the symlink
+			srcFname, err := filepath.EvalSymlinks(item.Fname())
+			if err != nil {
+				return fmt.Errorf("error copying item %s: %v", item.Key, err)
+			}
+			dstFname := newItem.Fname()
+			if err := os.Link(srcFname, dstFname); err != nil {
+				// e.g. the files are on different filesystems
+				if err := skyhook.CopyItemFile(srcFname, dstFname); err != nil {
+					return fmt.Errorf("error copying item %s: %v", item.Key, err)
+				}
+			}
+		} else if provider == "shard" {
+			var loc skyhook.ShardLocation
+			skyhook.JsonUnmarshal([]byte(*item.ProviderInfo), &loc)
+			srcFname := loc.Fname()
+			if shardNames[srcFname] == "" {
+				shardNames[srcFname] = skyhook.ShardName(nextShard)
+				nextShard++
+				dstFname := skyhook.ShardLocation{Dataset: dst.ID, Shard: shardNames[srcFname]}.Fname()
+				if err := os.Link(srcFname, dstFname); err != nil {
+					if err := skyhook.CopyFile(srcFname, dstFname); err != nil {
+						return fmt.Errorf("error copying shard %s: %v", srcFname, err)
+					}
+				}
+			}
+			loc.Dataset = dst.ID
+			loc.Shard = shardNames[srcFname]
+			newItem.ProviderInfo = new(string)
+			*newItem.ProviderInfo = string(skyhook.JsonMarshal(loc))
+		} else if provider == "s3" {
+			var loc skyhook.S3Location
+			skyhook.JsonUnmarshal([]byte(*item.ProviderInfo), &loc)
+			// snapshots have no storage of their own, so they use the storage
+			// of the source, or else the bucket and prefix of the object
+			storage := dst.GetStorage()
+			if storage == nil {
+				storage = src.GetStorage()
+			}
+			if storage == nil {
+				prefix := path.Dir(path.Dir(loc.Key))
+				if prefix == "." {
+					prefix = ""
+				}
+				storage = &DatasetStorage{Provider: "s3", Bucket: loc.Bucket, Prefix: prefix}
+			}
+			storage.SetItemProvider(dst.Dataset, &newItem)
+			var dstLoc skyhook.S3Location
+			skyhook.JsonUnmarshal([]byte(*newItem.ProviderInfo), &dstLoc)
+			if err := skyhook.S3.CopyObject(loc, dstLoc); err != nil {
+				return fmt.Errorf("error copying item %s: %v", item.Key, err)
+			}
+		} else {
+			newItem.Provider = nil
+			newItem.ProviderInfo = nil
+			if err := item.Item.CopyToItem(newItem, item.Format, false); err != nil {
+				return fmt.Errorf("error materializing item %s: %v", item.Key, err)
+			}
+		}
+
+		dst.insertItem(newItem)
+	}
+	return nil
+}
+
+// Create a snapshot of the current items in the dataset.
+func (ds *DBDataset) CreateSnapshot(name string) (*DatasetSnapshot, error) {
+	if ds.Type == "snapshot" {
+		return nil, fmt.Errorf("cannot snapshot a snapshot")
+	}
+	if ds.GetSnapshot(name) != nil {
+		return nil, fmt.Errorf("snapshot %s already exists", name)
+	}
+
+	snapshotDS := NewDataset(fmt.Sprintf("%s@%s", ds.Name, name), "snapshot", ds.DataType, nil)
+	// items are copied as-is, new items are never added to the snapshot
+	snapshotDS.SetStorage(nil)
+	if err := copyItems(ds, snapshotDS); err != nil {
+		snapshotDS.Delete()
+		return nil, err
+	}
+	db.Exec(
+		"INSERT INTO dataset_snapshots (dataset_id, name, snapshot_dataset_id, created) VALUES (?, ?, ?, datetime('now'))",
+		ds.ID, name, snapshotDS.ID,
+	)
+	log.Printf("[dataset %d-%s] created snapshot %s (dataset %d)", ds.ID, ds.Name, name, snapshotDS.ID)
+	return ds.GetSnapshot(name), nil
+}
+
+// Replace the items in the dataset with the items in the snapshot.
+func (ds *DBDataset) RestoreSnapshot(snapshot DatasetSnapshot) error {
+	if ds.Type == "computed" {
+		return fmt.Errorf("computed datasets cannot be restored, pin the snapshot as a parent instead")
+	}
+	snapshotDS := GetDataset(snapshot.SnapshotDatasetID)
+	if snapshotDS == nil {
+		return fmt.Errorf("snapshot dataset %d is missing", snapshot.SnapshotDatasetID)
+	}
+
+	// copy into a staging dataset first, so that the dataset is only cleared
+	// once the snapshot was copied successfully
+	staging := NewDataset(fmt.Sprintf("%s@restore-%s", ds.Name, snapshot.Name), "data", ds.DataType, nil)
+	staging.SetStorage(ds.GetStorage())
+	defer staging.Delete()
+	if err := copyItems(snapshotDS, staging); err != nil {
+		return err
+	}
+	// the staging items are hard links (or objects in the same storage), so
+	// moving them into the dataset is cheap
+	if err := ds.Clear(); err != nil {
+		return err
+	}
+	if err := copyItems(staging, ds); err != nil {
+		return err
+	}
+	log.Printf("[dataset %d-%s] restored snapshot %s", ds.ID, ds.Name, snapshot.Name)
+	return nil
+}
+
+// Returns the names of exec nodes that have a parent pinned to this snapshot.
+func (snapshot DatasetSnapshot) GetPinnedNodes() []string {
+	var names []string
+	for _, node := range ListExecNodes() {
+		for _, plist := range node.Parents {
+			pinned := false
+			for _, parent := range plist {
+				if parent.Type == "d" && parent.ID == snapshot.SnapshotDatasetID {
+					pinned = true
+				}
+			}
+			if pinned {
+				names = append(names, node.Name)
+				break
+			}
+		}
+	}
+	return names
+}
+
+func (snapshot DatasetSnapshot) Delete() {
+	if snapshotDS := GetDataset(snapshot.SnapshotDatasetID); snapshotDS != nil {
+		snapshotDS.Delete()
+	}
+	db.Exec("DELETE FROM dataset_snapshots WHERE id = ?", snapshot.ID)
+}
+
+type DatasetDiff struct {
+	Added []string
+	Removed []string
+	Modified []string
+}
+
+// Returns a reader over the encoded item, or nil if it is not available.
+func openItem(item *DBItem) io.ReadCloser {
+	if fname := item.Fname(); fname != "" {
+		file, err := os.Open(fname)
+		if err != nil {
+			return nil
+		}
+		return file
+	}
+	if open := item.GetProvider().Open; open != nil {
+		rd, err := open(item.Item)
+		if err != nil {
+			return nil
+		}
+		return rd
+	}
+	return nil
+}
+
+func readersEqual(a io.Reader, b io.Reader) bool {
+	bufA := make([]byte, 32*1024)
+	bufB := make([]byte, 32*1024)
+	for {
+		nA, errA := io.ReadFull(a, bufA)
+		nB, errB := io.ReadFull(b, bufB)
+		if nA != nB || !bytes.Equal(bufA[0:nA], bufB[0:nB]) {
+			return false
+		}
+		doneA := errA == io.EOF || errA == io.ErrUnexpectedEOF
+		doneB := errB == io.EOF || errB == io.ErrUnexpectedEOF
+		if doneA || doneB {
+			return doneA && doneB
+		}
+		if errA != nil || errB != nil {
+			return false
+		}
+	}
+}
+
+// Returns whether the two items have the same metadata and contents.
+func sameItem(a *DBItem, b *DBItem) bool {
+	if a.Ext != b.Ext || a.Format != b.Format || a.Metadata != b.Metadata {
+		return false
+	}
+	// hard-linked files are the same, which is the common case after a snapshot
+	fnameA, fnameB := a.Fname(), b.Fname()
+	if fnameA != "" && fnameB != "" {
+		fiA, errA := os.Stat(fnameA)
+		fiB, errB := os.Stat(fnameB)
+		if errA == nil && errB == nil {
+			if os.SameFile(fiA, fiB) {
+				return true
+			}
+			if fiA.Size() != fiB.Size() {
+				return false
+			}
+		}
+	}
+	rdA := openItem(a)
+	rdB := openItem(b)
+	if rdA == nil || rdB == nil {
+		if rdA != nil {
+			rdA.Close()
+		}
+		if rdB != nil {
+			rdB.Close()
+		}
+		// fallback to comparing the provider info
+		if a.ProviderInfo == nil || b.ProviderInfo == nil {
+			return a.ProviderInfo == nil && b.ProviderInfo == nil
+		}
+		return *a.ProviderInfo == *b.ProviderInfo
+	}
+	defer rdA.Close()
+	defer rdB.Close()
+	return readersEqual(rdA, rdB)
+}
+
+func DiffItems(from []*DBItem, to []*DBItem) DatasetDiff {
+	diff := DatasetDiff{
+		Added: []string{},
+		Removed: []string{},
+		Modified: []string{},
+	}
+	fromByKey := make(map[string]*DBItem)
+	for _, item := range from {
+		fromByKey[item.Key] = item
+	}
+	toKeys := make(map[string]bool)
+	for _, item := range to {
+		toKeys[item.Key] = true
+		fromItem := fromByKey[item.Key]
+		if fromItem == nil {
+			diff.Added = append(diff.Added, item.Key)
+		} else if !sameItem(fromItem, item) {
+			diff.Modified = append(diff.Modified, item.Key)
+		}
+	}
+	for _, item := range from {
+		if !toKeys[item.Key] {
+			diff.Removed = append(diff.Removed, item.Key)
+		}
+	}
+	sort.Strings(diff.Added)
+	sort.Strings(diff.Removed)
+	sort.Strings(diff.Modified)
+	return diff
+}
+
+// Pin a parent of the node to a snapshot of the dataset that it currently refers to.
+// The parent is replaced by the snapshot dataset.
+func (node *DBExecNode) PinParent(input string, idx int, snapshot DatasetSnapshot) error {
+	if idx < 0 || idx >= len(node.Parents[input]) {
+		return fmt.Errorf("node has no parent %s[%d]", input, idx)
+	}
+	parent := node.Parents[input][idx]
+	var parentDatasetID int
+	if parent.Type == "d" {
+		parentDatasetID = parent.ID
+	} else if parent.Type == "n" {
+		datasets, _ := GetExecNode(parent.ID).GetDatasets(false)
+		if datasets[parent.Name] != nil {
+			parentDatasetID = datasets[parent.Name].ID
+		}
+	}
+	if parentDatasetID != snapshot.DatasetID {
+		return fmt.Errorf("snapshot %s is not a snapshot of parent %s[%d]", snapshot.Name, input, idx)
+	}
+
+	newParents := make(map[string][]skyhook.ExecParent, len(node.Parents))
+	for name, plist := range node.Parents {
+		newParents[name] = append([]skyhook.ExecParent{}, plist...)
+	}
+	newParents[input][idx] = skyhook.ExecParent{
+		Type: "d",
+		ID: snapshot.SnapshotDatasetID,
+		DataType: parent.DataType,
+	}
+	node.Update(ExecNodeUpdate{
+		Parents: &newParents,
+	})
+	return nil
+}
+
+func init() {
+	Router.HandleFunc("/datasets/{ds_id}/snapshots", func(w http.ResponseWriter, r *http.Request) {
+		dsID := skyhook.ParseInt(mux.Vars(r)["ds_id"])
+		dataset := GetDataset(dsID)
+		if dataset == nil {
+			http.Error(w, "no such dataset", 404)
+			return
+		}
+		skyhook.JsonResponse(w, dataset.ListSnapshots())
+	}).Methods("GET")
+
+	Router.HandleFunc("/datasets/{ds_id}/snapshots", func(w http.ResponseWriter, r *http.Request) {
+		dsID := skyhook.ParseInt(mux.Vars(r)["ds_id"])
+		dataset := GetDataset(dsID)
+		if dataset == nil {
+			http.Error(w, "no such dataset", 404)
+			return
+		}
+		r.ParseForm()
+		name := r.PostForm.Get("name")
+		if name == "" {
+			http.Error(w, "snapshot name must be set", 400)
+			return
+		}
+		snapshot, err := dataset.CreateSnapshot(name)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		skyhook.JsonResponse(w, snapshot)
+	}).Methods("POST")
+
+	// handle endpoints starting with /datasets/{ds_id}/snapshots/{name}
+	handleSnapshot := func(f func(http.ResponseWriter, *http.Request, *DBDataset, *DatasetSnapshot)) func(w http.ResponseWriter, r *http.Request) {
+		return func(w http.ResponseWriter, r *http.Request) {
+			dsID := skyhook.ParseInt(mux.Vars(r)["ds_id"])
+			dataset := GetDataset(dsID)
+			if dataset == nil {
+				http.Error(w, "no such dataset", 404)
+				return
+			}
+			snapshot := dataset.GetSnapshot(mux.Vars(r)["name"])
+			if snapshot == nil {
+				http.Error(w, "no such snapshot", 404)
+				return
+			}
+			f(w, r, dataset, snapshot)
+		}
+	}
+
+	Router.HandleFunc("/datasets/{ds_id}/snapshots/{name}", handleSnapshot(func(w http.ResponseWriter, r *http.Request, dataset *DBDataset, snapshot *DatasetSnapshot) {
+		skyhook.JsonResponse(w, snapshot)
+	})).Methods("GET")
+
+	Router.HandleFunc("/datasets/{ds_id}/snapshots/{name}", handleSnapshot(func(w http.ResponseWriter, r *http.Request, dataset *DBDataset, snapshot *DatasetSnapshot) {
+		if names := snapshot.GetPinnedNodes(); len(names) > 0 {
+			http.Error(w, fmt.Sprintf("snapshot is pinned by nodes %s, unpin them first", strings.Join(names, ", ")), 400)
+			return
+		}
+		snapshot.Delete()
+	})).Methods("DELETE")
+
+	Router.HandleFunc("/datasets/{ds_id}/snapshots/{name}/restore", handleSnapshot(func(w http.ResponseWriter, r *http.Request, dataset *DBDataset, snapshot *DatasetSnapshot) {
+		if err := dataset.RestoreSnapshot(*snapshot); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+	})).Methods("POST")
+
+	// Compare two versions of the dataset.
+	// from and to are snapshot names, or empty for the current version.
+	Router.HandleFunc("/datasets/{ds_id}/diff", func(w http.ResponseWriter, r *http.Request) {
+		dsID := skyhook.ParseInt(mux.Vars(r)["ds_id"])
+		dataset := GetDataset(dsID)
+		if dataset == nil {
+			http.Error(w, "no such dataset", 404)
+			return
+		}
+		r.ParseForm()
+		getItems := func(name string) ([]*DBItem, error) {
+			if name == "" {
+				return dataset.ListItems(), nil
+			}
+			snapshot := dataset.GetSnapshot(name)
+			if snapshot == nil {
+				return nil, fmt.Errorf("no such snapshot %s", name)
+			}
+			snapshotDS := GetDataset(snapshot.SnapshotDatasetID)
+			if snapshotDS == nil {
+				return nil, fmt.Errorf("snapshot dataset %d is missing", snapshot.SnapshotDatasetID)
+			}
+			return snapshotDS.ListItems(), nil
+		}
+		from, err := getItems(r.Form.Get("from"))
+		if err != nil {
+			http.Error(w, err.Error(), 404)
+			return
+		}
+		to, err := getItems(r.Form.Get("to"))
+		if err != nil {
+			http.Error(w, err.Error(), 404)
+			return
+		}
+		skyhook.JsonResponse(w, DiffItems(from, to))
+	}).Methods("GET")
+
+	Router.HandleFunc("/exec-nodes/{node_id}/pin", func(w http.ResponseWriter, r *http.Request) {
+		nodeID := skyhook.ParseInt(mux.Vars(r)["node_id"])
+		node := GetExecNode(nodeID)
+		if node == nil {
+			http.Error(w, "no such exec node", 404)
+			return
+		}
+		r.ParseForm()
+		input := r.PostForm.Get("input")
+		idx := skyhook.ParseInt(r.PostForm.Get("idx"))
+		snapshot := GetSnapshotByID(skyhook.ParseInt(r.PostForm.Get("snapshot_id")))
+		if snapshot == nil {
+			http.Error(w, "no such snapshot", 404)
+			return
+		}
+		if err := node.PinParent(input, idx, *snapshot); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+	}).Methods("POST")
+}
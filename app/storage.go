@@ -0,0 +1,124 @@
+package app
+
+import (
+	"github.com/skyhookml/skyhookml/skyhook"
+
+	"fmt"
+	"net/http"
+	"path"
+
+	"github.com/gorilla/mux"
+)
+
+// Where new items in a dataset are stored, if not in the default local storage.
+type DatasetStorage struct {
+	// Currently only "s3" is supported.
+	Provider string
+	Bucket string
+	// Items are stored at {Prefix}/{dataset ID}/{key}.{ext} in the bucket.
+	Prefix string
+}
+
+// Returns the storage configured for this dataset, or nil if items are stored locally.
+func (ds *DBDataset) GetStorage() *DatasetStorage {
+	rows := db.Query("SELECT config FROM dataset_storage WHERE dataset_id = ?", ds.ID)
+	if !rows.Next() {
+		return nil
+	}
+	var raw string
+	rows.Scan(&raw)
+	rows.Close()
+	var storage DatasetStorage
+	skyhook.JsonUnmarshal([]byte(raw), &storage)
+	return &storage
+}
+
+// Set the storage for new items in this dataset; existing items are not moved.
+// If storage is nil, new items are stored locally.
+func (ds *DBDataset) SetStorage(storage *DatasetStorage) {
+	if storage == nil {
+		db.Exec("DELETE FROM dataset_storage WHERE dataset_id = ?", ds.ID)
+		return
+	}
+	db.Exec(
+		"INSERT OR REPLACE INTO dataset_storage (dataset_id, config) VALUES (?, ?)",
+		ds.ID, string(skyhook.JsonMarshal(storage)),
+	)
+}
+
+// Set the provider of an item that is about to be added to the dataset, based
+// on the dataset storage.
+func (storage DatasetStorage) SetItemProvider(ds skyhook.Dataset, item *skyhook.Item) {
+	loc := skyhook.S3Location{
+		Bucket: storage.Bucket,
+		Key: path.Join(storage.Prefix, fmt.Sprintf("%d", ds.ID), item.Key+"."+item.Ext),
+		Owner: ds.ID,
+	}
+	item.Provider = new(string)
+	*item.Provider = storage.Provider
+	item.ProviderInfo = new(string)
+	*item.ProviderInfo = string(skyhook.JsonMarshal(loc))
+}
+
+// Returns the storage that new datasets should use by default.
+func GetDefaultStorage() *DatasetStorage {
+	if Config.S3Bucket == "" {
+		return nil
+	}
+	return &DatasetStorage{
+		Provider: "s3",
+		Bucket: Config.S3Bucket,
+		Prefix: Config.S3Prefix,
+	}
+}
+
+func init() {
+	Router.HandleFunc("/datasets/{ds_id}/storage", func(w http.ResponseWriter, r *http.Request) {
+		dsID := skyhook.ParseInt(mux.Vars(r)["ds_id"])
+		dataset := GetDataset(dsID)
+		if dataset == nil {
+			http.Error(w, "no such dataset", 404)
+			return
+		}
+		skyhook.JsonResponse(w, dataset.GetStorage())
+	}).Methods("GET")
+
+	Router.HandleFunc("/datasets/{ds_id}/storage", func(w http.ResponseWriter, r *http.Request) {
+		dsID := skyhook.ParseInt(mux.Vars(r)["ds_id"])
+		dataset := GetDataset(dsID)
+		if dataset == nil {
+			http.Error(w, "no such dataset", 404)
+			return
+		}
+		var storage DatasetStorage
+		if err := skyhook.ParseJsonRequest(w, r, &storage); err != nil {
+			return
+		}
+		if storage.Provider == "" {
+			storage.Provider = "s3"
+		}
+		if storage.Provider != "s3" {
+			http.Error(w, fmt.Sprintf("unknown storage provider %s", storage.Provider), 400)
+			return
+		}
+		if storage.Bucket == "" {
+			http.Error(w, "bucket must be set", 400)
+			return
+		}
+		dataset.SetStorage(&storage)
+	}).Methods("POST")
+
+	Router.HandleFunc("/datasets/{ds_id}/storage", func(w http.ResponseWriter, r *http.Request) {
+		dsID := skyhook.ParseInt(mux.Vars(r)["ds_id"])
+		dataset := GetDataset(dsID)
+		if dataset == nil {
+			http.Error(w, "no such dataset", 404)
+			return
+		}
+		dataset.SetStorage(nil)
+	}).Methods("DELETE")
+
+	Router.HandleFunc("/storage/stats", func(w http.ResponseWriter, r *http.Request) {
+		skyhook.JsonResponse(w, skyhook.GetStorageStats())
+	}).Methods("GET")
+}
@@ -8,17 +8,40 @@ import (
 	"sync"
 )
 
-// Lock access to the backend worker or pool.
-// In the future (after worker_pool has more capabilities), we should just pass
-// requests if the configured endpoint is a pool.
+// Limit access to the backend worker or pool.
+// At most Config.WorkerCapacity containers may be in use at once.
+// If the configured endpoint is a pool, it packs containers onto workers based
+// on the op's Requirements, so the capacity can be set higher.
+// Jobs waiting here are admitted in order of priority (and then in the order
+// they started waiting), so that the priority also applies to this
+// coordinator's own jobs, not only across coordinators sharing a pool.
 
 var workerMu sync.Mutex
 var workerCond *sync.Cond
-var workerInUse bool
+var workersInUse int
+
+type workerWaiter struct {
+	priority int
+	seq int
+}
+// Jobs currently waiting in AcquireWorker.
+var workerWaiters = make(map[*workerWaiter]bool)
+var workerWaiterSeq int
+
+// Returns whether w is the next waiter that should acquire the worker.
+// Caller must have the lock.
+func (w *workerWaiter) isNext() bool {
+	for other := range workerWaiters {
+		if other.priority > w.priority || (other.priority == w.priority && other.seq < w.seq) {
+			return false
+		}
+	}
+	return true
+}
 
 // Acquire worker and return nil.
 // Or returns error if interrupted (i.e. job terminated by user).
-func AcquireWorker(jobOp *AppJobOp) error {
+func AcquireWorker(jobOp *AppJobOp, priority int) error {
 	stop := false
 
 	jobOp.SetCleanupFunc(func() {
@@ -30,20 +53,32 @@ func AcquireWorker(jobOp *AppJobOp) error {
 
 	workerMu.Lock()
 	defer workerMu.Unlock()
-	for workerInUse && !stop {
+	capacity := Config.WorkerCapacity
+	if capacity < 1 {
+		capacity = 1
+	}
+	waiter := &workerWaiter{priority: priority, seq: workerWaiterSeq}
+	workerWaiterSeq++
+	workerWaiters[waiter] = true
+	for (workersInUse >= capacity || !waiter.isNext()) && !stop {
 		workerCond.Wait()
 	}
+	delete(workerWaiters, waiter)
 	if stop {
+		// other waiters may be able to proceed now
+		workerCond.Broadcast()
 		return fmt.Errorf("job terminated while acquiring worker")
 	}
 	jobOp.SetCleanupFunc(nil)
-	workerInUse = true
+	workersInUse++
+	// with capacity left, the next waiter may acquire the worker too
+	workerCond.Broadcast()
 	return nil
 }
 
 func ReleaseWorker() {
 	workerMu.Lock()
-	workerInUse = false
+	workersInUse--
 	workerCond.Broadcast()
 	workerMu.Unlock()
 }
@@ -59,7 +94,7 @@ type ContainerInfo struct {
 	BaseURL string
 	Parallelism int
 }
-func AcquireContainer(node skyhook.Runnable, jobOp *AppJobOp) (ContainerInfo, error) {
+func AcquireContainer(node skyhook.Runnable, priority int, jobOp *AppJobOp) (ContainerInfo, error) {
 	println := func(s string) {
 		jobOp.Update([]string{s})
 		log.Printf("[acquire-container job-%d] %s", jobOp.Job.ID, s)
@@ -71,6 +106,8 @@ func AcquireContainer(node skyhook.Runnable, jobOp *AppJobOp) (ContainerInfo, er
 		JobID: &jobOp.Job.ID,
 		CoordinatorURL: Config.CoordinatorURL,
 		InstanceID: Config.InstanceID,
+		Requirements: node.GetOp().Requirements(node),
+		Priority: priority,
 	}
 	var containerResponse skyhook.ContainerResponse
 	err := skyhook.JsonPost(Config.WorkerURL, "/container/request", containerRequest, &containerResponse)
@@ -14,6 +14,7 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 )
 
 func main() {
@@ -22,6 +23,20 @@ func main() {
 	initdb := flag.Bool("initdb", false, "initialize the database before starting up")
 	workerURL := flag.String("worker", "http://127.0.0.1:8081", "worker or worker-pool URL")
 	instanceID := flag.String("instance-id", "", "instance ID")
+	workerCapacity := flag.Int("worker-capacity", 1, "number of containers that the worker (or worker pool) can run at once")
+	nodeParallelism := flag.Int("parallel", 4, "maximum number of independent exec nodes to run concurrently")
+	retryAttempts := flag.Int("retry-attempts", 1, "default maximum number of times to try each task")
+	retryBackoff := flag.Float64("retry-backoff", 1, "default seconds to wait before retrying a failed task, doubled after each attempt")
+	retryMaxBackoff := flag.Float64("retry-max-backoff", 60, "default maximum seconds to wait before retrying a failed task")
+	retryOn := flag.String("retry-on", "", "comma-separated error classes to retry by default (network, apply), empty to retry all errors")
+	allowPartial := flag.Bool("allow-partial", false, "by default, continue with other tasks when a task fails permanently")
+	inProcess := flag.Bool("inprocess", false, "run small CPU-only ops in the coordinator instead of in containers")
+	inProcessOps := flag.String("inprocess-ops", "", "comma-separated ops to always run in the coordinator, e.g. filter,sample (only ops that support it)")
+	jobLogMaxSize := flag.Int("job-log-max-size", 64, "size in MB at which job logs are rotated and compressed, 0 to disable")
+	jobLogRetention := flag.Int("job-log-retention", 30, "days to keep logs of finished jobs, 0 to keep forever")
+	s3Bucket := flag.String("s3-bucket", "", "store items of new datasets in this S3 bucket instead of locally")
+	s3Prefix := flag.String("s3-prefix", "", "prefix of objects in the S3 bucket")
+	datasetGCInterval := flag.Int("dataset-gc-interval", 0, "hours between deleting orphaned computed datasets, 0 to only delete them manually")
 	flag.Parse()
 
 	tcpAddr, err := net.ResolveTCPAddr("tcp", *addr)
@@ -32,11 +47,39 @@ func main() {
 	app.Config.CoordinatorURL = strings.ReplaceAll(*coordinatorURL, "PORT", strconv.Itoa(tcpAddr.Port))
 	app.Config.WorkerURL = *workerURL
 	app.Config.InstanceID = *instanceID
+	app.Config.WorkerCapacity = *workerCapacity
+	app.Config.NodeParallelism = *nodeParallelism
+	app.Config.RetryPolicy = app.RetryPolicy{
+		MaxAttempts: *retryAttempts,
+		Backoff: *retryBackoff,
+		MaxBackoff: *retryMaxBackoff,
+		AllowPartial: allowPartial,
+	}
+	if *retryOn != "" {
+		app.Config.RetryPolicy.RetryOn = strings.Split(*retryOn, ",")
+	}
+	app.Config.InProcess = *inProcess
+	app.Config.InProcessOps = make(map[string]bool)
+	if *inProcessOps != "" {
+		for _, op := range strings.Split(*inProcessOps, ",") {
+			app.Config.InProcessOps[op] = true
+		}
+	}
+	if err := app.CheckInProcessOps(); err != nil {
+		panic(err)
+	}
+	app.Config.JobLogMaxSize = int64(*jobLogMaxSize)*1024*1024
+	app.Config.JobLogRetention = time.Duration(*jobLogRetention)*24*time.Hour
+	app.Config.S3Bucket = *s3Bucket
+	app.Config.S3Prefix = *s3Prefix
+	app.Config.DatasetGCInterval = time.Duration(*datasetGCInterval)*time.Hour
 
 	log.SetFlags(log.LstdFlags | log.Lmicroseconds)
 	skyhook.SeedRand()
 
 	app.InitDB(*initdb)
+	app.StartJobLogPruner()
+	app.StartDatasetGC()
 
 	server, err := socketio.NewServer(nil)
 	if err != nil {
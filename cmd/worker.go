@@ -7,12 +7,16 @@ import (
 	_ "github.com/skyhookml/skyhookml/ops"
 
 	"bufio"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"runtime"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -20,8 +24,9 @@ import (
 
 func main() {
 	if len(os.Args) < 3 {
-		fmt.Println("usage: ./worker [external IP] [port]")
+		fmt.Println("usage: ./worker [external IP] [port] [optional mode] [optional pool URL]")
 		fmt.Println("example: ./worker localhost 8081")
+		fmt.Println("example: ./worker 1.2.3.4 8081 docker http://5.6.7.8:8080")
 		return
 	}
 	myIP := os.Args[1]
@@ -31,6 +36,10 @@ func main() {
 	if len(os.Args) >= 4 {
 		mode = os.Args[3]
 	}
+	var poolURL string
+	if len(os.Args) >= 5 {
+		poolURL = os.Args[4]
+	}
 
 	workingDir, err := os.Getwd()
 	if err != nil {
@@ -48,9 +57,16 @@ func main() {
 		ExecBeginResponse skyhook.ExecBeginResponse
 		// Set if we have error creating the container
 		Error error
+		// GPU devices pinned to this container.
+		GPUs []int
 	}
 	containers := make(map[string]*Container)
-	ports := []int{8100, 8101, 8102, 8103}
+	var ports []int
+	for port := 8100; port < 8116; port++ {
+		ports = append(ports, port)
+	}
+	capacity := getCapacity(len(ports))
+	log.Printf("[worker] capacity: %v, up to %d containers", capacity.Resources, capacity.Containers)
 	var mu sync.Mutex
 	cond := sync.NewCond(&mu)
 
@@ -67,42 +83,97 @@ func main() {
 		panic(fmt.Errorf("no available port"))
 	}
 
+	// Pick GPU devices that aren't pinned to any container yet.
+	// Returns nil if there are not enough free devices.
+	// Caller must have the lock.
+	getGPUs := func(count int) []int {
+		usedSet := make(map[int]bool)
+		for _, container := range containers {
+			for _, gpu := range container.GPUs {
+				usedSet[gpu] = true
+			}
+		}
+		gpus := []int{}
+		for gpu := 0; gpu < capacity.Resources[skyhook.ResourceGPU] && len(gpus) < count; gpu++ {
+			if !usedSet[gpu] {
+				gpus = append(gpus, gpu)
+			}
+		}
+		if len(gpus) < count {
+			return nil
+		}
+		return gpus
+	}
+
 	// Returns (container base URL, error)
-	startContainer := func(uuid string, imageName string, jobID *int, coordinatorURL string, instanceID string) (string, error) {
+	startContainer := func(uuid string, imageName string, request skyhook.ContainerRequest) (string, error) {
+		requirements := skyhook.NormalizeRequirements(request.Requirements)
+
+		setError := func(err error) {
+			mu.Lock()
+			containers[uuid].Error = err
+			cond.Broadcast()
+			mu.Unlock()
+		}
+
 		mu.Lock()
+		gpus := getGPUs(requirements[skyhook.ResourceGPU])
+		if gpus == nil {
+			mu.Unlock()
+			err := fmt.Errorf("requested %d GPUs but not enough are available", requirements[skyhook.ResourceGPU])
+			setError(err)
+			return "", err
+		}
 		containerPort := getPort()
 		containerBaseURL := fmt.Sprintf("http://%s:%d", myIP, containerPort)
 		containers[uuid].Port = containerPort
 		containers[uuid].BaseURL = containerBaseURL
+		containers[uuid].GPUs = gpus
 		mu.Unlock()
 
-		setError := func(err error) {
-			mu.Lock()
-			containers[uuid].Error = err
-			cond.Broadcast()
-			mu.Unlock()
+		var gpuStrs []string
+		for _, gpu := range gpus {
+			gpuStrs = append(gpuStrs, strconv.Itoa(gpu))
 		}
+		log.Printf("[worker] container %s requires %v, pinned to GPUs %v", uuid, requirements, gpus)
 
 		var cmd *exec.Cmd
 		if mode == "docker" {
 			dataDir := filepath.Join(workingDir, "data")
-			if instanceID != "" {
-				dataDir = filepath.Join(dataDir, filepath.Base(instanceID))
+			if request.InstanceID != "" {
+				dataDir = filepath.Join(dataDir, filepath.Base(request.InstanceID))
 			}
-			cmd = exec.Command(
-				"docker", "run",
+			args := []string{
+				"run",
 				"--mount", fmt.Sprintf("\"src=%s\",target=/usr/src/app/skyhook/data,type=bind", dataDir),
-				"--gpus", "all",
 				"-p", fmt.Sprintf("%d:8080", containerPort),
 				"--name", uuid,
 				// pytorch DataLoader needs more than tiny default 64MB shared memory
 				"--shm-size", "1G",
-				imageName,
-			)
+			}
+			// only limit CPU and memory if the op declared them explicitly
+			if request.Requirements[skyhook.ResourceCPU] > 0 {
+				args = append(args, "--cpus", strconv.Itoa(request.Requirements[skyhook.ResourceCPU]))
+			}
+			if len(gpus) > 0 {
+				args = append(args, "--gpus", fmt.Sprintf("\"device=%s\"", strings.Join(gpuStrs, ",")))
+			}
+			if request.Requirements[skyhook.ResourceMemory] > 0 {
+				args = append(args, "--memory", fmt.Sprintf("%dm", request.Requirements[skyhook.ResourceMemory]))
+			}
+			// pass on storage settings so the container stores items the same way
+			for _, name := range append([]string{skyhook.DedupEnvVar}, skyhook.S3EnvVars...) {
+				if os.Getenv(name) != "" {
+					args = append(args, "-e", name)
+				}
+			}
+			args = append(args, imageName)
+			cmd = exec.Command("docker", args...)
 		} else if mode == "process" {
 			cmd = exec.Command(
 				"go", "run", "cmd/container.go", fmt.Sprintf(":%d", containerPort),
 			)
+			cmd.Env = append(os.Environ(), "CUDA_VISIBLE_DEVICES="+strings.Join(gpuStrs, ","))
 		}
 
 		stdout, err := cmd.StdoutPipe()
@@ -129,7 +200,7 @@ func main() {
 		stdoutRd := bufio.NewReader(stdout)
 		stdoutRd.ReadString('\n') // ignore error here since it'll be caught by readContainerOutput
 		// read stdout/stderr, and if JobID is set then pass the output lines to the coordinator
-		readContainerOutput(uuid, stdoutRd, bufio.NewReader(stderr), jobID, coordinatorURL)
+		readContainerOutput(uuid, stdoutRd, bufio.NewReader(stderr), request.JobID, request.CoordinatorURL)
 
 		return containerBaseURL, nil
 	}
@@ -172,7 +243,7 @@ func main() {
 				panic(err)
 			}
 
-			baseURL, err := startContainer(uuid, imageName, request.JobID, request.CoordinatorURL, request.InstanceID)
+			baseURL, err := startContainer(uuid, imageName, request)
 			if err != nil {
 				// don't really need to do anything since startContainer will set containers[uuid].Error
 				return
@@ -263,10 +334,103 @@ func main() {
 		stopContainer(uuid, container)
 	})
 
+	http.HandleFunc("/worker/capacity", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.WriteHeader(404)
+			return
+		}
+		skyhook.JsonResponse(w, capacity)
+	})
+
+	// if a pool is specified, register with it and send heartbeats
+	if poolURL != "" {
+		myURL := fmt.Sprintf("http://%s:%d", myIP, myPort)
+		go func() {
+			registered := false
+			for {
+				if !registered {
+					request := skyhook.WorkerRegisterRequest{
+						URL: myURL,
+						Capacity: capacity,
+					}
+					err := skyhook.JsonPost(poolURL, "/workers/register", request, nil)
+					if err != nil {
+						log.Printf("[worker] error registering with pool at %s: %v", poolURL, err)
+						time.Sleep(skyhook.WorkerHeartbeatInterval)
+						continue
+					}
+					log.Printf("[worker] registered with pool at %s", poolURL)
+					registered = true
+
+					// The pool discards any allocations that it had on this worker
+					// when we register, so we need to stop our containers.
+					mu.Lock()
+					oldContainers := containers
+					containers = make(map[string]*Container)
+					mu.Unlock()
+					for uuid, container := range oldContainers {
+						if container.Cmd == nil {
+							continue
+						}
+						log.Printf("[worker] stopping container %s that the pool no longer knows about", uuid)
+						stopContainer(uuid, container)
+					}
+				}
+
+				time.Sleep(skyhook.WorkerHeartbeatInterval)
+				err := skyhook.JsonPost(poolURL, "/workers/heartbeat", skyhook.WorkerHeartbeatRequest{URL: myURL}, nil)
+				var httpErr skyhook.HttpError
+				if errors.As(err, &httpErr) && httpErr.StatusCode == 404 {
+					// The pool doesn't know us, e.g. because it restarted or because it
+					// previously marked us dead.
+					log.Printf("[worker] pool does not recognize us, registering again")
+					registered = false
+				} else if err != nil {
+					log.Printf("[worker] error sending heartbeat to pool: %v", err)
+				}
+			}
+		}()
+	}
+
 	log.Printf("starting on :%d", myPort)
 	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", myPort), nil))
 }
 
+// Determine the resources available on this machine.
+func getCapacity(maxContainers int) skyhook.WorkerCapacity {
+	capacity := skyhook.WorkerCapacity{
+		Resources: map[string]int{
+			skyhook.ResourceCPU: runtime.NumCPU(),
+		},
+		Containers: maxContainers,
+	}
+
+	// /proc/meminfo reports MemTotal in kilobytes.
+	if bytes, err := ioutil.ReadFile("/proc/meminfo"); err == nil {
+		for _, line := range strings.Split(string(bytes), "\n") {
+			parts := strings.Fields(line)
+			if len(parts) < 2 || parts[0] != "MemTotal:" {
+				continue
+			}
+			capacity.Resources[skyhook.ResourceMemory] = skyhook.ParseInt(parts[1])/1024
+		}
+	} else {
+		log.Printf("[worker] warning: could not determine memory size: %v", err)
+	}
+
+	// nvidia-smi -L prints one line per GPU.
+	// If it fails, we assume there are no GPUs.
+	if output, err := exec.Command("nvidia-smi", "-L").Output(); err == nil {
+		for _, line := range strings.Split(string(output), "\n") {
+			if strings.HasPrefix(line, "GPU ") {
+				capacity.Resources[skyhook.ResourceGPU]++
+			}
+		}
+	}
+
+	return capacity
+}
+
 func readContainerOutput(uuid string, stdout *bufio.Reader, stderr *bufio.Reader, jobID *int, coordinatorURL string) {
 	// Read lines from stdout and stderr simultaneously, printing to our output
 	// Every second, accumulate the lines (if any) and forward to coordinator (if jobID is set).
@@ -0,0 +1,400 @@
+package augment
+
+// Produce augmented copies of images, along with consistently transformed
+// annotations (detection or shape datasets connected to the annotations input).
+// Each copy applies, in order: random crop, scaling, flips, rotation by a
+// multiple of 90 degrees, and color jitter, depending on the parameters.
+// Copies of item "{key}" are written with keys "{key}_aug0", "{key}_aug1", etc.
+// Annotations are clipped to the output image, and dropped if they end up
+// outside of it.
+
+import (
+	"github.com/skyhookml/skyhookml/skyhook"
+	"github.com/skyhookml/skyhookml/exec_ops"
+
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"runtime"
+)
+
+type Params struct {
+	// Number of augmented copies of each item.
+	Copies int
+	// Whether to also output the original items.
+	IncludeOriginal bool
+	// Random seed; the copies of an item only depend on the seed and its key.
+	Seed int64
+
+	// Each flip is applied with probability 0.5.
+	FlipHorizontal bool
+	FlipVertical bool
+	// Rotate by a random multiple of 90 degrees.
+	Rotate90 bool
+	// If set, crop a random window whose width and height are at least this
+	// fraction of the image.
+	CropFraction float64
+	// If set, scale the image content by a random factor in this range,
+	// keeping the image size (by padding or cropping).
+	ScaleMin float64
+	ScaleMax float64
+	// Maximum relative change in brightness, contrast, and saturation.
+	Brightness float64
+	Contrast float64
+	Saturation float64
+}
+
+func (params Params) GetCopies() int {
+	if params.Copies <= 0 {
+		return 1
+	}
+	return params.Copies
+}
+
+// Function that maps a point in the input image to the output image.
+type PointFunc func(x float64, y float64) (float64, float64)
+
+func clip(x int, lo int, hi int) int {
+	if x < lo {
+		return lo
+	} else if x > hi {
+		return hi
+	}
+	return x
+}
+
+func transformDetections(data skyhook.DetectionData, f PointFunc, dims [2]int) skyhook.DetectionData {
+	ndetections := make([][]skyhook.Detection, len(data.Detections))
+	for frameIdx, dlist := range data.Detections {
+		ndetections[frameIdx] = []skyhook.Detection{}
+		for _, d := range dlist {
+			x1, y1 := f(float64(d.Left), float64(d.Top))
+			x2, y2 := f(float64(d.Right), float64(d.Bottom))
+			d.Left = clip(int(math.Round(math.Min(x1, x2))), 0, dims[0])
+			d.Right = clip(int(math.Round(math.Max(x1, x2))), 0, dims[0])
+			d.Top = clip(int(math.Round(math.Min(y1, y2))), 0, dims[1])
+			d.Bottom = clip(int(math.Round(math.Max(y1, y2))), 0, dims[1])
+			if d.Right <= d.Left || d.Bottom <= d.Top {
+				continue
+			}
+			ndetections[frameIdx] = append(ndetections[frameIdx], d)
+		}
+	}
+	metadata := data.Metadata
+	metadata.CanvasDims = dims
+	return skyhook.DetectionData{Detections: ndetections, Metadata: metadata}
+}
+
+func transformShapes(data skyhook.ShapeData, f PointFunc, dims [2]int) skyhook.ShapeData {
+	nshapes := make([][]skyhook.Shape, len(data.Shapes))
+	for frameIdx, shapes := range data.Shapes {
+		nshapes[frameIdx] = []skyhook.Shape{}
+		for _, shape := range shapes {
+			if len(shape.Points) == 0 {
+				continue
+			}
+			points := make([][2]int, len(shape.Points))
+			for i, p := range shape.Points {
+				x, y := f(float64(p[0]), float64(p[1]))
+				points[i] = [2]int{int(math.Round(x)), int(math.Round(y))}
+			}
+			shape.Points = points
+			// drop shapes outside the image, and clamp the others
+			bounds := shape.Bounds()
+			if bounds[2] < 0 || bounds[3] < 0 || bounds[0] > dims[0] || bounds[1] > dims[1] {
+				continue
+			}
+			for i := range shape.Points {
+				shape.Points[i] = [2]int{clip(shape.Points[i][0], 0, dims[0]), clip(shape.Points[i][1], 0, dims[1])}
+			}
+			bounds = shape.Bounds()
+			if shape.Type != skyhook.PointShape && bounds[0] == bounds[2] && bounds[1] == bounds[3] {
+				continue
+			}
+			nshapes[frameIdx] = append(nshapes[frameIdx], shape)
+		}
+	}
+	metadata := data.Metadata
+	metadata.CanvasDims = dims
+	return skyhook.ShapeData{Shapes: nshapes, Metadata: metadata}
+}
+
+// An image along with its annotations.
+type Sample struct {
+	Image skyhook.Image
+	Annotations []skyhook.Data
+}
+
+func (s Sample) Dims() [2]int {
+	return [2]int{s.Image.Width, s.Image.Height}
+}
+
+// Replace the image and transform the annotations to match it.
+func (s Sample) Transform(im skyhook.Image, f PointFunc) Sample {
+	dims := [2]int{im.Width, im.Height}
+	out := Sample{Image: im}
+	for _, data := range s.Annotations {
+		if data.Type() == skyhook.DetectionType {
+			data = transformDetections(data.(skyhook.DetectionData), f, dims)
+		} else if data.Type() == skyhook.ShapeType {
+			data = transformShapes(data.(skyhook.ShapeData), f, dims)
+		}
+		out.Annotations = append(out.Annotations, data)
+	}
+	return out
+}
+
+// Rescale annotations to the image dimensions if their canvas is different.
+func (s Sample) Normalize() Sample {
+	for i, data := range s.Annotations {
+		var canvasDims [2]int
+		if data.Type() == skyhook.DetectionType {
+			canvasDims = data.(skyhook.DetectionData).Metadata.CanvasDims
+		} else if data.Type() == skyhook.ShapeType {
+			canvasDims = data.(skyhook.ShapeData).Metadata.CanvasDims
+		}
+		if canvasDims[0] == 0 || canvasDims == s.Dims() {
+			continue
+		}
+		sx := float64(s.Image.Width)/float64(canvasDims[0])
+		sy := float64(s.Image.Height)/float64(canvasDims[1])
+		cur := Sample{Image: s.Image, Annotations: []skyhook.Data{data}}.Transform(s.Image, func(x, y float64) (float64, float64) {
+			return x*sx, y*sy
+		})
+		s.Annotations[i] = cur.Annotations[0]
+	}
+	return s
+}
+
+func flipImage(im skyhook.Image, horizontal bool) skyhook.Image {
+	out := skyhook.NewImage(im.Width, im.Height)
+	for i := 0; i < im.Width; i++ {
+		for j := 0; j < im.Height; j++ {
+			if horizontal {
+				out.SetRGB(im.Width-1-i, j, im.GetRGB(i, j))
+			} else {
+				out.SetRGB(i, im.Height-1-j, im.GetRGB(i, j))
+			}
+		}
+	}
+	return out
+}
+
+// Rotate the image by 90 degrees clockwise.
+func rotateImage(im skyhook.Image) skyhook.Image {
+	out := skyhook.NewImage(im.Height, im.Width)
+	for i := 0; i < im.Width; i++ {
+		for j := 0; j < im.Height; j++ {
+			out.SetRGB(im.Height-1-j, i, im.GetRGB(i, j))
+		}
+	}
+	return out
+}
+
+// Scale brightness, contrast (around the mean intensity), and saturation
+// (around the gray value of each pixel) by the given factors.
+func jitterImage(im skyhook.Image, brightness float64, contrast float64, saturation float64) skyhook.Image {
+	out := im.Copy()
+	var sum float64
+	for _, b := range out.Bytes {
+		sum += float64(b)
+	}
+	mean := brightness*sum/float64(len(out.Bytes))
+	for i := 0; i+2 < len(out.Bytes); i += 3 {
+		var c [3]float64
+		for j := 0; j < 3; j++ {
+			c[j] = float64(out.Bytes[i+j])*brightness
+			c[j] = (c[j]-mean)*contrast + mean
+		}
+		gray := 0.299*c[0] + 0.587*c[1] + 0.114*c[2]
+		for j := 0; j < 3; j++ {
+			v := (c[j]-gray)*saturation + gray
+			out.Bytes[i+j] = uint8(math.Max(0, math.Min(255, math.Round(v))))
+		}
+	}
+	return out
+}
+
+// Returns a random factor in [1-amount, 1+amount].
+func randomFactor(r *rand.Rand, amount float64) float64 {
+	return 1 + (2*r.Float64()-1)*amount
+}
+
+func (params Params) Augment(s Sample, r *rand.Rand) Sample {
+	if params.CropFraction > 0 && params.CropFraction < 1 {
+		fraction := params.CropFraction + r.Float64()*(1-params.CropFraction)
+		w := int(float64(s.Image.Width)*fraction)
+		h := int(float64(s.Image.Height)*fraction)
+		if w > 0 && h > 0 {
+			sx := r.Intn(s.Image.Width-w+1)
+			sy := r.Intn(s.Image.Height-h+1)
+			s = s.Transform(s.Image.Crop(sx, sy, sx+w, sy+h), func(x, y float64) (float64, float64) {
+				return x-float64(sx), y-float64(sy)
+			})
+		}
+	}
+
+	if params.ScaleMin > 0 && params.ScaleMax >= params.ScaleMin {
+		scale := params.ScaleMin + r.Float64()*(params.ScaleMax-params.ScaleMin)
+		w, h := s.Image.Width, s.Image.Height
+		rw := int(float64(w)*scale)
+		rh := int(float64(h)*scale)
+		if rw > 0 && rh > 0 {
+			resized := s.Image.Resize(rw, rh)
+			var im skyhook.Image
+			var ox, oy int
+			if scale < 1 {
+				// pad the scaled image at a random position
+				ox = r.Intn(w-rw+1)
+				oy = r.Intn(h-rh+1)
+				im = skyhook.NewImage(w, h)
+				im.DrawImage(ox, oy, resized)
+			} else {
+				// crop a random window of the scaled image
+				cx := r.Intn(rw-w+1)
+				cy := r.Intn(rh-h+1)
+				im = resized.Crop(cx, cy, cx+w, cy+h)
+				ox, oy = -cx, -cy
+			}
+			s = s.Transform(im, func(x, y float64) (float64, float64) {
+				return x*scale+float64(ox), y*scale+float64(oy)
+			})
+		}
+	}
+
+	if params.FlipHorizontal && r.Intn(2) == 0 {
+		w := float64(s.Image.Width)
+		s = s.Transform(flipImage(s.Image, true), func(x, y float64) (float64, float64) {
+			return w-x, y
+		})
+	}
+	if params.FlipVertical && r.Intn(2) == 0 {
+		h := float64(s.Image.Height)
+		s = s.Transform(flipImage(s.Image, false), func(x, y float64) (float64, float64) {
+			return x, h-y
+		})
+	}
+
+	if params.Rotate90 {
+		for k := r.Intn(4); k > 0; k-- {
+			h := float64(s.Image.Height)
+			s = s.Transform(rotateImage(s.Image), func(x, y float64) (float64, float64) {
+				return h-y, x
+			})
+		}
+	}
+
+	if params.Brightness > 0 || params.Contrast > 0 || params.Saturation > 0 {
+		s.Image = jitterImage(
+			s.Image,
+			randomFactor(r, params.Brightness),
+			randomFactor(r, params.Contrast),
+			randomFactor(r, params.Saturation),
+		)
+	}
+
+	return s
+}
+
+type AugmentOp struct {
+	URL string
+	Params Params
+	OutputDatasets map[string]skyhook.Dataset
+}
+
+func (e *AugmentOp) Parallelism() int {
+	return runtime.NumCPU()
+}
+
+func (e *AugmentOp) write(key string, s Sample) error {
+	if err := exec_ops.WriteItem(e.URL, e.OutputDatasets["images"], key, skyhook.ImageData{Images: []skyhook.Image{s.Image}}); err != nil {
+		return err
+	}
+	for i, data := range s.Annotations {
+		if err := exec_ops.WriteItem(e.URL, e.OutputDatasets[fmt.Sprintf("annotations%d", i)], key, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *AugmentOp) Apply(task skyhook.ExecTask) error {
+	data, err := task.Items["images"][0][0].LoadData()
+	if err != nil {
+		return err
+	}
+	images := data.(skyhook.ImageData).Images
+	if len(images) != 1 {
+		return fmt.Errorf("expected one image in item %s but got %d", task.Key, len(images))
+	}
+	sample := Sample{Image: images[0]}
+	for _, itemList := range task.Items["annotations"] {
+		data, err := itemList[0].LoadData()
+		if err != nil {
+			return err
+		}
+		sample.Annotations = append(sample.Annotations, data)
+	}
+	sample = sample.Normalize()
+
+	if e.Params.IncludeOriginal {
+		if err := e.write(task.Key, sample); err != nil {
+			return err
+		}
+	}
+
+	h := fnv.New64a()
+	h.Write([]byte(task.Key))
+	r := rand.New(rand.NewSource(e.Params.Seed ^ int64(h.Sum64())))
+	for i := 0; i < e.Params.GetCopies(); i++ {
+		augmented := e.Params.Augment(sample, r)
+		if err := e.write(fmt.Sprintf("%s_aug%d", task.Key, i), augmented); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *AugmentOp) Close() {}
+
+func init() {
+	skyhook.AddExecOpImpl(skyhook.ExecOpImpl{
+		Config: skyhook.ExecOpConfig{
+			ID: "augment",
+			Name: "Augment",
+			Description: "Produce augmented copies of images along with their detection or shape annotations",
+		},
+		Inputs: []skyhook.ExecInput{
+			{Name: "images", DataTypes: []skyhook.DataType{skyhook.ImageType}},
+			{Name: "annotations", DataTypes: []skyhook.DataType{skyhook.DetectionType, skyhook.ShapeType}, Variable: true},
+		},
+		GetOutputs: func(rawParams string, inputTypes map[string][]skyhook.DataType) []skyhook.ExecOutput {
+			outputs := []skyhook.ExecOutput{{Name: "images", DataType: skyhook.ImageType}}
+			for i, inputType := range inputTypes["annotations"] {
+				outputs = append(outputs, skyhook.ExecOutput{
+					Name: fmt.Sprintf("annotations%d", i),
+					DataType: inputType,
+				})
+			}
+			return outputs
+		},
+		Requirements: func(node skyhook.Runnable) map[string]int {
+			return nil
+		},
+		GetTasks: exec_ops.SimpleTasks,
+		Prepare: func(url string, node skyhook.Runnable) (skyhook.ExecOp, error) {
+			var params Params
+			if err := exec_ops.DecodeParams(node, &params, true); err != nil {
+				return nil, err
+			}
+			op := &AugmentOp{
+				URL: url,
+				Params: params,
+				OutputDatasets: node.OutputDatasets,
+			}
+			return op, nil
+		},
+		ImageName: "skyhookml/basic",
+	})
+}
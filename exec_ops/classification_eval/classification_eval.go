@@ -0,0 +1,314 @@
+package classification_eval
+
+// Evaluate predicted class labels against ground truth labels.
+// Outputs three tables:
+// - summary: overall metrics (accuracy, macro-averaged precision/recall/F1, and
+//   top-k accuracy if scores are provided)
+// - classes: per-category precision, recall, and F1
+// - confusion: counts of (ground truth category, predicted category) pairs
+// Scores are optional: if a floats dataset is connected, each element should
+// contain one score for each category.
+
+import (
+	"github.com/skyhookml/skyhookml/skyhook"
+	"github.com/skyhookml/skyhookml/exec_ops"
+
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+)
+
+type Params struct {
+	// Values of k for which to compute top-k accuracy, if scores are provided.
+	TopK []int
+}
+
+func (params Params) GetTopK() []int {
+	if len(params.TopK) == 0 {
+		return []int{5}
+	}
+	return params.TopK
+}
+
+type Counts struct {
+	// Number of elements evaluated.
+	Total int
+	Correct int
+	// Map from [ground truth, predicted] class to count.
+	Confusion map[[2]int]int
+	// Number of elements with scores, and how many of them have the ground truth
+	// class within the top k scores, for each k.
+	NumScored int
+	TopKCorrect map[int]int
+}
+
+func NewCounts() Counts {
+	return Counts{
+		Confusion: make(map[[2]int]int),
+		TopKCorrect: make(map[int]int),
+	}
+}
+
+// Returns the rank of the ground truth class in the scores, starting from 1.
+func getRank(scores []float64, label int) int {
+	if label < 0 || label >= len(scores) {
+		return math.MaxInt32
+	}
+	rank := 1
+	for i, score := range scores {
+		if i != label && score > scores[label] {
+			rank++
+		}
+	}
+	return rank
+}
+
+// Add labels of one item to the counts.
+// scores is nil if scores are not provided.
+func (c *Counts) Add(predicted []int, groundTruth []int, scores [][]float64, topK []int) error {
+	if len(predicted) != len(groundTruth) {
+		return fmt.Errorf("there are %d predicted labels but %d ground truth labels", len(predicted), len(groundTruth))
+	}
+	if scores != nil && len(scores) != len(groundTruth) {
+		return fmt.Errorf("there are %d scores but %d ground truth labels", len(scores), len(groundTruth))
+	}
+	for i := range groundTruth {
+		c.Total++
+		if predicted[i] == groundTruth[i] {
+			c.Correct++
+		}
+		c.Confusion[[2]int{groundTruth[i], predicted[i]}]++
+		if scores == nil {
+			continue
+		}
+		c.NumScored++
+		rank := getRank(scores[i], groundTruth[i])
+		for _, k := range topK {
+			if rank <= k {
+				c.TopKCorrect[k]++
+			}
+		}
+	}
+	return nil
+}
+
+func ratio(a int, b int) float64 {
+	if b == 0 {
+		return math.NaN()
+	}
+	return float64(a)/float64(b)
+}
+
+func formatFloat(x float64) string {
+	if math.IsNaN(x) {
+		return ""
+	}
+	return strconv.FormatFloat(x, 'f', 4, 64)
+}
+
+// Make the summary, classes, and confusion tables.
+func (c Counts) MakeTables(categories []string, topK []int) (skyhook.TableData, skyhook.TableData, skyhook.TableData) {
+	getName := func(cls int) string {
+		if cls >= 0 && cls < len(categories) {
+			return categories[cls]
+		}
+		return strconv.Itoa(cls)
+	}
+
+	// find all classes, including those in categories that don't appear
+	classSet := make(map[int]bool)
+	for cls := range categories {
+		classSet[cls] = true
+	}
+	support := make(map[int]int)
+	numPredicted := make(map[int]int)
+	for pair, count := range c.Confusion {
+		classSet[pair[0]] = true
+		classSet[pair[1]] = true
+		support[pair[0]] += count
+		numPredicted[pair[1]] += count
+	}
+	var classes []int
+	for cls := range classSet {
+		classes = append(classes, cls)
+	}
+	sort.Ints(classes)
+
+	classTable := skyhook.TableData{
+		Specs: []skyhook.ColumnSpec{
+			{Label: "class", Type: "int"},
+			{Label: "category", Type: "string"},
+			{Label: "support", Type: "int"},
+			{Label: "predicted", Type: "int"},
+			{Label: "precision", Type: "float64"},
+			{Label: "recall", Type: "float64"},
+			{Label: "f1", Type: "float64"},
+		},
+	}
+	// macro averages are over classes that appear in the ground truth
+	var precisionSum, recallSum, f1Sum float64
+	var numClasses int
+	for _, cls := range classes {
+		tp := c.Confusion[[2]int{cls, cls}]
+		precision := ratio(tp, numPredicted[cls])
+		recall := ratio(tp, support[cls])
+		f1 := ratio(2*tp, support[cls]+numPredicted[cls])
+		classTable.Data = append(classTable.Data, []string{
+			strconv.Itoa(cls),
+			getName(cls),
+			strconv.Itoa(support[cls]),
+			strconv.Itoa(numPredicted[cls]),
+			formatFloat(precision),
+			formatFloat(recall),
+			formatFloat(f1),
+		})
+		if support[cls] == 0 {
+			continue
+		}
+		numClasses++
+		// precision is zero, rather than undefined, if the class is never predicted
+		if !math.IsNaN(precision) {
+			precisionSum += precision
+		}
+		recallSum += recall
+		f1Sum += f1
+	}
+
+	summary := skyhook.TableData{
+		Specs: []skyhook.ColumnSpec{
+			{Label: "metric", Type: "string"},
+			{Label: "value", Type: "float64"},
+		},
+	}
+	addMetric := func(name string, value float64) {
+		summary.Data = append(summary.Data, []string{name, formatFloat(value)})
+	}
+	addMetric("accuracy", ratio(c.Correct, c.Total))
+	if numClasses > 0 {
+		addMetric("macro_precision", precisionSum/float64(numClasses))
+		addMetric("macro_recall", recallSum/float64(numClasses))
+		addMetric("macro_f1", f1Sum/float64(numClasses))
+	}
+	if c.NumScored > 0 {
+		for _, k := range topK {
+			addMetric(fmt.Sprintf("top%d_accuracy", k), ratio(c.TopKCorrect[k], c.NumScored))
+		}
+	}
+	summary.Data = append(summary.Data, []string{"count", strconv.Itoa(c.Total)})
+
+	confusion := skyhook.TableData{
+		Specs: []skyhook.ColumnSpec{
+			{Label: "ground_truth", Type: "string"},
+			{Label: "predicted", Type: "string"},
+			{Label: "count", Type: "int"},
+		},
+	}
+	var pairs [][2]int
+	for pair := range c.Confusion {
+		pairs = append(pairs, pair)
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i][0] != pairs[j][0] {
+			return pairs[i][0] < pairs[j][0]
+		}
+		return pairs[i][1] < pairs[j][1]
+	})
+	for _, pair := range pairs {
+		confusion.Data = append(confusion.Data, []string{
+			getName(pair[0]),
+			getName(pair[1]),
+			strconv.Itoa(c.Confusion[pair]),
+		})
+	}
+
+	return summary, classTable, confusion
+}
+
+func init() {
+	skyhook.AddExecOpImpl(skyhook.ExecOpImpl{
+		Config: skyhook.ExecOpConfig{
+			ID: "classification_eval",
+			Name: "Classification Evaluation",
+			Description: "Compute accuracy, per-class precision/recall/F1, top-k accuracy, and confusion matrix of predicted labels",
+		},
+		Inputs: []skyhook.ExecInput{
+			{Name: "predicted", DataTypes: []skyhook.DataType{skyhook.IntType}},
+			{Name: "ground_truth", DataTypes: []skyhook.DataType{skyhook.IntType}},
+			// optional, at most one
+			{Name: "scores", DataTypes: []skyhook.DataType{skyhook.FloatsType}, Variable: true},
+		},
+		Outputs: []skyhook.ExecOutput{
+			{Name: "summary", DataType: skyhook.TableType},
+			{Name: "classes", DataType: skyhook.TableType},
+			{Name: "confusion", DataType: skyhook.TableType},
+		},
+		Requirements: func(node skyhook.Runnable) map[string]int {
+			return nil
+		},
+		GetTasks: exec_ops.SingleTask("eval"),
+		Prepare: func(url string, node skyhook.Runnable) (skyhook.ExecOp, error) {
+			var params Params
+			if err := exec_ops.DecodeParams(node, &params, true); err != nil {
+				return nil, err
+			}
+			if len(node.InputDatasets["scores"]) > 1 {
+				return nil, fmt.Errorf("at most one scores input can be connected")
+			}
+			applyFunc := func(task skyhook.ExecTask) error {
+				groupedItems := exec_ops.GroupItems(task.Items)
+				var keys []string
+				for key := range groupedItems {
+					keys = append(keys, key)
+				}
+				sort.Strings(keys)
+
+				counts := NewCounts()
+				var categories []string
+				for _, key := range keys {
+					predData, err := groupedItems[key]["predicted"][0].LoadData()
+					if err != nil {
+						return err
+					}
+					gtData, err := groupedItems[key]["ground_truth"][0].LoadData()
+					if err != nil {
+						return err
+					}
+					predicted := predData.(skyhook.IntData)
+					groundTruth := gtData.(skyhook.IntData)
+					// prefer the ground truth category names
+					if len(groundTruth.Metadata.Categories) > len(categories) {
+						categories = groundTruth.Metadata.Categories
+					} else if len(categories) == 0 {
+						categories = predicted.Metadata.Categories
+					}
+
+					var scores [][]float64
+					if len(groupedItems[key]["scores"]) > 0 {
+						scoreData, err := groupedItems[key]["scores"][0].LoadData()
+						if err != nil {
+							return err
+						}
+						scores = scoreData.(skyhook.FloatData).Floats
+					}
+
+					if err := counts.Add(predicted.Ints, groundTruth.Ints, scores, params.GetTopK()); err != nil {
+						return fmt.Errorf("item %s: %v", key, err)
+					}
+				}
+
+				summary, classes, confusion := counts.MakeTables(categories, params.GetTopK())
+				if err := exec_ops.WriteItem(url, node.OutputDatasets["summary"], task.Key, summary); err != nil {
+					return err
+				}
+				if err := exec_ops.WriteItem(url, node.OutputDatasets["classes"], task.Key, classes); err != nil {
+					return err
+				}
+				return exec_ops.WriteItem(url, node.OutputDatasets["confusion"], task.Key, confusion)
+			}
+			return skyhook.SimpleExecOp{ApplyFunc: applyFunc}, nil
+		},
+		ImageName: "skyhookml/basic",
+		InProcess: true,
+	})
+}
@@ -66,7 +66,7 @@ func init() {
 				if err != nil {
 					return err
 				}
-				err = inImageItem.CopyTo(outItem.Fname(), inImageItem.Format, params.Symlink)
+				err = inImageItem.CopyToItem(outItem, inImageItem.Format, params.Symlink)
 				if err != nil {
 					return err
 				}
@@ -163,7 +163,7 @@ func init() {
 				if err != nil {
 					return err
 				}
-				err = inItem.CopyTo(outImageItem.Fname(), format, params.Symlink)
+				err = inItem.CopyToItem(outImageItem, format, params.Symlink)
 				if err != nil {
 					return err
 				}
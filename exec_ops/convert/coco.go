@@ -140,7 +140,7 @@ func init() {
 						if err != nil {
 							return err
 						}
-						err = inImageItem.CopyTo(outImageItem.Fname(), params.Format, params.Symlink)
+						err = inImageItem.CopyToItem(outImageItem, params.Format, params.Symlink)
 						if err != nil {
 							return err
 						}
@@ -292,7 +292,7 @@ func init() {
 					if err != nil {
 						return err
 					}
-					err = inItem.CopyTo(outImageItem.Fname(), format, params.Symlink)
+					err = inItem.CopyToItem(outImageItem, format, params.Symlink)
 					if err != nil {
 						return err
 					}
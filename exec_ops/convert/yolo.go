@@ -80,7 +80,7 @@ func init() {
 				if err != nil {
 					return err
 				}
-				err = inImageItem.CopyTo(outImageItem.Fname(), outImageFormat, params.Symlink)
+				err = inImageItem.CopyToItem(outImageItem, outImageFormat, params.Symlink)
 				if err != nil {
 					return err
 				}
@@ -284,7 +284,7 @@ func init() {
 				if err != nil {
 					return err
 				}
-				err = inImageItem.CopyTo(outImageItem.Fname(), format, params.Symlink)
+				err = inImageItem.CopyToItem(outImageItem, format, params.Symlink)
 				if err != nil {
 					return err
 				}
@@ -0,0 +1,411 @@
+package detection_eval
+
+// Evaluate predicted detections against ground truth.
+// Outputs three tables:
+// - metrics: per-category AP at each IOU threshold, and COCO-style AP averaged
+//   over IOU thresholds .5:.05:.95, with a final "mean" row (mAP)
+// - pr_curves: interpolated precision at 101 recall points, per category and
+//   IOU threshold
+// - confusion: counts of (ground truth category, predicted category) pairs,
+//   where unmatched detections are paired with "background"
+
+import (
+	"github.com/skyhookml/skyhookml/skyhook"
+	"github.com/skyhookml/skyhookml/exec_ops"
+
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+)
+
+const Background = "background"
+
+type Params struct {
+	// IOU thresholds at which to report per-category AP and PR curves.
+	IOUThresholds []float64
+	// IOU threshold for matching detections in the confusion matrix.
+	ConfusionIOU float64
+	// Predictions with lower score are ignored in the confusion matrix.
+	ConfusionScore float64
+}
+
+func (params Params) GetIOUThresholds() []float64 {
+	if len(params.IOUThresholds) == 0 {
+		return []float64{0.5, 0.75}
+	}
+	return params.IOUThresholds
+}
+
+func (params Params) GetConfusionIOU() float64 {
+	if params.ConfusionIOU == 0 {
+		return 0.5
+	}
+	return params.ConfusionIOU
+}
+
+// The detections in one frame.
+type Frame struct {
+	Predicted []skyhook.Detection
+	GroundTruth []skyhook.Detection
+}
+
+// Result of evaluating one category at one IOU threshold.
+type CategoryResult struct {
+	AP float64
+	// Interpolated precision at recall 0, 0.01, ..., 1.
+	Precisions [101]float64
+	// Score of the first prediction that reaches each recall level, or NaN if
+	// the recall level is not reached.
+	Scores [101]float64
+}
+
+func formatFloat(x float64) string {
+	if math.IsNaN(x) {
+		return ""
+	}
+	return strconv.FormatFloat(x, 'f', 4, 64)
+}
+
+// Label for a column of AP at a threshold, e.g. ap50 for 0.5.
+func apLabel(threshold float64) string {
+	return fmt.Sprintf("ap%d", int(math.Round(threshold*100)))
+}
+
+// Compute AP of one category at one IOU threshold, following COCO: predictions
+// are processed in decreasing order of score, and each is greedily matched to
+// the unmatched ground truth box with highest IOU.
+func EvaluateCategory(frames []Frame, category string, threshold float64) CategoryResult {
+	type Prediction struct {
+		FrameIdx int
+		Detection skyhook.Detection
+	}
+	var predictions []Prediction
+	var numGT int
+	for frameIdx, frame := range frames {
+		for _, d := range frame.Predicted {
+			if d.Category != category {
+				continue
+			}
+			predictions = append(predictions, Prediction{frameIdx, d})
+		}
+		for _, d := range frame.GroundTruth {
+			if d.Category == category {
+				numGT++
+			}
+		}
+	}
+	sort.SliceStable(predictions, func(i, j int) bool {
+		return predictions[i].Detection.Score > predictions[j].Detection.Score
+	})
+
+	matched := make(map[[2]int]bool)
+	precisions := make([]float64, len(predictions))
+	recalls := make([]float64, len(predictions))
+	var tp int
+	for i, pred := range predictions {
+		bestIdx := -1
+		bestIOU := threshold
+		for gtIdx, gt := range frames[pred.FrameIdx].GroundTruth {
+			if gt.Category != category || matched[[2]int{pred.FrameIdx, gtIdx}] {
+				continue
+			}
+			iou := pred.Detection.IOU(gt)
+			if iou >= bestIOU {
+				bestIdx = gtIdx
+				bestIOU = iou
+			}
+		}
+		if bestIdx >= 0 {
+			matched[[2]int{pred.FrameIdx, bestIdx}] = true
+			tp++
+		}
+		precisions[i] = float64(tp)/float64(i+1)
+		if numGT > 0 {
+			recalls[i] = float64(tp)/float64(numGT)
+		}
+	}
+
+	// make precision monotonically decreasing
+	for i := len(precisions)-2; i >= 0; i-- {
+		if precisions[i+1] > precisions[i] {
+			precisions[i] = precisions[i+1]
+		}
+	}
+
+	var result CategoryResult
+	var sum float64
+	i := 0
+	for r := 0; r <= 100; r++ {
+		recall := float64(r)/100
+		for i < len(recalls) && recalls[i] < recall {
+			i++
+		}
+		if numGT == 0 || i >= len(recalls) {
+			result.Scores[r] = math.NaN()
+			continue
+		}
+		result.Precisions[r] = precisions[i]
+		result.Scores[r] = predictions[i].Detection.Score
+		sum += precisions[i]
+	}
+	result.AP = sum/101
+	return result
+}
+
+// Returns confusion counts, keyed by [ground truth category, predicted category].
+// In each frame, pairs of boxes are matched greedily by decreasing IOU,
+// regardless of category.
+func ComputeConfusion(frames []Frame, threshold float64, minScore float64) map[[2]string]int {
+	counts := make(map[[2]string]int)
+	for _, frame := range frames {
+		var predicted []skyhook.Detection
+		for _, d := range frame.Predicted {
+			if d.Score >= minScore {
+				predicted = append(predicted, d)
+			}
+		}
+		type Pair struct {
+			GTIdx int
+			PredIdx int
+			IOU float64
+		}
+		var pairs []Pair
+		for i, gt := range frame.GroundTruth {
+			for j, pred := range predicted {
+				if iou := gt.IOU(pred); iou >= threshold {
+					pairs = append(pairs, Pair{i, j, iou})
+				}
+			}
+		}
+		sort.SliceStable(pairs, func(i, j int) bool {
+			return pairs[i].IOU > pairs[j].IOU
+		})
+		gtMatched := make([]bool, len(frame.GroundTruth))
+		predMatched := make([]bool, len(predicted))
+		for _, pair := range pairs {
+			if gtMatched[pair.GTIdx] || predMatched[pair.PredIdx] {
+				continue
+			}
+			gtMatched[pair.GTIdx] = true
+			predMatched[pair.PredIdx] = true
+			counts[[2]string{frame.GroundTruth[pair.GTIdx].Category, predicted[pair.PredIdx].Category}]++
+		}
+		for i, gt := range frame.GroundTruth {
+			if !gtMatched[i] {
+				counts[[2]string{gt.Category, Background}]++
+			}
+		}
+		for j, pred := range predicted {
+			if !predMatched[j] {
+				counts[[2]string{Background, pred.Category}]++
+			}
+		}
+	}
+	return counts
+}
+
+// Evaluate the frames, returning the metrics, pr_curves, and confusion tables.
+func Evaluate(frames []Frame, params Params) (skyhook.TableData, skyhook.TableData, skyhook.TableData) {
+	// count boxes in each category
+	numGT := make(map[string]int)
+	numPredicted := make(map[string]int)
+	for _, frame := range frames {
+		for _, d := range frame.GroundTruth {
+			numGT[d.Category]++
+		}
+		for _, d := range frame.Predicted {
+			numPredicted[d.Category]++
+		}
+	}
+	var categories []string
+	for category := range numGT {
+		categories = append(categories, category)
+	}
+	for category := range numPredicted {
+		if _, ok := numGT[category]; !ok {
+			categories = append(categories, category)
+		}
+	}
+	sort.Strings(categories)
+
+	thresholds := params.GetIOUThresholds()
+	var cocoThresholds []float64
+	for i := 0; i < 10; i++ {
+		cocoThresholds = append(cocoThresholds, 0.5+0.05*float64(i))
+	}
+
+	metrics := skyhook.TableData{
+		Specs: []skyhook.ColumnSpec{
+			{Label: "category", Type: "string"},
+			{Label: "ground_truth", Type: "int"},
+			{Label: "predicted", Type: "int"},
+		},
+	}
+	for _, threshold := range thresholds {
+		metrics.Specs = append(metrics.Specs, skyhook.ColumnSpec{Label: apLabel(threshold), Type: "float64"})
+	}
+	metrics.Specs = append(metrics.Specs, skyhook.ColumnSpec{Label: "ap", Type: "float64"})
+
+	prCurves := skyhook.TableData{
+		Specs: []skyhook.ColumnSpec{
+			{Label: "category", Type: "string"},
+			{Label: "iou", Type: "float64"},
+			{Label: "recall", Type: "float64"},
+			{Label: "precision", Type: "float64"},
+			{Label: "score", Type: "float64"},
+		},
+	}
+
+	// sums of AP over categories that have ground truth, for the mean row
+	sums := make([]float64, len(thresholds)+1)
+	var numEvaluated int
+	for _, category := range categories {
+		row := []string{category, strconv.Itoa(numGT[category]), strconv.Itoa(numPredicted[category])}
+		// AP is undefined for categories without ground truth
+		if numGT[category] == 0 {
+			for i := 0; i < len(thresholds)+1; i++ {
+				row = append(row, "")
+			}
+			metrics.Data = append(metrics.Data, row)
+			continue
+		}
+		numEvaluated++
+
+		for i, threshold := range thresholds {
+			result := EvaluateCategory(frames, category, threshold)
+			row = append(row, formatFloat(result.AP))
+			sums[i] += result.AP
+			for r := 0; r <= 100; r++ {
+				prCurves.Data = append(prCurves.Data, []string{
+					category,
+					formatFloat(threshold),
+					formatFloat(float64(r)/100),
+					formatFloat(result.Precisions[r]),
+					formatFloat(result.Scores[r]),
+				})
+			}
+		}
+
+		var cocoAP float64
+		for _, threshold := range cocoThresholds {
+			cocoAP += EvaluateCategory(frames, category, threshold).AP
+		}
+		cocoAP /= float64(len(cocoThresholds))
+		row = append(row, formatFloat(cocoAP))
+		sums[len(thresholds)] += cocoAP
+
+		metrics.Data = append(metrics.Data, row)
+	}
+
+	var totalGT, totalPredicted int
+	for _, category := range categories {
+		totalGT += numGT[category]
+		totalPredicted += numPredicted[category]
+	}
+	meanRow := []string{"mean", strconv.Itoa(totalGT), strconv.Itoa(totalPredicted)}
+	for _, sum := range sums {
+		if numEvaluated == 0 {
+			meanRow = append(meanRow, "")
+		} else {
+			meanRow = append(meanRow, formatFloat(sum/float64(numEvaluated)))
+		}
+	}
+	metrics.Data = append(metrics.Data, meanRow)
+
+	confusion := skyhook.TableData{
+		Specs: []skyhook.ColumnSpec{
+			{Label: "ground_truth", Type: "string"},
+			{Label: "predicted", Type: "string"},
+			{Label: "count", Type: "int"},
+		},
+	}
+	counts := ComputeConfusion(frames, params.GetConfusionIOU(), params.ConfusionScore)
+	var pairs [][2]string
+	for pair := range counts {
+		pairs = append(pairs, pair)
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i][0] != pairs[j][0] {
+			return pairs[i][0] < pairs[j][0]
+		}
+		return pairs[i][1] < pairs[j][1]
+	})
+	for _, pair := range pairs {
+		confusion.Data = append(confusion.Data, []string{pair[0], pair[1], strconv.Itoa(counts[pair])})
+	}
+
+	return metrics, prCurves, confusion
+}
+
+func init() {
+	skyhook.AddExecOpImpl(skyhook.ExecOpImpl{
+		Config: skyhook.ExecOpConfig{
+			ID: "detection_eval",
+			Name: "Detection Evaluation",
+			Description: "Compute AP, mAP, precision-recall curves, and confusion matrix of predicted detections",
+		},
+		Inputs: []skyhook.ExecInput{
+			{Name: "predicted", DataTypes: []skyhook.DataType{skyhook.DetectionType}},
+			{Name: "ground_truth", DataTypes: []skyhook.DataType{skyhook.DetectionType}},
+		},
+		Outputs: []skyhook.ExecOutput{
+			{Name: "metrics", DataType: skyhook.TableType},
+			{Name: "pr_curves", DataType: skyhook.TableType},
+			{Name: "confusion", DataType: skyhook.TableType},
+		},
+		Requirements: func(node skyhook.Runnable) map[string]int {
+			return nil
+		},
+		GetTasks: exec_ops.SingleTask("eval"),
+		Prepare: func(url string, node skyhook.Runnable) (skyhook.ExecOp, error) {
+			var params Params
+			if err := exec_ops.DecodeParams(node, &params, true); err != nil {
+				return nil, err
+			}
+			applyFunc := func(task skyhook.ExecTask) error {
+				// collect frames from items with the same key
+				groupedItems := exec_ops.GroupItems(task.Items)
+				var keys []string
+				for key := range groupedItems {
+					keys = append(keys, key)
+				}
+				sort.Strings(keys)
+				var frames []Frame
+				for _, key := range keys {
+					predData, err := groupedItems[key]["predicted"][0].LoadData()
+					if err != nil {
+						return err
+					}
+					gtData, err := groupedItems[key]["ground_truth"][0].LoadData()
+					if err != nil {
+						return err
+					}
+					predicted := predData.(skyhook.DetectionData).Detections
+					groundTruth := gtData.(skyhook.DetectionData).Detections
+					if len(predicted) != len(groundTruth) {
+						return fmt.Errorf("item %s has %d predicted frames but %d ground truth frames", key, len(predicted), len(groundTruth))
+					}
+					for i := range predicted {
+						frames = append(frames, Frame{
+							Predicted: predicted[i],
+							GroundTruth: groundTruth[i],
+						})
+					}
+				}
+
+				metrics, prCurves, confusion := Evaluate(frames, params)
+				if err := exec_ops.WriteItem(url, node.OutputDatasets["metrics"], task.Key, metrics); err != nil {
+					return err
+				}
+				if err := exec_ops.WriteItem(url, node.OutputDatasets["pr_curves"], task.Key, prCurves); err != nil {
+					return err
+				}
+				return exec_ops.WriteItem(url, node.OutputDatasets["confusion"], task.Key, confusion)
+			}
+			return skyhook.SimpleExecOp{ApplyFunc: applyFunc}, nil
+		},
+		ImageName: "skyhookml/basic",
+		InProcess: true,
+	})
+}
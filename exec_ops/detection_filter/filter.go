@@ -89,5 +89,6 @@ func init() {
 		GetOutputKeys: exec_ops.MapGetOutputKeys,
 		GetNeededInputs: exec_ops.MapGetNeededInputs,
 		ImageName: "skyhookml/basic",
+		InProcess: true,
 	})
 }
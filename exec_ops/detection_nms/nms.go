@@ -0,0 +1,342 @@
+package detection_nms
+
+// Suppress or fuse overlapping detections, possibly from several inputs.
+// Detections of all inputs are pooled in each frame, and then:
+// - nms: greedy non-maximum suppression
+// - soft_nms: soft-NMS, which decays scores of overlapping boxes instead of
+//   removing them
+// - wbf: weighted box fusion, which averages clusters of overlapping boxes
+//   weighted by their scores; this is mostly useful to ensemble models
+// Only boxes with the same category are compared unless ClassAgnostic is set.
+
+import (
+	"github.com/skyhookml/skyhookml/skyhook"
+	"github.com/skyhookml/skyhookml/exec_ops"
+
+	"fmt"
+	"math"
+	"runtime"
+	"sort"
+)
+
+type Params struct {
+	// One of "nms", "soft_nms", or "wbf".
+	Mode string
+	ClassAgnostic bool
+	// Boxes with higher IOU are suppressed (nms), decayed (soft_nms with
+	// linear decay), or fused (wbf).
+	IOUThreshold float64
+	// Boxes with lower score are dropped from the output.
+	ScoreThreshold float64
+	// For soft_nms, either "gaussian" (default) or "linear" score decay.
+	SoftMethod string
+	// For soft_nms with gaussian decay.
+	Sigma float64
+	// For wbf, weight of each input (default 1).
+	Weights []float64
+}
+
+func (params Params) GetMode() string {
+	if params.Mode == "" {
+		return "nms"
+	}
+	return params.Mode
+}
+
+func (params Params) GetIOUThreshold() float64 {
+	if params.IOUThreshold == 0 {
+		return 0.5
+	}
+	return params.IOUThreshold
+}
+
+func (params Params) GetScoreThreshold() float64 {
+	// soft-NMS never removes boxes on its own, so use a small threshold by default
+	if params.ScoreThreshold == 0 && params.GetMode() == "soft_nms" {
+		return 0.001
+	}
+	return params.ScoreThreshold
+}
+
+func (params Params) GetSigma() float64 {
+	if params.Sigma == 0 {
+		return 0.5
+	}
+	return params.Sigma
+}
+
+func (params Params) GetWeight(inputIdx int) float64 {
+	if inputIdx < len(params.Weights) && params.Weights[inputIdx] > 0 {
+		return params.Weights[inputIdx]
+	}
+	return 1
+}
+
+func (params Params) sameGroup(a skyhook.Detection, b skyhook.Detection) bool {
+	return params.ClassAgnostic || a.Category == b.Category
+}
+
+func sortByScore(dlist []skyhook.Detection) {
+	sort.SliceStable(dlist, func(i, j int) bool {
+		return dlist[i].Score > dlist[j].Score
+	})
+}
+
+func (params Params) NMS(dlist []skyhook.Detection) []skyhook.Detection {
+	sortByScore(dlist)
+	threshold := params.GetIOUThreshold()
+	kept := []skyhook.Detection{}
+	for _, d := range dlist {
+		if d.Score < params.GetScoreThreshold() {
+			continue
+		}
+		suppressed := false
+		for _, other := range kept {
+			if params.sameGroup(d, other) && d.IOU(other) > threshold {
+				suppressed = true
+				break
+			}
+		}
+		if !suppressed {
+			kept = append(kept, d)
+		}
+	}
+	return kept
+}
+
+func (params Params) SoftNMS(dlist []skyhook.Detection) []skyhook.Detection {
+	remaining := append([]skyhook.Detection{}, dlist...)
+	threshold := params.GetIOUThreshold()
+	kept := []skyhook.Detection{}
+	for len(remaining) > 0 {
+		// move the highest-scoring box to the output
+		best := 0
+		for i := range remaining {
+			if remaining[i].Score > remaining[best].Score {
+				best = i
+			}
+		}
+		cur := remaining[best]
+		remaining = append(remaining[:best], remaining[best+1:]...)
+		if cur.Score < params.GetScoreThreshold() {
+			break
+		}
+		kept = append(kept, cur)
+
+		// decay the others
+		for i := range remaining {
+			if !params.sameGroup(cur, remaining[i]) {
+				continue
+			}
+			iou := cur.IOU(remaining[i])
+			if params.SoftMethod == "linear" {
+				if iou > threshold {
+					remaining[i].Score *= 1-iou
+				}
+			} else {
+				remaining[i].Score *= math.Exp(-iou*iou/params.GetSigma())
+			}
+		}
+	}
+	return kept
+}
+
+// A detection along with the index of the input it came from.
+type InputDetection struct {
+	skyhook.Detection
+	InputIdx int
+}
+
+func (params Params) WBF(dlist []InputDetection, numInputs int) []skyhook.Detection {
+	sort.SliceStable(dlist, func(i, j int) bool {
+		return dlist[i].Score*params.GetWeight(dlist[i].InputIdx) > dlist[j].Score*params.GetWeight(dlist[j].InputIdx)
+	})
+	var totalWeight float64
+	for i := 0; i < numInputs; i++ {
+		totalWeight += params.GetWeight(i)
+	}
+
+	type Cluster struct {
+		Members []InputDetection
+		// box fused from the members
+		Fused skyhook.Detection
+		// sum of the weights of the inputs of the members
+		Weight float64
+	}
+	// fuse the boxes in a cluster, weighted by score
+	fuse := func(cluster *Cluster) {
+		var left, top, right, bottom, scoreSum, weightSum float64
+		for _, d := range cluster.Members {
+			weight := params.GetWeight(d.InputIdx)
+			score := d.Score*weight
+			left += score*float64(d.Left)
+			top += score*float64(d.Top)
+			right += score*float64(d.Right)
+			bottom += score*float64(d.Bottom)
+			scoreSum += score
+			weightSum += weight
+		}
+		// the first member has the highest score, so take the metadata from it
+		fused := cluster.Members[0].Detection
+		if scoreSum > 0 {
+			fused.Left = int(math.Round(left/scoreSum))
+			fused.Top = int(math.Round(top/scoreSum))
+			fused.Right = int(math.Round(right/scoreSum))
+			fused.Bottom = int(math.Round(bottom/scoreSum))
+		}
+		// weighted average of the member scores
+		fused.Score = scoreSum/weightSum
+		cluster.Fused = fused
+		cluster.Weight = weightSum
+	}
+
+	var clusters []*Cluster
+	threshold := params.GetIOUThreshold()
+	for _, d := range dlist {
+		var bestCluster *Cluster
+		bestIOU := threshold
+		for _, cluster := range clusters {
+			if !params.sameGroup(d.Detection, cluster.Fused) {
+				continue
+			}
+			if iou := d.IOU(cluster.Fused); iou > bestIOU {
+				bestCluster = cluster
+				bestIOU = iou
+			}
+		}
+		if bestCluster == nil {
+			bestCluster = &Cluster{}
+			clusters = append(clusters, bestCluster)
+		}
+		bestCluster.Members = append(bestCluster.Members, d)
+		fuse(bestCluster)
+	}
+
+	fused := []skyhook.Detection{}
+	for _, cluster := range clusters {
+		// penalize boxes that only few inputs agree on
+		d := cluster.Fused
+		d.Score = d.Score * math.Min(cluster.Weight, totalWeight) / totalWeight
+		if d.Score < params.GetScoreThreshold() {
+			continue
+		}
+		fused = append(fused, d)
+	}
+	sortByScore(fused)
+	return fused
+}
+
+type DetectionNMS struct {
+	URL string
+	Params Params
+	Dataset skyhook.Dataset
+}
+
+func (e *DetectionNMS) Parallelism() int {
+	return runtime.NumCPU()
+}
+
+func (e *DetectionNMS) Apply(task skyhook.ExecTask) error {
+	var inputs []skyhook.DetectionData
+	for _, item := range task.Items["inputs"] {
+		data, err := item[0].LoadData()
+		if err != nil {
+			return err
+		}
+		inputs = append(inputs, data.(skyhook.DetectionData))
+	}
+	if len(inputs) == 0 {
+		return fmt.Errorf("no inputs")
+	}
+
+	// use the canvas dims of the first input, and merge the category lists
+	metadata := inputs[0].Metadata
+	categorySet := make(map[string]bool)
+	for _, category := range metadata.Categories {
+		categorySet[category] = true
+	}
+	for idx, input := range inputs {
+		if len(input.Detections) != len(inputs[0].Detections) {
+			return fmt.Errorf("input %d has %d frames but input 0 has %d", idx, len(input.Detections), len(inputs[0].Detections))
+		}
+		for _, category := range input.Metadata.Categories {
+			if !categorySet[category] {
+				categorySet[category] = true
+				metadata.Categories = append(metadata.Categories, category)
+			}
+		}
+	}
+
+	ndetections := make([][]skyhook.Detection, len(inputs[0].Detections))
+	for frameIdx := range ndetections {
+		var dlist []InputDetection
+		for inputIdx, input := range inputs {
+			dims := input.Metadata.CanvasDims
+			for _, d := range input.Detections[frameIdx] {
+				if dims[0] != 0 && metadata.CanvasDims[0] != 0 && dims != metadata.CanvasDims {
+					d = d.Rescale(dims, metadata.CanvasDims)
+				}
+				dlist = append(dlist, InputDetection{d, inputIdx})
+			}
+		}
+
+		mode := e.Params.GetMode()
+		if mode == "wbf" {
+			ndetections[frameIdx] = e.Params.WBF(dlist, len(inputs))
+			continue
+		}
+		plain := make([]skyhook.Detection, len(dlist))
+		for i := range dlist {
+			plain[i] = dlist[i].Detection
+		}
+		if mode == "soft_nms" {
+			ndetections[frameIdx] = e.Params.SoftNMS(plain)
+		} else {
+			ndetections[frameIdx] = e.Params.NMS(plain)
+		}
+	}
+
+	outputData := skyhook.DetectionData{
+		Detections: ndetections,
+		Metadata: metadata,
+	}
+	return exec_ops.WriteItem(e.URL, e.Dataset, task.Key, outputData)
+}
+
+func (e *DetectionNMS) Close() {}
+
+func init() {
+	skyhook.AddExecOpImpl(skyhook.ExecOpImpl{
+		Config: skyhook.ExecOpConfig{
+			ID: "detection_nms",
+			Name: "Detection NMS",
+			Description: "Suppress or fuse overlapping detections with NMS, soft-NMS, or weighted box fusion",
+		},
+		Inputs: []skyhook.ExecInput{{Name: "inputs", DataTypes: []skyhook.DataType{skyhook.DetectionType}, Variable: true}},
+		Outputs: []skyhook.ExecOutput{{Name: "detections", DataType: skyhook.DetectionType}},
+		Requirements: func(node skyhook.Runnable) map[string]int {
+			return nil
+		},
+		GetTasks: exec_ops.SimpleTasks,
+		Prepare: func(url string, node skyhook.Runnable) (skyhook.ExecOp, error) {
+			var params Params
+			if err := exec_ops.DecodeParams(node, &params, true); err != nil {
+				return nil, err
+			}
+			if mode := params.GetMode(); mode != "nms" && mode != "soft_nms" && mode != "wbf" {
+				return nil, fmt.Errorf("unknown mode %s", mode)
+			}
+			op := &DetectionNMS{
+				URL: url,
+				Params: params,
+				Dataset: node.OutputDatasets["detections"],
+			}
+			return op, nil
+		},
+		Incremental: true,
+		GetOutputKeys: exec_ops.MapGetOutputKeys,
+		GetNeededInputs: exec_ops.MapGetNeededInputs,
+		ImageName: "skyhookml/basic",
+		InProcess: true,
+	})
+}
@@ -5,7 +5,6 @@ import (
 	"github.com/skyhookml/skyhookml/exec_ops"
 
 	"fmt"
-	urllib "net/url"
 	"runtime"
 )
 
@@ -70,14 +69,7 @@ func (e *FilterOp) Apply(task skyhook.ExecTask) error {
 	for i, itemList := range task.Items["others"] {
 		item := itemList[0]
 		dsName := fmt.Sprintf("others%d", i)
-		err := skyhook.JsonPostForm(e.url, fmt.Sprintf("/datasets/%d/items", e.outputDatasets[dsName].ID), urllib.Values{
-			"key": {task.Key},
-			"ext": {item.Ext},
-			"format": {item.Format},
-			"metadata": {item.Metadata},
-			"provider": {"reference"},
-			"provider_info": {item.Fname()},
-		}, nil)
+		err := exec_ops.AddReference(e.url, e.outputDatasets[dsName], task.Key, item)
 		if err != nil {
 			return err
 		}
@@ -149,5 +141,6 @@ func init() {
 			return op, nil
 		},
 		ImageName: "skyhookml/basic",
+		InProcess: true,
 	})
 }
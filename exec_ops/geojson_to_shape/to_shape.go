@@ -172,5 +172,6 @@ func init() {
 			return skyhook.SimpleExecOp{ApplyFunc: applyFunc}, nil
 		},
 		ImageName: "skyhookml/basic",
+		InProcess: true,
 	})
 }
@@ -34,7 +34,7 @@ func init() {
 					if err != nil {
 						return err
 					}
-					err = inItem.CopyTo(item.Fname(), inItem.Format, false)
+					err = inItem.CopyToItem(item, inItem.Format, false)
 					if err != nil {
 						return err
 					}
@@ -13,6 +13,8 @@ import (
 type Params struct {
 	Code string
 	Outputs []skyhook.ExecOutput
+	// Number of GPUs that the code needs.
+	GPUs int
 }
 
 // Data about one Apply call.
@@ -356,7 +358,11 @@ func init() {
 			return params.Outputs
 		},
 		Requirements: func(node skyhook.Runnable) map[string]int {
-			return nil
+			var params Params
+			if err := json.Unmarshal([]byte(node.Params), &params); err != nil || params.GPUs <= 0 {
+				return nil
+			}
+			return map[string]int{skyhook.ResourceGPU: params.GPUs}
 		},
 		GetTasks: exec_ops.SimpleTasks,
 		Prepare: func(url string, node skyhook.Runnable) (skyhook.ExecOp, error) {
@@ -15,6 +15,8 @@ import (
 type Params struct {
 	Code string
 	Outputs []skyhook.ExecOutput
+	// Number of GPUs that the code needs.
+	GPUs int
 }
 
 type Packet struct {
@@ -258,7 +260,11 @@ func init() {
 			return params.Outputs
 		},
 		Requirements: func(node skyhook.Runnable) map[string]int {
-			return nil
+			var params Params
+			if err := json.Unmarshal([]byte(node.Params), &params); err != nil || params.GPUs <= 0 {
+				return nil
+			}
+			return map[string]int{skyhook.ResourceGPU: params.GPUs}
 		},
 		GetTasks: func(node skyhook.Runnable, rawItems map[string][][]skyhook.Item) ([]skyhook.ExecTask, error) {
 			op, err := getOp("", node)
@@ -42,7 +42,7 @@ func Prepare(url string, node skyhook.Runnable) (skyhook.ExecOp, error) {
 	cmd := skyhook.Command(
 		fmt.Sprintf("pytorch-exec-%s", node.Name), skyhook.CommandOptions{},
 		"python3", "exec_ops/pytorch/run.py",
-		strconv.Itoa(inputDatasets["model"][0].ID), paramsArg,
+		strconv.Itoa(inputDatasets["model"][0].ID), url, paramsArg,
 	)
 
 	var flatOutputs []skyhook.Dataset
@@ -109,7 +109,7 @@ var InferImpl = skyhook.ExecOpImpl{
 		return GetInferOutputs(params)
 	},
 	Requirements: func(node skyhook.Runnable) map[string]int {
-		return nil
+		return map[string]int{skyhook.ResourceGPU: 1}
 	},
 	GetTasks: func(node skyhook.Runnable, rawItems map[string][][]skyhook.Item) ([]skyhook.ExecTask, error) {
 		// the model only has one dataset, we want to use all the other datasets
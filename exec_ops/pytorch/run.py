@@ -2,6 +2,7 @@ import sys
 sys.path.append('./python')
 import skyhook.common as lib
 
+import io
 import json
 import numpy
 import os, os.path
@@ -15,15 +16,17 @@ import skyhook.pytorch.model as model
 import skyhook.pytorch.util as util
 
 in_dataset_id = int(sys.argv[1])
-params_arg = sys.argv[2]
+url = sys.argv[2]
+params_arg = sys.argv[3]
 batch_size = 16
 
 params = json.loads(params_arg)
 
 device = torch.device('cuda:0')
 #device = torch.device('cpu')
-model_path = 'data/items/{}/model.pt'.format(in_dataset_id)
-save_dict = torch.load(model_path)
+# the model may not be in a local file, e.g. if the dataset is stored in s3
+model_item = lib.get_item(url, in_dataset_id, 'model')
+save_dict = torch.load(io.BytesIO(lib.read_item(model_item['Dataset'], model_item, url)))
 
 # overwrite parameters in save_dict['arch'] with parameters from
 # params['Components'][comp_idx]
@@ -11,6 +11,7 @@ import (
 	"log"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strconv"
 	"strings"
 )
@@ -127,8 +128,7 @@ func (e *TrainOp) Apply(task skyhook.ExecTask) error {
 	}
 
 	// add to the file dataset
-	fileMetadata := skyhook.FileMetadata{Filename: "model.pt"}
-	_, err = exec_ops.AddItem(e.url, e.dataset, "model", "pt", "", string(skyhook.JsonMarshal(fileMetadata)))
+	err = exec_ops.AddFileItem(e.url, e.dataset, "model", "pt", filepath.Join(e.dataset.Dirname(), "model.pt"))
 	if err != nil {
 		return err
 	}
@@ -177,7 +177,7 @@ var TrainImpl = skyhook.ExecOpImpl{
 	},
 	Outputs: []skyhook.ExecOutput{{Name: "model", DataType: skyhook.FileType}},
 	Requirements: func(node skyhook.Runnable) map[string]int {
-		return nil
+		return map[string]int{skyhook.ResourceGPU: 1}
 	},
 	GetTasks: exec_ops.SingleTask("model"),
 	Prepare: func(url string, node skyhook.Runnable) (skyhook.ExecOp, error) {
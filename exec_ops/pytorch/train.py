@@ -2,6 +2,7 @@ import sys
 sys.path.append('./python')
 import skyhook.common as lib
 
+import io
 import json
 import numpy
 import os, os.path
@@ -244,8 +245,8 @@ if params.get('Restore', None) and parent_models:
 		skip_prefixes = [prefix.strip() for prefix in restore['SkipPrefixes'].split(',') if prefix.strip()]
 		print('restore model to', dst_prefix)
 		# load save dict based on dataset ID
-		fname = 'data/items/{}/model.pt'.format(parent_model['ID'])
-		save_dict = torch.load(fname)
+		model_item = lib.get_item(url, parent_model['ID'], 'model')
+		save_dict = torch.load(io.BytesIO(lib.read_item(model_item['Dataset'], model_item, url)))
 		# update the parameter names based on src/dst/skip prefixes
 		state_dict = save_dict['model']
 		new_dict = {}
@@ -0,0 +1,290 @@
+package rebalance
+
+// Over- or under-sample items so that categories follow a target distribution.
+// The category of each item is the most common category in its labels (an int
+// or detection item). Outputs reference the input items rather than copying
+// them: the labels output and outputs{i} for each dataset in inputs.
+// Items that are sampled more than once are duplicated with keys like
+// "{key}_dup1", "{key}_dup2", and so on.
+// A summary table reports the number of items per category before and after.
+
+import (
+	"github.com/skyhookml/skyhookml/skyhook"
+	"github.com/skyhookml/skyhookml/exec_ops"
+
+	"fmt"
+	"math"
+	"math/rand"
+	"runtime"
+	"sort"
+	"strconv"
+)
+
+type Params struct {
+	// One of:
+	// - "oversample" (default): duplicate items so that no item is dropped.
+	// - "undersample": drop items so that no item is duplicated.
+	// - "count": sample Count items in total.
+	Mode string
+	Count int
+	// Relative weight of each category in the target distribution.
+	// Categories that are not listed have weight 1, so the default is uniform.
+	Weights map[string]float64
+	Seed int64
+}
+
+func (params Params) GetMode() string {
+	if params.Mode == "" {
+		return "oversample"
+	}
+	return params.Mode
+}
+
+func (params Params) GetWeight(category string) float64 {
+	if weight, ok := params.Weights[category]; ok {
+		return weight
+	}
+	return 1
+}
+
+// Returns the number of items to sample from each category.
+func (params Params) GetTargets(counts map[string]int) map[string]int {
+	var weightSum float64
+	for category := range counts {
+		weightSum += params.GetWeight(category)
+	}
+	targets := make(map[string]int)
+	if weightSum <= 0 {
+		return targets
+	}
+
+	// determine the total number of items
+	var total float64
+	mode := params.GetMode()
+	if mode == "count" {
+		total = float64(params.Count)
+	} else {
+		first := true
+		for category, count := range counts {
+			p := params.GetWeight(category)/weightSum
+			if p <= 0 {
+				continue
+			}
+			cur := float64(count)/p
+			if first || (mode == "oversample" && cur > total) || (mode == "undersample" && cur < total) {
+				total = cur
+				first = false
+			}
+		}
+	}
+
+	for category := range counts {
+		p := params.GetWeight(category)/weightSum
+		if p <= 0 {
+			targets[category] = 0
+			continue
+		}
+		target := int(math.Round(total*p))
+		if mode == "undersample" && target > counts[category] {
+			target = counts[category]
+		}
+		targets[category] = target
+	}
+	return targets
+}
+
+// Sample target items from keys, returning map from each sampled key to the
+// number of times it is sampled.
+// Every key is sampled target/len(keys) times, and the remainder is sampled
+// without replacement.
+func Sample(keys []string, target int, r *rand.Rand) map[string]int {
+	times := make(map[string]int)
+	if len(keys) == 0 {
+		return times
+	}
+	for _, key := range keys {
+		if target/len(keys) > 0 {
+			times[key] = target/len(keys)
+		}
+	}
+	for _, idx := range r.Perm(len(keys))[0:target%len(keys)] {
+		times[keys[idx]]++
+	}
+	return times
+}
+
+type TaskMetadata struct {
+	// If set, this task writes the summary table instead of items.
+	Summary *skyhook.TableData
+}
+
+func GetTasks(node skyhook.Runnable, allItems map[string][][]skyhook.Item) ([]skyhook.ExecTask, error) {
+	var params Params
+	if err := exec_ops.DecodeParams(node, &params, true); err != nil {
+		return nil, err
+	}
+
+	simpleTasks, err := exec_ops.SimpleTasks(node, allItems)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(simpleTasks, func(i, j int) bool {
+		return simpleTasks[i].Key < simpleTasks[j].Key
+	})
+
+	tasksByKey := make(map[string]skyhook.ExecTask)
+	keysByCategory := make(map[string][]string)
+	counts := make(map[string]int)
+	for _, task := range simpleTasks {
+		data, err := task.Items["labels"][0][0].LoadData()
+		if err != nil {
+			return nil, err
+		}
+		category := exec_ops.GetCategory(data)
+		tasksByKey[task.Key] = task
+		keysByCategory[category] = append(keysByCategory[category], task.Key)
+		counts[category]++
+	}
+	var categories []string
+	for category := range counts {
+		categories = append(categories, category)
+	}
+	sort.Strings(categories)
+
+	targets := params.GetTargets(counts)
+	r := rand.New(rand.NewSource(params.Seed))
+	var tasks []skyhook.ExecTask
+	after := make(map[string]int)
+	for _, category := range categories {
+		times := Sample(keysByCategory[category], targets[category], r)
+		for _, key := range keysByCategory[category] {
+			for i := 0; i < times[key]; i++ {
+				task := tasksByKey[key]
+				if i > 0 {
+					task.Key = fmt.Sprintf("%s_dup%d", key, i)
+				}
+				tasks = append(tasks, task)
+				after[category]++
+			}
+		}
+	}
+
+	// make the summary table
+	var totalBefore, totalAfter int
+	for _, category := range categories {
+		totalBefore += counts[category]
+		totalAfter += after[category]
+	}
+	fraction := func(count int, total int) string {
+		if total == 0 {
+			return ""
+		}
+		return strconv.FormatFloat(float64(count)/float64(total), 'f', 4, 64)
+	}
+	summary := skyhook.TableData{
+		Specs: []skyhook.ColumnSpec{
+			{Label: "category", Type: "string"},
+			{Label: "before", Type: "int"},
+			{Label: "after", Type: "int"},
+			{Label: "before_fraction", Type: "float64"},
+			{Label: "after_fraction", Type: "float64"},
+		},
+	}
+	for _, category := range categories {
+		summary.Data = append(summary.Data, []string{
+			category,
+			strconv.Itoa(counts[category]),
+			strconv.Itoa(after[category]),
+			fraction(counts[category], totalBefore),
+			fraction(after[category], totalAfter),
+		})
+	}
+	tasks = append(tasks, skyhook.ExecTask{
+		Key: "summary",
+		Metadata: string(skyhook.JsonMarshal(TaskMetadata{Summary: &summary})),
+	})
+
+	return tasks, nil
+}
+
+type RebalanceOp struct {
+	URL string
+	OutputDatasets map[string]skyhook.Dataset
+}
+
+func (e *RebalanceOp) Parallelism() int {
+	return runtime.NumCPU()
+}
+
+func (e *RebalanceOp) Apply(task skyhook.ExecTask) error {
+	var metadata TaskMetadata
+	if task.Metadata != "" {
+		skyhook.JsonUnmarshal([]byte(task.Metadata), &metadata)
+	}
+	if metadata.Summary != nil {
+		return exec_ops.WriteItem(e.URL, e.OutputDatasets["summary"], task.Key, *metadata.Summary)
+	}
+
+	if err := exec_ops.AddReference(e.URL, e.OutputDatasets["labels"], task.Key, task.Items["labels"][0][0]); err != nil {
+		return err
+	}
+	for i, itemList := range task.Items["inputs"] {
+		if err := exec_ops.AddReference(e.URL, e.OutputDatasets[fmt.Sprintf("outputs%d", i)], task.Key, itemList[0]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *RebalanceOp) Close() {}
+
+func init() {
+	skyhook.AddExecOpImpl(skyhook.ExecOpImpl{
+		Config: skyhook.ExecOpConfig{
+			ID: "rebalance",
+			Name: "Rebalance",
+			Description: "Over- or under-sample items to balance the categories in their labels",
+		},
+		Inputs: []skyhook.ExecInput{
+			{Name: "labels", DataTypes: []skyhook.DataType{skyhook.IntType, skyhook.DetectionType}},
+			{Name: "inputs", Variable: true},
+		},
+		GetOutputs: func(rawParams string, inputTypes map[string][]skyhook.DataType) []skyhook.ExecOutput {
+			labelType := skyhook.DataType(skyhook.IntType)
+			if len(inputTypes["labels"]) > 0 {
+				labelType = inputTypes["labels"][0]
+			}
+			outputs := []skyhook.ExecOutput{
+				{Name: "labels", DataType: labelType},
+				{Name: "summary", DataType: skyhook.TableType},
+			}
+			for i, inputType := range inputTypes["inputs"] {
+				outputs = append(outputs, skyhook.ExecOutput{
+					Name: fmt.Sprintf("outputs%d", i),
+					DataType: inputType,
+				})
+			}
+			return outputs
+		},
+		Requirements: func(node skyhook.Runnable) map[string]int {
+			return nil
+		},
+		GetTasks: GetTasks,
+		Prepare: func(url string, node skyhook.Runnable) (skyhook.ExecOp, error) {
+			var params Params
+			if err := exec_ops.DecodeParams(node, &params, true); err != nil {
+				return nil, err
+			}
+			if mode := params.GetMode(); mode != "oversample" && mode != "undersample" && mode != "count" {
+				return nil, fmt.Errorf("unknown mode %s", mode)
+			}
+			op := &RebalanceOp{
+				URL: url,
+				OutputDatasets: node.OutputDatasets,
+			}
+			return op, nil
+		},
+		ImageName: "skyhookml/basic",
+		InProcess: true,
+	})
+}
@@ -1,6 +1,8 @@
 import sys
 sys.path.append('./python')
+import skyhook.common as lib
 
+import io
 import json
 import numpy
 import os, os.path
@@ -16,11 +18,13 @@ import skyhook.pytorch.model as model
 import skyhook.pytorch.util as util
 
 in_dataset_id = int(sys.argv[1])
+url = sys.argv[2]
 
 device = torch.device('cuda:0')
 #device = torch.device('cpu')
-model_path = 'data/items/{}/model.pt'.format(in_dataset_id)
-save_dict = torch.load(model_path)
+# the model may not be in a local file, e.g. if the dataset is stored in s3
+model_item = lib.get_item(url, in_dataset_id, 'model')
+save_dict = torch.load(io.BytesIO(lib.read_item(model_item['Dataset'], model_item, url)))
 example_inputs = save_dict['example_inputs']
 util.inputs_to_device(example_inputs, device)
 net = model.Net(save_dict['arch'], save_dict['comps'], example_inputs, save_dict['example_metadatas'], infer=True, device=device)
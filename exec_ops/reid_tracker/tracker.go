@@ -55,7 +55,7 @@ func Prepare(url string, node skyhook.Runnable) (skyhook.ExecOp, error) {
 	cmd := skyhook.Command(
 		fmt.Sprintf("reid_tracker-%s", node.Name), skyhook.CommandOptions{},
 		"python3", "exec_ops/reid_tracker/run.py",
-		strconv.Itoa(node.InputDatasets["model"][0].ID),
+		strconv.Itoa(node.InputDatasets["model"][0].ID), url,
 	)
 
 	return &Tracker{
@@ -237,7 +237,7 @@ func init() {
 		},
 		Outputs: []skyhook.ExecOutput{{Name: "tracks", DataType: skyhook.DetectionType}},
 		Requirements: func(node skyhook.Runnable) map[string]int {
-			return nil
+			return map[string]int{skyhook.ResourceGPU: 1}
 		},
 		GetTasks: func(node skyhook.Runnable, rawItems map[string][][]skyhook.Item) ([]skyhook.ExecTask, error) {
 			// provide everything but the model to SimpleTasks
@@ -146,5 +146,6 @@ func init() {
 			return op, nil
 		},
 		ImageName: "skyhookml/basic",
+		InProcess: true,
 	})
 }
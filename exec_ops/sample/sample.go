@@ -7,7 +7,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"math/rand"
-	urllib "net/url"
 )
 
 type Params struct {
@@ -79,14 +78,7 @@ func init() {
 				for i, itemList := range task.Items["inputs"] {
 					item := itemList[0]
 					dsName := fmt.Sprintf("outputs%d", i) // matches exec_ops.GetOutputsSimilarToInputs
-					err := skyhook.JsonPostForm(url, fmt.Sprintf("/datasets/%d/items", node.OutputDatasets[dsName].ID), urllib.Values{
-						"key": {task.Key},
-						"ext": {item.Ext},
-						"format": {item.Format},
-						"metadata": {item.Metadata},
-						"provider": {"reference"},
-						"provider_info": {item.Fname()},
-					}, nil)
+					err := exec_ops.AddReference(url, node.OutputDatasets[dsName], task.Key, item)
 					if err != nil {
 						return err
 					}
@@ -96,5 +88,6 @@ func init() {
 			return skyhook.SimpleExecOp{ApplyFunc: applyFunc}, nil
 		},
 		ImageName: "skyhookml/basic",
+		InProcess: true,
 	})
 }
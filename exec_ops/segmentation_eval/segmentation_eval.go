@@ -0,0 +1,304 @@
+package segmentation_eval
+
+// Evaluate predicted class masks against target masks.
+// Both inputs are uint8 ArrayData with one channel, where each element is a
+// class ID (e.g. from segmentation_mask).
+// Outputs a metrics table with per-class IOU, Dice and accuracy, followed by a
+// "mean" row (mean IOU etc.) and an "all" row with the overall pixel accuracy.
+// If PerItem is set, also outputs a table with metrics of each item, sorted
+// so that the worst items come first.
+
+import (
+	"github.com/skyhookml/skyhookml/skyhook"
+	"github.com/skyhookml/skyhookml/exec_ops"
+
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+)
+
+type Params struct {
+	// Optional category names, where Categories[i] is the name of class i.
+	Categories []string
+	// Optional class ID in target masks that should be ignored, e.g. for
+	// unlabeled pixels.
+	IgnoreIndex *int
+	// Whether to output the per-item table.
+	PerItem bool
+}
+
+// Pixel counts for each class.
+type Counts struct {
+	// Pixels where both prediction and target are the class.
+	TP [256]int64
+	Predicted [256]int64
+	Target [256]int64
+	// Number of pixels evaluated (excluding ignored pixels).
+	Total int64
+}
+
+func (c *Counts) Add(other Counts) {
+	for i := 0; i < 256; i++ {
+		c.TP[i] += other.TP[i]
+		c.Predicted[i] += other.Predicted[i]
+		c.Target[i] += other.Target[i]
+	}
+	c.Total += other.Total
+}
+
+func (c Counts) IOU(cls int) float64 {
+	union := c.Predicted[cls] + c.Target[cls] - c.TP[cls]
+	if union == 0 {
+		return math.NaN()
+	}
+	return float64(c.TP[cls])/float64(union)
+}
+
+func (c Counts) Dice(cls int) float64 {
+	denom := c.Predicted[cls] + c.Target[cls]
+	if denom == 0 {
+		return math.NaN()
+	}
+	return float64(2*c.TP[cls])/float64(denom)
+}
+
+// Fraction of target pixels of the class that are predicted correctly.
+func (c Counts) Accuracy(cls int) float64 {
+	if c.Target[cls] == 0 {
+		return math.NaN()
+	}
+	return float64(c.TP[cls])/float64(c.Target[cls])
+}
+
+func (c Counts) PixelAccuracy() float64 {
+	if c.Total == 0 {
+		return math.NaN()
+	}
+	var correct int64
+	for i := 0; i < 256; i++ {
+		correct += c.TP[i]
+	}
+	return float64(correct)/float64(c.Total)
+}
+
+// Returns the mean of f over classes where it is defined.
+func (c Counts) Mean(f func(int) float64) float64 {
+	var sum float64
+	var count int
+	for cls := 0; cls < 256; cls++ {
+		x := f(cls)
+		if math.IsNaN(x) {
+			continue
+		}
+		sum += x
+		count++
+	}
+	if count == 0 {
+		return math.NaN()
+	}
+	return sum/float64(count)
+}
+
+func formatFloat(x float64) string {
+	if math.IsNaN(x) {
+		return ""
+	}
+	return strconv.FormatFloat(x, 'f', 4, 64)
+}
+
+func getMask(data skyhook.Data) (skyhook.ArrayData, error) {
+	array := data.(skyhook.ArrayData)
+	if array.Metadata.Type != "uint8" || array.Metadata.Channels != 1 {
+		return array, fmt.Errorf("expected uint8 array with one channel, but got %s array with %d channels", array.Metadata.Type, array.Metadata.Channels)
+	}
+	return array, nil
+}
+
+// Count pixels of each class in a pair of masks.
+func CompareMasks(predicted skyhook.ArrayData, target skyhook.ArrayData, ignoreIndex *int) (Counts, error) {
+	var counts Counts
+	if predicted.Metadata.Width != target.Metadata.Width || predicted.Metadata.Height != target.Metadata.Height {
+		return counts, fmt.Errorf(
+			"predicted mask is %dx%d but target is %dx%d",
+			predicted.Metadata.Width, predicted.Metadata.Height,
+			target.Metadata.Width, target.Metadata.Height,
+		)
+	}
+	if len(predicted.Bytes) != len(target.Bytes) {
+		return counts, fmt.Errorf("predicted mask has %d frames but target has %d", predicted.Length(), target.Length())
+	}
+	for i := range target.Bytes {
+		t := target.Bytes[i]
+		if ignoreIndex != nil && int(t) == *ignoreIndex {
+			continue
+		}
+		p := predicted.Bytes[i]
+		counts.Total++
+		counts.Predicted[p]++
+		counts.Target[t]++
+		if p == t {
+			counts.TP[t]++
+		}
+	}
+	return counts, nil
+}
+
+func MakeMetricsTable(counts Counts, categories []string) skyhook.TableData {
+	table := skyhook.TableData{
+		Specs: []skyhook.ColumnSpec{
+			{Label: "class", Type: "int"},
+			{Label: "category", Type: "string"},
+			{Label: "target_pixels", Type: "int"},
+			{Label: "predicted_pixels", Type: "int"},
+			{Label: "iou", Type: "float64"},
+			{Label: "dice", Type: "float64"},
+			{Label: "accuracy", Type: "float64"},
+		},
+	}
+	for cls := 0; cls < 256; cls++ {
+		if cls >= len(categories) && counts.Target[cls] == 0 && counts.Predicted[cls] == 0 {
+			continue
+		}
+		category := strconv.Itoa(cls)
+		if cls < len(categories) {
+			category = categories[cls]
+		}
+		table.Data = append(table.Data, []string{
+			strconv.Itoa(cls),
+			category,
+			strconv.FormatInt(counts.Target[cls], 10),
+			strconv.FormatInt(counts.Predicted[cls], 10),
+			formatFloat(counts.IOU(cls)),
+			formatFloat(counts.Dice(cls)),
+			formatFloat(counts.Accuracy(cls)),
+		})
+	}
+	table.Data = append(table.Data, []string{
+		"", "mean", "", "",
+		formatFloat(counts.Mean(counts.IOU)),
+		formatFloat(counts.Mean(counts.Dice)),
+		formatFloat(counts.Mean(counts.Accuracy)),
+	})
+	table.Data = append(table.Data, []string{
+		"", "all", strconv.FormatInt(counts.Total, 10), strconv.FormatInt(counts.Total, 10),
+		"", "",
+		formatFloat(counts.PixelAccuracy()),
+	})
+	return table
+}
+
+func init() {
+	skyhook.AddExecOpImpl(skyhook.ExecOpImpl{
+		Config: skyhook.ExecOpConfig{
+			ID: "segmentation_eval",
+			Name: "Segmentation Evaluation",
+			Description: "Compute IOU, Dice, and pixel accuracy of predicted segmentation masks",
+		},
+		Inputs: []skyhook.ExecInput{
+			{Name: "predicted", DataTypes: []skyhook.DataType{skyhook.ArrayType}},
+			{Name: "target", DataTypes: []skyhook.DataType{skyhook.ArrayType}},
+		},
+		GetOutputs: func(rawParams string, inputTypes map[string][]skyhook.DataType) []skyhook.ExecOutput {
+			outputs := []skyhook.ExecOutput{{Name: "metrics", DataType: skyhook.TableType}}
+			var params Params
+			if err := json.Unmarshal([]byte(rawParams), &params); err == nil && params.PerItem {
+				outputs = append(outputs, skyhook.ExecOutput{Name: "items", DataType: skyhook.TableType})
+			}
+			return outputs
+		},
+		Requirements: func(node skyhook.Runnable) map[string]int {
+			return nil
+		},
+		GetTasks: exec_ops.SingleTask("eval"),
+		Prepare: func(url string, node skyhook.Runnable) (skyhook.ExecOp, error) {
+			var params Params
+			if err := exec_ops.DecodeParams(node, &params, true); err != nil {
+				return nil, err
+			}
+			applyFunc := func(task skyhook.ExecTask) error {
+				groupedItems := exec_ops.GroupItems(task.Items)
+				var keys []string
+				for key := range groupedItems {
+					keys = append(keys, key)
+				}
+				sort.Strings(keys)
+
+				type ItemResult struct {
+					Key string
+					Counts Counts
+				}
+				var total Counts
+				var itemResults []ItemResult
+				for _, key := range keys {
+					predData, err := groupedItems[key]["predicted"][0].LoadData()
+					if err != nil {
+						return err
+					}
+					targetData, err := groupedItems[key]["target"][0].LoadData()
+					if err != nil {
+						return err
+					}
+					predicted, err := getMask(predData)
+					if err != nil {
+						return fmt.Errorf("predicted item %s: %v", key, err)
+					}
+					target, err := getMask(targetData)
+					if err != nil {
+						return fmt.Errorf("target item %s: %v", key, err)
+					}
+					counts, err := CompareMasks(predicted, target, params.IgnoreIndex)
+					if err != nil {
+						return fmt.Errorf("item %s: %v", key, err)
+					}
+					total.Add(counts)
+					if params.PerItem {
+						itemResults = append(itemResults, ItemResult{key, counts})
+					}
+				}
+
+				metrics := MakeMetricsTable(total, params.Categories)
+				if err := exec_ops.WriteItem(url, node.OutputDatasets["metrics"], task.Key, metrics); err != nil {
+					return err
+				}
+				if !params.PerItem {
+					return nil
+				}
+
+				// sort by increasing mean IOU, so the worst items are first
+				// items where IOU is undefined (all pixels ignored) go last
+				meanIOUs := make(map[string]float64)
+				for _, result := range itemResults {
+					meanIOUs[result.Key] = result.Counts.Mean(result.Counts.IOU)
+				}
+				sort.SliceStable(itemResults, func(i, j int) bool {
+					a, b := meanIOUs[itemResults[i].Key], meanIOUs[itemResults[j].Key]
+					if math.IsNaN(b) {
+						return !math.IsNaN(a)
+					}
+					return a < b
+				})
+				items := skyhook.TableData{
+					Specs: []skyhook.ColumnSpec{
+						{Label: "key", Type: "string"},
+						{Label: "mean_iou", Type: "float64"},
+						{Label: "mean_dice", Type: "float64"},
+						{Label: "pixel_accuracy", Type: "float64"},
+					},
+				}
+				for _, result := range itemResults {
+					items.Data = append(items.Data, []string{
+						result.Key,
+						formatFloat(meanIOUs[result.Key]),
+						formatFloat(result.Counts.Mean(result.Counts.Dice)),
+						formatFloat(result.Counts.PixelAccuracy()),
+					})
+				}
+				return exec_ops.WriteItem(url, node.OutputDatasets["items"], task.Key, items)
+			}
+			return skyhook.SimpleExecOp{ApplyFunc: applyFunc}, nil
+		},
+		ImageName: "skyhookml/basic",
+	})
+}
@@ -0,0 +1,330 @@
+package split
+
+// Split the items of one or more datasets into train, validation, and test sets.
+// For each input dataset i, the outputs are train{i}, val{i}, and test{i}.
+// In k-fold mode, each item is in the validation set of exactly one fold and
+// in the training set of the others, and the outputs are fold{f}_train{i} and
+// fold{f}_val{i} for each fold f.
+// The split only depends on the seed and the set of keys, so re-running the
+// node produces the same split.
+// Items are optionally grouped by key prefix (so that e.g. frames of the same
+// video are in the same split), and stratified by category, which is read
+// from a labels dataset (the most common category in each item or group).
+
+import (
+	"github.com/skyhookml/skyhookml/skyhook"
+	"github.com/skyhookml/skyhookml/exec_ops"
+
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+type Params struct {
+	// Either "split" (default) or "kfold".
+	Mode string
+	// In split mode, percentage of items in each set (default 80/10/10).
+	// The percentages are normalized if they do not add up to 100.
+	TrainPercent float64
+	ValPercent float64
+	TestPercent float64
+	// In kfold mode, the number of folds (default 5).
+	Folds int
+	Seed int64
+	// If set, keys are grouped by the part before the last occurrence of this
+	// separator, and each group is assigned to a single split.
+	GroupSeparator string
+	// Whether to stratify by the category in the labels input.
+	Stratify bool
+}
+
+func (params Params) GetMode() string {
+	if params.Mode == "" {
+		return "split"
+	}
+	return params.Mode
+}
+
+func (params Params) GetFolds() int {
+	if params.Folds <= 0 {
+		return 5
+	}
+	return params.Folds
+}
+
+// Returns an error if the percents cannot be used to split the groups.
+func (params Params) CheckPercents() error {
+	if params.GetMode() == "kfold" {
+		return nil
+	}
+	percents := []float64{params.TrainPercent, params.ValPercent, params.TestPercent}
+	for _, percent := range percents {
+		if percent < 0 {
+			return fmt.Errorf("split percents must not be negative")
+		}
+	}
+	// all zero means to use the default percents
+	return nil
+}
+
+// Returns the names of the splits, and the fraction of groups to assign to each.
+// In kfold mode, these are the validation sets of each fold.
+func (params Params) GetSplits() ([]string, []float64) {
+	if params.GetMode() == "kfold" {
+		var names []string
+		var fractions []float64
+		for f := 0; f < params.GetFolds(); f++ {
+			names = append(names, fmt.Sprintf("fold%d_val", f))
+			fractions = append(fractions, 1/float64(params.GetFolds()))
+		}
+		return names, fractions
+	}
+
+	percents := []float64{params.TrainPercent, params.ValPercent, params.TestPercent}
+	if percents[0] == 0 && percents[1] == 0 && percents[2] == 0 {
+		percents = []float64{80, 10, 10}
+	}
+	sum := percents[0]+percents[1]+percents[2]
+	fractions := make([]float64, len(percents))
+	for i := range percents {
+		fractions[i] = percents[i]/sum
+	}
+	return []string{"train", "val", "test"}, fractions
+}
+
+// Returns the names of the output datasets, without the input index suffix.
+func (params Params) GetOutputSplits() []string {
+	if params.GetMode() == "kfold" {
+		var names []string
+		for f := 0; f < params.GetFolds(); f++ {
+			names = append(names, fmt.Sprintf("fold%d_train", f), fmt.Sprintf("fold%d_val", f))
+		}
+		return names
+	}
+	return []string{"train", "val", "test"}
+}
+
+func (params Params) GetGroup(key string) string {
+	if params.GroupSeparator == "" {
+		return key
+	}
+	idx := strings.LastIndex(key, params.GroupSeparator)
+	if idx == -1 {
+		return key
+	}
+	return key[0:idx]
+}
+
+type Group struct {
+	Name string
+	Category string
+	// Number of items in the group.
+	Size int
+}
+
+// Assign each group to a split, returning map from group name to split index.
+// Within each category, groups are shuffled and then each group is assigned
+// to the split that is furthest below its target number of items.
+func Assign(groups []Group, fractions []float64, seed int64) map[string]int {
+	r := rand.New(rand.NewSource(seed))
+	byCategory := make(map[string][]Group)
+	var categories []string
+	for _, group := range groups {
+		if _, ok := byCategory[group.Category]; !ok {
+			categories = append(categories, group.Category)
+		}
+		byCategory[group.Category] = append(byCategory[group.Category], group)
+	}
+	sort.Strings(categories)
+
+	assignment := make(map[string]int)
+	for _, category := range categories {
+		cur := byCategory[category]
+		sort.Slice(cur, func(i, j int) bool {
+			return cur[i].Name < cur[j].Name
+		})
+		r.Shuffle(len(cur), func(i, j int) {
+			cur[i], cur[j] = cur[j], cur[i]
+		})
+		var total int
+		for _, group := range cur {
+			total += group.Size
+		}
+		counts := make([]int, len(fractions))
+		for _, group := range cur {
+			best := -1
+			var bestDeficit float64
+			for i, fraction := range fractions {
+				if fraction <= 0 {
+					continue
+				}
+				deficit := fraction*float64(total) - float64(counts[i])
+				if best == -1 || deficit > bestDeficit {
+					best = i
+					bestDeficit = deficit
+				}
+			}
+			assignment[group.Name] = best
+			counts[best] += group.Size
+		}
+	}
+	return assignment
+}
+
+type TaskMetadata struct {
+	// Output splits that the item should be copied to.
+	Splits []string
+}
+
+func GetTasks(node skyhook.Runnable, allItems map[string][][]skyhook.Item) ([]skyhook.ExecTask, error) {
+	var params Params
+	if err := exec_ops.DecodeParams(node, &params, true); err != nil {
+		return nil, err
+	}
+	if err := params.CheckPercents(); err != nil {
+		return nil, err
+	}
+
+	simpleTasks, err := exec_ops.SimpleTasks(node, map[string][][]skyhook.Item{
+		"inputs": allItems["inputs"],
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// get the category of each item
+	categories := make(map[string]string)
+	if params.Stratify {
+		if len(allItems["labels"]) != 1 {
+			return nil, fmt.Errorf("stratify requires exactly one labels input")
+		}
+		for _, item := range allItems["labels"][0] {
+			data, err := item.LoadData()
+			if err != nil {
+				return nil, err
+			}
+			categories[item.Key] = exec_ops.GetCategory(data)
+		}
+	}
+
+	// group the items, and determine the category of each group
+	groupSizes := make(map[string]int)
+	groupCounts := make(map[string]map[string]int)
+	for _, task := range simpleTasks {
+		name := params.GetGroup(task.Key)
+		groupSizes[name]++
+		if groupCounts[name] == nil {
+			groupCounts[name] = make(map[string]int)
+		}
+		if category, ok := categories[task.Key]; ok {
+			groupCounts[name][category]++
+		}
+	}
+	var groups []Group
+	for name, size := range groupSizes {
+		groups = append(groups, Group{
+			Name: name,
+			Category: exec_ops.MostCommon(groupCounts[name]),
+			Size: size,
+		})
+	}
+
+	splitNames, fractions := params.GetSplits()
+	assignment := Assign(groups, fractions, params.Seed)
+	for i := range simpleTasks {
+		splitIdx := assignment[params.GetGroup(simpleTasks[i].Key)]
+		var metadata TaskMetadata
+		if params.GetMode() == "kfold" {
+			for f := 0; f < params.GetFolds(); f++ {
+				if f == splitIdx {
+					metadata.Splits = append(metadata.Splits, fmt.Sprintf("fold%d_val", f))
+				} else {
+					metadata.Splits = append(metadata.Splits, fmt.Sprintf("fold%d_train", f))
+				}
+			}
+		} else {
+			metadata.Splits = []string{splitNames[splitIdx]}
+		}
+		simpleTasks[i].Metadata = string(skyhook.JsonMarshal(metadata))
+	}
+	return simpleTasks, nil
+}
+
+type SplitOp struct {
+	URL string
+	OutputDatasets map[string]skyhook.Dataset
+}
+
+func (e *SplitOp) Parallelism() int {
+	return runtime.NumCPU()
+}
+
+func (e *SplitOp) Apply(task skyhook.ExecTask) error {
+	var metadata TaskMetadata
+	skyhook.JsonUnmarshal([]byte(task.Metadata), &metadata)
+	for _, split := range metadata.Splits {
+		for i, itemList := range task.Items["inputs"] {
+			item := itemList[0]
+			dsName := fmt.Sprintf("%s%d", split, i)
+			err := exec_ops.AddReference(e.URL, e.OutputDatasets[dsName], task.Key, item)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (e *SplitOp) Close() {}
+
+func init() {
+	skyhook.AddExecOpImpl(skyhook.ExecOpImpl{
+		Config: skyhook.ExecOpConfig{
+			ID: "split",
+			Name: "Split",
+			Description: "Split datasets into train, validation, and test sets, or into k folds",
+		},
+		Inputs: []skyhook.ExecInput{
+			{Name: "inputs", Variable: true},
+			// optional, used for stratification
+			{Name: "labels", DataTypes: []skyhook.DataType{skyhook.IntType, skyhook.DetectionType}, Variable: true},
+		},
+		GetOutputs: func(rawParams string, inputTypes map[string][]skyhook.DataType) []skyhook.ExecOutput {
+			var params Params
+			json.Unmarshal([]byte(rawParams), &params)
+			var outputs []skyhook.ExecOutput
+			for _, split := range params.GetOutputSplits() {
+				for i, inputType := range inputTypes["inputs"] {
+					outputs = append(outputs, skyhook.ExecOutput{
+						Name: fmt.Sprintf("%s%d", split, i),
+						DataType: inputType,
+					})
+				}
+			}
+			return outputs
+		},
+		Requirements: func(node skyhook.Runnable) map[string]int {
+			return nil
+		},
+		GetTasks: GetTasks,
+		Prepare: func(url string, node skyhook.Runnable) (skyhook.ExecOp, error) {
+			var params Params
+			if err := exec_ops.DecodeParams(node, &params, true); err != nil {
+				return nil, err
+			}
+			if mode := params.GetMode(); mode != "split" && mode != "kfold" {
+				return nil, fmt.Errorf("unknown mode %s", mode)
+			}
+			op := &SplitOp{
+				URL: url,
+				OutputDatasets: node.OutputDatasets,
+			}
+			return op, nil
+		},
+		ImageName: "skyhookml/basic",
+		InProcess: true,
+	})
+}
@@ -0,0 +1,446 @@
+package track_counting
+
+// Count tracks crossing lines and visiting zones.
+// Lines (line and polyline shapes) and zones (polygon and box shapes) are read
+// from the first frame of a shape item. If the config dataset has one item, it
+// applies to every track item; otherwise, each track item uses the config item
+// with the same key.
+// Outputs three tables for each track item:
+// - crossings: each time a track crosses a line
+// - dwell: each visit of a track in a zone, with its duration
+// - occupancy: number of tracks in each zone over time
+
+import (
+	"github.com/skyhookml/skyhookml/skyhook"
+	"github.com/skyhookml/skyhookml/exec_ops"
+
+	"fmt"
+	"runtime"
+	"sort"
+	"strconv"
+)
+
+type Params struct {
+	// Point of each box used to determine its position, either "center"
+	// (default) or "bottom" (center of the bottom edge, e.g. for pedestrians).
+	Anchor string
+	// If set, each track is counted at most once at each line.
+	CountOnce bool
+	// Frames per second, used to compute dwell times in seconds.
+	FPS float64
+	// Occupancy is output every OccupancyInterval frames (default 1).
+	OccupancyInterval int
+}
+
+func (params Params) GetOccupancyInterval() int {
+	if params.OccupancyInterval <= 0 {
+		return 1
+	}
+	return params.OccupancyInterval
+}
+
+type Point [2]float64
+
+func (p Point) Sub(other Point) Point {
+	return Point{p[0]-other[0], p[1]-other[1]}
+}
+
+func (p Point) Cross(other Point) float64 {
+	return p[0]*other[1] - p[1]*other[0]
+}
+
+func sign(x float64) int {
+	if x > 0 {
+		return 1
+	} else if x < 0 {
+		return -1
+	}
+	return 0
+}
+
+// Returns the side of segment a-b that p is on.
+// In image coordinates (y pointing down), 1 is the right side when walking
+// from a to b, and -1 is the left side.
+func side(a, b, p Point) int {
+	return sign(b.Sub(a).Cross(p.Sub(a)))
+}
+
+type Line struct {
+	Name string
+	Points []Point
+}
+
+type Zone struct {
+	Name string
+	Polygon []Point
+}
+
+// Even-odd rule point in polygon test.
+func (zone Zone) Contains(p Point) bool {
+	inside := false
+	n := len(zone.Polygon)
+	for i := 0; i < n; i++ {
+		a := zone.Polygon[i]
+		b := zone.Polygon[(i+1)%n]
+		if (a[1] > p[1]) != (b[1] > p[1]) {
+			x := a[0] + (p[1]-a[1])*(b[0]-a[0])/(b[1]-a[1])
+			if p[0] < x {
+				inside = !inside
+			}
+		}
+	}
+	return inside
+}
+
+// Get lines and zones from the shapes.
+// Shapes are named by their category, or else by type and index.
+func GetConfig(shapeData skyhook.ShapeData, dims [2]int) ([]Line, []Zone) {
+	if len(shapeData.Shapes) == 0 {
+		return nil, nil
+	}
+	shapeDims := shapeData.Metadata.CanvasDims
+	getPoint := func(p [2]int) Point {
+		// rescale to the canvas of the tracks if needed
+		if shapeDims[0] != 0 && dims[0] != 0 && shapeDims != dims {
+			return Point{
+				float64(p[0])*float64(dims[0])/float64(shapeDims[0]),
+				float64(p[1])*float64(dims[1])/float64(shapeDims[1]),
+			}
+		}
+		return Point{float64(p[0]), float64(p[1])}
+	}
+
+	var lines []Line
+	var zones []Zone
+	for _, shape := range shapeData.Shapes[0] {
+		var points []Point
+		for _, p := range shape.Points {
+			points = append(points, getPoint(p))
+		}
+		if shape.Type == skyhook.LineShape || shape.Type == skyhook.PolyLineShape {
+			name := shape.Category
+			if name == "" {
+				name = fmt.Sprintf("line%d", len(lines)+1)
+			}
+			lines = append(lines, Line{name, points})
+		} else if shape.Type == skyhook.PolygonShape || shape.Type == skyhook.BoxShape {
+			name := shape.Category
+			if name == "" {
+				name = fmt.Sprintf("zone%d", len(zones)+1)
+			}
+			if shape.Type == skyhook.BoxShape {
+				bounds := shape.Bounds()
+				points = []Point{
+					getPoint([2]int{bounds[0], bounds[1]}),
+					getPoint([2]int{bounds[2], bounds[1]}),
+					getPoint([2]int{bounds[2], bounds[3]}),
+					getPoint([2]int{bounds[0], bounds[3]}),
+				}
+			}
+			zones = append(zones, Zone{name, points})
+		}
+	}
+	return lines, zones
+}
+
+func (params Params) GetAnchor(d skyhook.Detection) Point {
+	x := float64(d.Left+d.Right)/2
+	if params.Anchor == "bottom" {
+		return Point{x, float64(d.Bottom)}
+	}
+	return Point{x, float64(d.Top+d.Bottom)/2}
+}
+
+type TrackPoint struct {
+	FrameIdx int
+	Point Point
+}
+
+// Returns positions of each track, sorted by frame.
+func (params Params) GetTracks(detections [][]skyhook.Detection) ([]int, map[int][]TrackPoint) {
+	var trackIDs []int
+	tracks := make(map[int][]TrackPoint)
+	for frameIdx, dlist := range detections {
+		for _, d := range dlist {
+			if d.TrackID == 0 {
+				continue
+			}
+			if _, ok := tracks[d.TrackID]; !ok {
+				trackIDs = append(trackIDs, d.TrackID)
+			}
+			tracks[d.TrackID] = append(tracks[d.TrackID], TrackPoint{frameIdx, params.GetAnchor(d)})
+		}
+	}
+	sort.Ints(trackIDs)
+	return trackIDs, tracks
+}
+
+type Crossing struct {
+	TrackID int
+	Line string
+	// "positive" if the track moved to the right side of the line (walking
+	// from its first to its last point, in image coordinates), else "negative".
+	Direction string
+	FrameIdx int
+}
+
+func (params Params) GetCrossings(track []TrackPoint, trackID int, line Line) []Crossing {
+	var crossings []Crossing
+	for i := 0; i+1 < len(line.Points); i++ {
+		a, b := line.Points[i], line.Points[i+1]
+		// last position where the track was strictly on one side of the line
+		var last *TrackPoint
+		lastSide := 0
+		for j := range track {
+			cur := track[j]
+			curSide := side(a, b, cur.Point)
+			if curSide == 0 {
+				continue
+			}
+			if last != nil && curSide != lastSide {
+				// the track changed sides, but make sure it passed within the segment
+				p, q := last.Point, cur.Point
+				if side(p, q, a)*side(p, q, b) <= 0 {
+					direction := "positive"
+					if curSide < 0 {
+						direction = "negative"
+					}
+					crossings = append(crossings, Crossing{trackID, line.Name, direction, cur.FrameIdx})
+				}
+			}
+			last = &track[j]
+			lastSide = curSide
+		}
+	}
+
+	// a track may cross a polyline at a vertex between two segments, so remove
+	// duplicates in the same frame
+	sort.SliceStable(crossings, func(i, j int) bool {
+		return crossings[i].FrameIdx < crossings[j].FrameIdx
+	})
+	var out []Crossing
+	for i, crossing := range crossings {
+		if i > 0 && crossing.FrameIdx == crossings[i-1].FrameIdx {
+			continue
+		}
+		out = append(out, crossing)
+		if params.CountOnce {
+			break
+		}
+	}
+	return out
+}
+
+type Visit struct {
+	TrackID int
+	Zone string
+	// First and last frames where the track was in the zone.
+	Enter int
+	Exit int
+}
+
+// Returns visits of the track in the zone, where each visit is a maximal run
+// of consecutive observations inside the zone.
+func GetVisits(track []TrackPoint, trackID int, zone Zone) []Visit {
+	var visits []Visit
+	var cur *Visit
+	for _, p := range track {
+		if !zone.Contains(p.Point) {
+			cur = nil
+			continue
+		}
+		if cur == nil {
+			visits = append(visits, Visit{trackID, zone.Name, p.FrameIdx, p.FrameIdx})
+			cur = &visits[len(visits)-1]
+		}
+		cur.Exit = p.FrameIdx
+	}
+	return visits
+}
+
+func (params Params) Count(detections [][]skyhook.Detection, lines []Line, zones []Zone) (skyhook.TableData, skyhook.TableData, skyhook.TableData) {
+	trackIDs, tracks := params.GetTracks(detections)
+
+	crossingTable := skyhook.TableData{
+		Specs: []skyhook.ColumnSpec{
+			{Label: "track", Type: "int"},
+			{Label: "line", Type: "string"},
+			{Label: "direction", Type: "string"},
+			{Label: "frame", Type: "int"},
+		},
+	}
+	var crossings []Crossing
+	for _, trackID := range trackIDs {
+		for _, line := range lines {
+			crossings = append(crossings, params.GetCrossings(tracks[trackID], trackID, line)...)
+		}
+	}
+	sort.SliceStable(crossings, func(i, j int) bool {
+		return crossings[i].FrameIdx < crossings[j].FrameIdx
+	})
+	for _, crossing := range crossings {
+		crossingTable.Data = append(crossingTable.Data, []string{
+			strconv.Itoa(crossing.TrackID),
+			crossing.Line,
+			crossing.Direction,
+			strconv.Itoa(crossing.FrameIdx),
+		})
+	}
+
+	dwellTable := skyhook.TableData{
+		Specs: []skyhook.ColumnSpec{
+			{Label: "track", Type: "int"},
+			{Label: "zone", Type: "string"},
+			{Label: "enter_frame", Type: "int"},
+			{Label: "exit_frame", Type: "int"},
+			{Label: "dwell_frames", Type: "int"},
+			{Label: "dwell_seconds", Type: "float64"},
+		},
+	}
+	// occupancy[zoneIdx][frameIdx] is number of tracks in the zone
+	occupancy := make([][]int, len(zones))
+	for zoneIdx, zone := range zones {
+		occupancy[zoneIdx] = make([]int, len(detections))
+		for _, trackID := range trackIDs {
+			for _, visit := range GetVisits(tracks[trackID], trackID, zone) {
+				frames := visit.Exit-visit.Enter+1
+				var seconds string
+				if params.FPS > 0 {
+					seconds = strconv.FormatFloat(float64(frames)/params.FPS, 'f', 2, 64)
+				}
+				dwellTable.Data = append(dwellTable.Data, []string{
+					strconv.Itoa(trackID),
+					zone.Name,
+					strconv.Itoa(visit.Enter),
+					strconv.Itoa(visit.Exit),
+					strconv.Itoa(frames),
+					seconds,
+				})
+				for frameIdx := visit.Enter; frameIdx <= visit.Exit; frameIdx++ {
+					occupancy[zoneIdx][frameIdx]++
+				}
+			}
+		}
+	}
+
+	occupancyTable := skyhook.TableData{
+		Specs: []skyhook.ColumnSpec{
+			{Label: "frame", Type: "int"},
+			{Label: "zone", Type: "string"},
+			{Label: "count", Type: "int"},
+		},
+	}
+	for frameIdx := 0; frameIdx < len(detections); frameIdx += params.GetOccupancyInterval() {
+		for zoneIdx, zone := range zones {
+			occupancyTable.Data = append(occupancyTable.Data, []string{
+				strconv.Itoa(frameIdx),
+				zone.Name,
+				strconv.Itoa(occupancy[zoneIdx][frameIdx]),
+			})
+		}
+	}
+
+	return crossingTable, dwellTable, occupancyTable
+}
+
+// Pair each track item with its config item.
+func GetTasks(node skyhook.Runnable, rawItems map[string][][]skyhook.Item) ([]skyhook.ExecTask, error) {
+	configItems := rawItems["config"][0]
+	if len(configItems) == 0 {
+		return nil, fmt.Errorf("config dataset is empty")
+	}
+	configByKey := make(map[string]skyhook.Item)
+	for _, item := range configItems {
+		configByKey[item.Key] = item
+	}
+	var tasks []skyhook.ExecTask
+	for _, item := range rawItems["tracks"][0] {
+		config, ok := configByKey[item.Key]
+		if !ok && len(configItems) == 1 {
+			config = configItems[0]
+			ok = true
+		}
+		if !ok {
+			continue
+		}
+		tasks = append(tasks, skyhook.ExecTask{
+			Key: item.Key,
+			Items: map[string][][]skyhook.Item{
+				"tracks": {{item}},
+				"config": {{config}},
+			},
+		})
+	}
+	return tasks, nil
+}
+
+type TrackCounting struct {
+	URL string
+	Params Params
+	OutputDatasets map[string]skyhook.Dataset
+}
+
+func (e *TrackCounting) Parallelism() int {
+	return runtime.NumCPU()
+}
+
+func (e *TrackCounting) Apply(task skyhook.ExecTask) error {
+	data, err := task.Items["tracks"][0][0].LoadData()
+	if err != nil {
+		return err
+	}
+	detectionData := data.(skyhook.DetectionData)
+	data, err = task.Items["config"][0][0].LoadData()
+	if err != nil {
+		return err
+	}
+	lines, zones := GetConfig(data.(skyhook.ShapeData), detectionData.Metadata.CanvasDims)
+
+	crossings, dwell, occupancy := e.Params.Count(detectionData.Detections, lines, zones)
+	if err := exec_ops.WriteItem(e.URL, e.OutputDatasets["crossings"], task.Key, crossings); err != nil {
+		return err
+	}
+	if err := exec_ops.WriteItem(e.URL, e.OutputDatasets["dwell"], task.Key, dwell); err != nil {
+		return err
+	}
+	return exec_ops.WriteItem(e.URL, e.OutputDatasets["occupancy"], task.Key, occupancy)
+}
+
+func (e *TrackCounting) Close() {}
+
+func init() {
+	skyhook.AddExecOpImpl(skyhook.ExecOpImpl{
+		Config: skyhook.ExecOpConfig{
+			ID: "track_counting",
+			Name: "Track Counting",
+			Description: "Count tracks crossing lines, and compute dwell times and occupancy of zones",
+		},
+		Inputs: []skyhook.ExecInput{
+			{Name: "tracks", DataTypes: []skyhook.DataType{skyhook.DetectionType}},
+			{Name: "config", DataTypes: []skyhook.DataType{skyhook.ShapeType}},
+		},
+		Outputs: []skyhook.ExecOutput{
+			{Name: "crossings", DataType: skyhook.TableType},
+			{Name: "dwell", DataType: skyhook.TableType},
+			{Name: "occupancy", DataType: skyhook.TableType},
+		},
+		Requirements: func(node skyhook.Runnable) map[string]int {
+			return nil
+		},
+		GetTasks: GetTasks,
+		Prepare: func(url string, node skyhook.Runnable) (skyhook.ExecOp, error) {
+			var params Params
+			if err := exec_ops.DecodeParams(node, &params, true); err != nil {
+				return nil, err
+			}
+			op := &TrackCounting{
+				URL: url,
+				Params: params,
+				OutputDatasets: node.OutputDatasets,
+			}
+			return op, nil
+		},
+		ImageName: "skyhookml/basic",
+		InProcess: true,
+	})
+}
@@ -0,0 +1,256 @@
+package track_postprocess
+
+// Clean up tracks produced by a tracker.
+// The steps are applied in this order:
+// 1. Drop tracks with fewer than MinLength detections, or whose mean score is
+//    below MinScore.
+// 2. Linearly interpolate boxes in frames missing within each track.
+// 3. Smooth the box coordinates along each track.
+// 4. Re-number the tracks densely (1, 2, ...) in order of first appearance.
+// Detections without TrackID are passed through unchanged.
+
+import (
+	"github.com/skyhookml/skyhookml/skyhook"
+	"github.com/skyhookml/skyhookml/exec_ops"
+
+	"fmt"
+	"math"
+	"runtime"
+)
+
+type Params struct {
+	// Minimum number of detections in a track, counted before interpolation.
+	MinLength int
+	MinScore float64
+
+	Interpolate bool
+	// Gaps longer than this many frames are not interpolated (0 means no limit).
+	MaxGap int
+
+	// Either "" (no smoothing), "moving_average", or "exponential".
+	Smoothing string
+	// For moving_average, number of frames in the window centered at each box.
+	Window int
+	// For exponential, weight of the current box versus the smoothed history.
+	Alpha float64
+}
+
+func (params Params) GetWindow() int {
+	if params.Window == 0 {
+		return 5
+	}
+	return params.Window
+}
+
+func (params Params) GetAlpha() float64 {
+	if params.Alpha == 0 {
+		return 0.5
+	}
+	return params.Alpha
+}
+
+type TrackedDetection struct {
+	skyhook.Detection
+	FrameIdx int
+}
+
+// Returns tracks from the detections, where each track is sorted by frame.
+// The first return value lists track IDs in order of first appearance.
+func GetTracks(detections [][]skyhook.Detection) ([]int, map[int][]TrackedDetection) {
+	var order []int
+	tracks := make(map[int][]TrackedDetection)
+	for frameIdx, dlist := range detections {
+		for _, d := range dlist {
+			if d.TrackID == 0 {
+				continue
+			}
+			if _, ok := tracks[d.TrackID]; !ok {
+				order = append(order, d.TrackID)
+			}
+			tracks[d.TrackID] = append(tracks[d.TrackID], TrackedDetection{d, frameIdx})
+		}
+	}
+	return order, tracks
+}
+
+func (params Params) KeepTrack(track []TrackedDetection) bool {
+	if len(track) < params.MinLength {
+		return false
+	}
+	if params.MinScore > 0 {
+		var sum float64
+		for _, d := range track {
+			sum += d.Score
+		}
+		if sum/float64(len(track)) < params.MinScore {
+			return false
+		}
+	}
+	return true
+}
+
+func lerp(a int, b int, t float64) int {
+	return int(math.Round(float64(a) + float64(b-a)*t))
+}
+
+func (params Params) InterpolateTrack(track []TrackedDetection) []TrackedDetection {
+	var out []TrackedDetection
+	for i, cur := range track {
+		if i > 0 {
+			prev := track[i-1]
+			gap := cur.FrameIdx - prev.FrameIdx - 1
+			if gap > 0 && (params.MaxGap == 0 || gap <= params.MaxGap) {
+				for frameIdx := prev.FrameIdx+1; frameIdx < cur.FrameIdx; frameIdx++ {
+					t := float64(frameIdx-prev.FrameIdx)/float64(cur.FrameIdx-prev.FrameIdx)
+					d := prev.Detection
+					d.Left = lerp(prev.Left, cur.Left, t)
+					d.Top = lerp(prev.Top, cur.Top, t)
+					d.Right = lerp(prev.Right, cur.Right, t)
+					d.Bottom = lerp(prev.Bottom, cur.Bottom, t)
+					d.Score = prev.Score + (cur.Score-prev.Score)*t
+					out = append(out, TrackedDetection{d, frameIdx})
+				}
+			}
+		}
+		out = append(out, cur)
+	}
+	return out
+}
+
+func (params Params) SmoothTrack(track []TrackedDetection) []TrackedDetection {
+	out := make([]TrackedDetection, len(track))
+	copy(out, track)
+	if params.Smoothing == "moving_average" {
+		radius := params.GetWindow()/2
+		for i := range track {
+			var left, top, right, bottom float64
+			var count int
+			// the track is sorted by frame, so the window is a contiguous range
+			start, end := i, i
+			for start > 0 && track[start-1].FrameIdx >= track[i].FrameIdx-radius {
+				start--
+			}
+			for end < len(track)-1 && track[end+1].FrameIdx <= track[i].FrameIdx+radius {
+				end++
+			}
+			for j := start; j <= end; j++ {
+				left += float64(track[j].Left)
+				top += float64(track[j].Top)
+				right += float64(track[j].Right)
+				bottom += float64(track[j].Bottom)
+				count++
+			}
+			n := float64(count)
+			out[i].Left = int(math.Round(left/n))
+			out[i].Top = int(math.Round(top/n))
+			out[i].Right = int(math.Round(right/n))
+			out[i].Bottom = int(math.Round(bottom/n))
+		}
+	} else if params.Smoothing == "exponential" {
+		alpha := params.GetAlpha()
+		left, top, right, bottom := float64(track[0].Left), float64(track[0].Top), float64(track[0].Right), float64(track[0].Bottom)
+		for i := range track {
+			left = alpha*float64(track[i].Left) + (1-alpha)*left
+			top = alpha*float64(track[i].Top) + (1-alpha)*top
+			right = alpha*float64(track[i].Right) + (1-alpha)*right
+			bottom = alpha*float64(track[i].Bottom) + (1-alpha)*bottom
+			out[i].Left = int(math.Round(left))
+			out[i].Top = int(math.Round(top))
+			out[i].Right = int(math.Round(right))
+			out[i].Bottom = int(math.Round(bottom))
+		}
+	}
+	return out
+}
+
+func (params Params) Process(detections [][]skyhook.Detection) [][]skyhook.Detection {
+	ndetections := make([][]skyhook.Detection, len(detections))
+	for frameIdx, dlist := range detections {
+		ndetections[frameIdx] = []skyhook.Detection{}
+		for _, d := range dlist {
+			if d.TrackID == 0 {
+				ndetections[frameIdx] = append(ndetections[frameIdx], d)
+			}
+		}
+	}
+
+	order, tracks := GetTracks(detections)
+	nextID := 1
+	for _, trackID := range order {
+		track := tracks[trackID]
+		if !params.KeepTrack(track) {
+			continue
+		}
+		if params.Interpolate {
+			track = params.InterpolateTrack(track)
+		}
+		track = params.SmoothTrack(track)
+		for _, d := range track {
+			d.TrackID = nextID
+			ndetections[d.FrameIdx] = append(ndetections[d.FrameIdx], d.Detection)
+		}
+		nextID++
+	}
+	return ndetections
+}
+
+type TrackPostprocess struct {
+	URL string
+	Params Params
+	Dataset skyhook.Dataset
+}
+
+func (e *TrackPostprocess) Parallelism() int {
+	return runtime.NumCPU()
+}
+
+func (e *TrackPostprocess) Apply(task skyhook.ExecTask) error {
+	data, err := task.Items["tracks"][0][0].LoadData()
+	if err != nil {
+		return err
+	}
+	detectionData := data.(skyhook.DetectionData)
+	outputData := skyhook.DetectionData{
+		Detections: e.Params.Process(detectionData.Detections),
+		Metadata: detectionData.Metadata,
+	}
+	return exec_ops.WriteItem(e.URL, e.Dataset, task.Key, outputData)
+}
+
+func (e *TrackPostprocess) Close() {}
+
+func init() {
+	skyhook.AddExecOpImpl(skyhook.ExecOpImpl{
+		Config: skyhook.ExecOpConfig{
+			ID: "track_postprocess",
+			Name: "Track Post-processing",
+			Description: "Interpolate, smooth, filter, and re-number tracks",
+		},
+		Inputs: []skyhook.ExecInput{{Name: "tracks", DataTypes: []skyhook.DataType{skyhook.DetectionType}}},
+		Outputs: []skyhook.ExecOutput{{Name: "tracks", DataType: skyhook.DetectionType}},
+		Requirements: func(node skyhook.Runnable) map[string]int {
+			return nil
+		},
+		GetTasks: exec_ops.SimpleTasks,
+		Prepare: func(url string, node skyhook.Runnable) (skyhook.ExecOp, error) {
+			var params Params
+			if err := exec_ops.DecodeParams(node, &params, true); err != nil {
+				return nil, err
+			}
+			if params.Smoothing != "" && params.Smoothing != "moving_average" && params.Smoothing != "exponential" {
+				return nil, fmt.Errorf("unknown smoothing %s", params.Smoothing)
+			}
+			op := &TrackPostprocess{
+				URL: url,
+				Params: params,
+				Dataset: node.OutputDatasets["tracks"],
+			}
+			return op, nil
+		},
+		Incremental: true,
+		GetOutputKeys: exec_ops.MapGetOutputKeys,
+		GetNeededInputs: exec_ops.MapGetNeededInputs,
+		ImageName: "skyhookml/basic",
+		InProcess: true,
+	})
+}
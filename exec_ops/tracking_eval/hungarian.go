@@ -0,0 +1,94 @@
+package tracking_eval
+
+import (
+	"math"
+)
+
+// Solve the assignment problem with the Hungarian algorithm.
+// weights[i][j] is the gain from assigning row i to column j.
+// Returns the column assigned to each row, or -1 if the row is unassigned.
+// Pairs with non-positive weight are never assigned.
+func MaxWeightAssignment(weights [][]float64) []int {
+	rows := len(weights)
+	if rows == 0 {
+		return nil
+	}
+	cols := len(weights[0])
+	n := rows
+	if cols > n {
+		n = cols
+	}
+
+	// square cost matrix, 1-indexed, padded with zero
+	cost := func(i, j int) float64 {
+		if i > rows || j > cols || weights[i-1][j-1] <= 0 {
+			return 0
+		}
+		return -weights[i-1][j-1]
+	}
+
+	u := make([]float64, n+1)
+	v := make([]float64, n+1)
+	// p[j] is the row assigned to column j
+	p := make([]int, n+1)
+	way := make([]int, n+1)
+	for i := 1; i <= n; i++ {
+		p[0] = i
+		j0 := 0
+		minv := make([]float64, n+1)
+		used := make([]bool, n+1)
+		for j := range minv {
+			minv[j] = math.Inf(1)
+		}
+		for {
+			used[j0] = true
+			i0 := p[j0]
+			delta := math.Inf(1)
+			j1 := 0
+			for j := 1; j <= n; j++ {
+				if used[j] {
+					continue
+				}
+				cur := cost(i0, j) - u[i0] - v[j]
+				if cur < minv[j] {
+					minv[j] = cur
+					way[j] = j0
+				}
+				if minv[j] < delta {
+					delta = minv[j]
+					j1 = j
+				}
+			}
+			for j := 0; j <= n; j++ {
+				if used[j] {
+					u[p[j]] += delta
+					v[j] -= delta
+				} else {
+					minv[j] -= delta
+				}
+			}
+			j0 = j1
+			if p[j0] == 0 {
+				break
+			}
+		}
+		for j0 != 0 {
+			j1 := way[j0]
+			p[j0] = p[j1]
+			j0 = j1
+		}
+	}
+
+	assignment := make([]int, rows)
+	for i := range assignment {
+		assignment[i] = -1
+	}
+	for j := 1; j <= n; j++ {
+		i := p[j]
+		if i == 0 || i > rows || j > cols || weights[i-1][j-1] <= 0 {
+			continue
+		}
+		assignment[i-1] = j-1
+	}
+	return assignment
+}
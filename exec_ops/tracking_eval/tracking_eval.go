@@ -0,0 +1,395 @@
+package tracking_eval
+
+// Evaluate predicted tracks against ground truth tracks with the CLEAR MOT
+// metrics (MOTA, MOTP) and identity metrics (IDF1).
+// Outputs a table with a row for each video key, and a final "overall" row.
+// MOTP is the mean IOU of matched boxes, so higher is better.
+
+import (
+	"github.com/skyhookml/skyhookml/skyhook"
+	"github.com/skyhookml/skyhookml/exec_ops"
+
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// Ground truth tracks that are matched in at least this fraction of their
+// frames are mostly tracked, and those matched in at most MostlyLost of their
+// frames are mostly lost.
+const MostlyTracked = 0.8
+const MostlyLost = 0.2
+
+type Params struct {
+	// Minimum IOU for a predicted box to match a ground truth box.
+	IOUThreshold float64
+}
+
+func (params Params) GetIOUThreshold() float64 {
+	if params.IOUThreshold == 0 {
+		return 0.5
+	}
+	return params.IOUThreshold
+}
+
+type Result struct {
+	Frames int
+	// Number of ground truth and predicted boxes.
+	NumGT int
+	NumPredicted int
+	// Number of matched boxes, and sum of their IOUs.
+	Matches int
+	IOUSum float64
+	FalsePositives int
+	Misses int
+	IDSwitches int
+	Fragmentations int
+	GTTracks int
+	PredTracks int
+	MostlyTracked int
+	PartiallyTracked int
+	MostlyLost int
+	// Boxes matched under the best one-to-one mapping between ground truth and
+	// predicted tracks, for IDF1.
+	IDTP int
+}
+
+func (r *Result) Add(other Result) {
+	r.Frames += other.Frames
+	r.NumGT += other.NumGT
+	r.NumPredicted += other.NumPredicted
+	r.Matches += other.Matches
+	r.IOUSum += other.IOUSum
+	r.FalsePositives += other.FalsePositives
+	r.Misses += other.Misses
+	r.IDSwitches += other.IDSwitches
+	r.Fragmentations += other.Fragmentations
+	r.GTTracks += other.GTTracks
+	r.PredTracks += other.PredTracks
+	r.MostlyTracked += other.MostlyTracked
+	r.PartiallyTracked += other.PartiallyTracked
+	r.MostlyLost += other.MostlyLost
+	r.IDTP += other.IDTP
+}
+
+func ratio(a float64, b int) float64 {
+	if b == 0 {
+		return math.NaN()
+	}
+	return a/float64(b)
+}
+
+func (r Result) MOTA() float64 {
+	return 1 - ratio(float64(r.Misses+r.FalsePositives+r.IDSwitches), r.NumGT)
+}
+
+func (r Result) MOTP() float64 {
+	return ratio(r.IOUSum, r.Matches)
+}
+
+func (r Result) IDF1() float64 {
+	return ratio(float64(2*r.IDTP), r.NumGT+r.NumPredicted)
+}
+
+func (r Result) IDP() float64 {
+	return ratio(float64(r.IDTP), r.NumPredicted)
+}
+
+func (r Result) IDR() float64 {
+	return ratio(float64(r.IDTP), r.NumGT)
+}
+
+// Evaluate the tracks in one video.
+func Evaluate(predicted [][]skyhook.Detection, groundTruth [][]skyhook.Detection, threshold float64) (Result, error) {
+	var result Result
+	if len(predicted) != len(groundTruth) {
+		return result, fmt.Errorf("there are %d predicted frames but %d ground truth frames", len(predicted), len(groundTruth))
+	}
+	result.Frames = len(groundTruth)
+
+	type GTStatus struct {
+		// number of frames where the track appears, and where it is matched
+		Present int
+		Tracked int
+		WasTracked bool
+		EverTracked bool
+	}
+	gtStatus := make(map[int]*GTStatus)
+	predTracks := make(map[int]bool)
+	// map from ground truth track ID to the predicted track ID that it matched
+	// in the previous frame, and the last one it was ever matched to
+	prevMapping := make(map[int]int)
+	lastMatched := make(map[int]int)
+	// for IDF1, number of frames where each (ground truth, predicted) pair of
+	// tracks overlap
+	pairCounts := make(map[[2]int]int)
+
+	for frameIdx := range groundTruth {
+		gts := groundTruth[frameIdx]
+		preds := predicted[frameIdx]
+		for _, d := range gts {
+			if d.TrackID == 0 {
+				return result, fmt.Errorf("ground truth detection in frame %d has no track ID", frameIdx)
+			}
+		}
+		for _, d := range preds {
+			if d.TrackID == 0 {
+				return result, fmt.Errorf("predicted detection in frame %d has no track ID", frameIdx)
+			}
+		}
+		result.NumGT += len(gts)
+		result.NumPredicted += len(preds)
+
+		ious := make([][]float64, len(gts))
+		for i, gt := range gts {
+			ious[i] = make([]float64, len(preds))
+			for j, pred := range preds {
+				ious[i][j] = gt.IOU(pred)
+				if ious[i][j] >= threshold {
+					pairCounts[[2]int{gt.TrackID, pred.TrackID}]++
+				}
+			}
+		}
+
+		// First keep matches from the previous frame if they are still valid.
+		gtMatch := make([]int, len(gts))
+		predUsed := make([]bool, len(preds))
+		predIdxByID := make(map[int]int)
+		for j, pred := range preds {
+			predTracks[pred.TrackID] = true
+			if _, ok := predIdxByID[pred.TrackID]; !ok {
+				predIdxByID[pred.TrackID] = j
+			}
+		}
+		for i, gt := range gts {
+			gtMatch[i] = -1
+			predID, ok := prevMapping[gt.TrackID]
+			if !ok {
+				continue
+			}
+			j, ok := predIdxByID[predID]
+			if !ok || predUsed[j] || ious[i][j] < threshold {
+				continue
+			}
+			gtMatch[i] = j
+			predUsed[j] = true
+		}
+
+		// Then match the remaining boxes to maximize total IOU.
+		var rows, cols []int
+		for i := range gts {
+			if gtMatch[i] == -1 {
+				rows = append(rows, i)
+			}
+		}
+		for j := range preds {
+			if !predUsed[j] {
+				cols = append(cols, j)
+			}
+		}
+		if len(rows) > 0 && len(cols) > 0 {
+			weights := make([][]float64, len(rows))
+			for a, i := range rows {
+				weights[a] = make([]float64, len(cols))
+				for b, j := range cols {
+					if ious[i][j] >= threshold {
+						weights[a][b] = ious[i][j]
+					}
+				}
+			}
+			for a, b := range MaxWeightAssignment(weights) {
+				if b == -1 {
+					continue
+				}
+				gtMatch[rows[a]] = cols[b]
+				predUsed[cols[b]] = true
+			}
+		}
+
+		mapping := make(map[int]int)
+		for i, gt := range gts {
+			status := gtStatus[gt.TrackID]
+			if status == nil {
+				status = &GTStatus{}
+				gtStatus[gt.TrackID] = status
+			}
+			status.Present++
+
+			j := gtMatch[i]
+			if j == -1 {
+				result.Misses++
+				status.WasTracked = false
+				continue
+			}
+			predID := preds[j].TrackID
+			if last, ok := lastMatched[gt.TrackID]; ok && last != predID {
+				result.IDSwitches++
+			}
+			lastMatched[gt.TrackID] = predID
+			mapping[gt.TrackID] = predID
+			result.Matches++
+			result.IOUSum += ious[i][j]
+
+			status.Tracked++
+			if !status.WasTracked && status.EverTracked {
+				result.Fragmentations++
+			}
+			status.WasTracked = true
+			status.EverTracked = true
+		}
+		for j := range preds {
+			if !predUsed[j] {
+				result.FalsePositives++
+			}
+		}
+		prevMapping = mapping
+	}
+
+	result.GTTracks = len(gtStatus)
+	result.PredTracks = len(predTracks)
+	for _, status := range gtStatus {
+		fraction := float64(status.Tracked)/float64(status.Present)
+		if fraction >= MostlyTracked {
+			result.MostlyTracked++
+		} else if fraction <= MostlyLost {
+			result.MostlyLost++
+		} else {
+			result.PartiallyTracked++
+		}
+	}
+
+	// Compute IDTP from the best one-to-one mapping of tracks.
+	var gtIDs, predIDs []int
+	for id := range gtStatus {
+		gtIDs = append(gtIDs, id)
+	}
+	for id := range predTracks {
+		predIDs = append(predIDs, id)
+	}
+	if len(gtIDs) > 0 && len(predIDs) > 0 {
+		weights := make([][]float64, len(gtIDs))
+		for i, gtID := range gtIDs {
+			weights[i] = make([]float64, len(predIDs))
+			for j, predID := range predIDs {
+				weights[i][j] = float64(pairCounts[[2]int{gtID, predID}])
+			}
+		}
+		for i, j := range MaxWeightAssignment(weights) {
+			if j == -1 {
+				continue
+			}
+			result.IDTP += pairCounts[[2]int{gtIDs[i], predIDs[j]}]
+		}
+	}
+
+	return result, nil
+}
+
+func formatFloat(x float64) string {
+	if math.IsNaN(x) {
+		return ""
+	}
+	return strconv.FormatFloat(x, 'f', 4, 64)
+}
+
+var Specs = []skyhook.ColumnSpec{
+	{Label: "key", Type: "string"},
+	{Label: "frames", Type: "int"},
+	{Label: "mota", Type: "float64"},
+	{Label: "motp", Type: "float64"},
+	{Label: "idf1", Type: "float64"},
+	{Label: "idp", Type: "float64"},
+	{Label: "idr", Type: "float64"},
+	{Label: "id_switches", Type: "int"},
+	{Label: "fragmentations", Type: "int"},
+	{Label: "false_positives", Type: "int"},
+	{Label: "misses", Type: "int"},
+	{Label: "gt_tracks", Type: "int"},
+	{Label: "pred_tracks", Type: "int"},
+	{Label: "mostly_tracked", Type: "int"},
+	{Label: "partially_tracked", Type: "int"},
+	{Label: "mostly_lost", Type: "int"},
+}
+
+func (r Result) Row(key string) []string {
+	return []string{
+		key,
+		strconv.Itoa(r.Frames),
+		formatFloat(r.MOTA()),
+		formatFloat(r.MOTP()),
+		formatFloat(r.IDF1()),
+		formatFloat(r.IDP()),
+		formatFloat(r.IDR()),
+		strconv.Itoa(r.IDSwitches),
+		strconv.Itoa(r.Fragmentations),
+		strconv.Itoa(r.FalsePositives),
+		strconv.Itoa(r.Misses),
+		strconv.Itoa(r.GTTracks),
+		strconv.Itoa(r.PredTracks),
+		strconv.Itoa(r.MostlyTracked),
+		strconv.Itoa(r.PartiallyTracked),
+		strconv.Itoa(r.MostlyLost),
+	}
+}
+
+func init() {
+	skyhook.AddExecOpImpl(skyhook.ExecOpImpl{
+		Config: skyhook.ExecOpConfig{
+			ID: "tracking_eval",
+			Name: "Tracking Evaluation",
+			Description: "Compute MOTA, MOTP, IDF1, and other multi-object tracking metrics",
+		},
+		Inputs: []skyhook.ExecInput{
+			{Name: "predicted", DataTypes: []skyhook.DataType{skyhook.DetectionType}},
+			{Name: "ground_truth", DataTypes: []skyhook.DataType{skyhook.DetectionType}},
+		},
+		Outputs: []skyhook.ExecOutput{{Name: "metrics", DataType: skyhook.TableType}},
+		Requirements: func(node skyhook.Runnable) map[string]int {
+			return nil
+		},
+		GetTasks: exec_ops.SingleTask("eval"),
+		Prepare: func(url string, node skyhook.Runnable) (skyhook.ExecOp, error) {
+			var params Params
+			if err := exec_ops.DecodeParams(node, &params, true); err != nil {
+				return nil, err
+			}
+			applyFunc := func(task skyhook.ExecTask) error {
+				groupedItems := exec_ops.GroupItems(task.Items)
+				var keys []string
+				for key := range groupedItems {
+					keys = append(keys, key)
+				}
+				sort.Strings(keys)
+
+				table := skyhook.TableData{Specs: Specs}
+				var overall Result
+				for _, key := range keys {
+					predData, err := groupedItems[key]["predicted"][0].LoadData()
+					if err != nil {
+						return err
+					}
+					gtData, err := groupedItems[key]["ground_truth"][0].LoadData()
+					if err != nil {
+						return err
+					}
+					result, err := Evaluate(
+						predData.(skyhook.DetectionData).Detections,
+						gtData.(skyhook.DetectionData).Detections,
+						params.GetIOUThreshold(),
+					)
+					if err != nil {
+						return fmt.Errorf("item %s: %v", key, err)
+					}
+					table.Data = append(table.Data, result.Row(key))
+					overall.Add(result)
+				}
+				table.Data = append(table.Data, overall.Row("overall"))
+				return exec_ops.WriteItem(url, node.OutputDatasets["metrics"], task.Key, table)
+			}
+			return skyhook.SimpleExecOp{ApplyFunc: applyFunc}, nil
+		},
+		ImageName: "skyhookml/basic",
+		InProcess: true,
+	})
+}
@@ -79,5 +79,6 @@ func init() {
 			return skyhook.SimpleExecOp{ApplyFunc: applyFunc}, nil
 		},
 		ImageName: "skyhookml/basic",
+		InProcess: true,
 	})
 }
@@ -122,8 +122,7 @@ func (e *TrainOp) Apply(task skyhook.ExecTask) error {
 	}
 
 	// add to the file dataset
-	fileMetadata := skyhook.FileMetadata{Filename: "model.pt"}
-	_, err = exec_ops.AddItem(e.url, e.dataset, "model", "pt", "", string(skyhook.JsonMarshal(fileMetadata)))
+	err = exec_ops.AddFileItem(e.url, e.dataset, "model", "pt", filepath.Join(e.dataset.Dirname(), "model.pt"))
 	if err != nil {
 		return err
 	}
@@ -146,7 +145,7 @@ func init() {
 		},
 		Outputs: []skyhook.ExecOutput{{Name: "model", DataType: skyhook.FileType}},
 		Requirements: func(node skyhook.Runnable) map[string]int {
-			return nil
+			return map[string]int{skyhook.ResourceGPU: 1}
 		},
 		GetTasks: exec_ops.SingleTask("model"),
 		Prepare: func(url string, node skyhook.Runnable) (skyhook.ExecOp, error) {
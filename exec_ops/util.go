@@ -7,6 +7,9 @@ import (
 	"fmt"
 	"log"
 	urllib "net/url"
+	"os"
+	"path/filepath"
+	"strconv"
 )
 
 func GetDataset(url string, id int) (skyhook.Dataset, error) {
@@ -168,6 +171,53 @@ func AddItem(url string, dataset skyhook.Dataset, key string, ext string, format
 	return item, err
 }
 
+// Add a file item to the dataset from a file that was written locally, e.g. a
+// model saved by a training script in the dataset directory.
+// If the dataset stores items elsewhere (e.g. in S3), the file is uploaded
+// there and the local copy is removed.
+func AddFileItem(url string, dataset skyhook.Dataset, key string, ext string, fname string) error {
+	fileMetadata := skyhook.FileMetadata{Filename: filepath.Base(fname)}
+	item, err := AddItem(url, dataset, key, ext, "", string(skyhook.JsonMarshal(fileMetadata)))
+	if err != nil {
+		return err
+	}
+	if item.Provider == nil {
+		// the file is usually written at the item's filename already
+		srcFi, err := os.Stat(fname)
+		if err != nil {
+			return err
+		}
+		if dstFi, err := os.Stat(item.Fname()); err == nil && os.SameFile(srcFi, dstFi) {
+			return nil
+		}
+		return item.CopyFrom(fname, false)
+	}
+	if err := item.CopyFrom(fname, false); err != nil {
+		return fmt.Errorf("error uploading %s: %v", fname, err)
+	}
+	return os.Remove(fname)
+}
+
+// Add an item to the dataset that references an existing item instead of copying it.
+// Items in local files are referenced by filename, while items in remote
+// storage (e.g. s3) share the same object.
+func AddReference(url string, dataset skyhook.Dataset, key string, item skyhook.Item) error {
+	provider := "reference"
+	providerInfo := item.Fname()
+	if providerInfo == "" && item.Provider != nil {
+		provider = *item.Provider
+		providerInfo = *item.ProviderInfo
+	}
+	return skyhook.JsonPostForm(url, fmt.Sprintf("/datasets/%d/items", dataset.ID), urllib.Values{
+		"key": {key},
+		"ext": {item.Ext},
+		"format": {item.Format},
+		"metadata": {item.Metadata},
+		"provider": {provider},
+		"provider_info": {providerInfo},
+	}, nil)
+}
+
 func WriteItemWithFormat(url string, dataset skyhook.Dataset, key string, data skyhook.Data, ext string, format string) error {
 	metadata := string(skyhook.JsonMarshal(data.GetMetadata()))
 	item, err := AddItem(url, dataset, key, ext, format, metadata)
@@ -256,3 +306,33 @@ func DecodeParams(node skyhook.Runnable, x interface{}, emptyOK bool) error {
 
 	return nil
 }
+
+// Returns the most common category in the labels, or "" if there are none.
+func GetCategory(data skyhook.Data) string {
+	counts := make(map[string]int)
+	if data.Type() == skyhook.IntType {
+		for _, x := range data.(skyhook.IntData).Ints {
+			counts[strconv.Itoa(x)]++
+		}
+	} else if data.Type() == skyhook.DetectionType {
+		for _, dlist := range data.(skyhook.DetectionData).Detections {
+			for _, d := range dlist {
+				counts[d.Category]++
+			}
+		}
+	}
+	return MostCommon(counts)
+}
+
+// Returns the key with highest count, breaking ties by smallest key.
+func MostCommon(counts map[string]int) string {
+	var best string
+	bestCount := 0
+	for key, count := range counts {
+		if count > bestCount || (count == bestCount && key < best) {
+			best = key
+			bestCount = count
+		}
+	}
+	return best
+}
@@ -8,12 +8,33 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
 )
 
+// Download model files that are not in the local dataset directory, e.g. if
+// the dataset is stored in s3, since darknet reads them from disk.
+func fetchModelFiles(url string, dataset skyhook.Dataset) error {
+	items, err := exec_ops.GetDatasetItems(url, dataset)
+	if err != nil {
+		return err
+	}
+	dataset.Mkdir()
+	for _, item := range items {
+		fname := filepath.Join(dataset.Dirname(), item.Key+"."+item.Ext)
+		if _, err := os.Stat(fname); err == nil {
+			continue
+		}
+		if err := item.CopyTo(fname, item.Format, false); err != nil {
+			return fmt.Errorf("error fetching model file %s: %v", item.Key, err)
+		}
+	}
+	return nil
+}
+
 func Prepare(url string, node skyhook.Runnable) (skyhook.ExecOp, error) {
 	var params Params
 	if err := exec_ops.DecodeParams(node, &params, false); err != nil {
@@ -21,6 +42,9 @@ func Prepare(url string, node skyhook.Runnable) (skyhook.ExecOp, error) {
 	}
 
 	modelDataset := node.InputDatasets["model"][0]
+	if err := fetchModelFiles(url, modelDataset); err != nil {
+		return nil, err
+	}
 
 	// load category names
 	var categories []string
@@ -160,7 +184,7 @@ func init() {
 		},
 		Outputs: []skyhook.ExecOutput{{Name: "detections", DataType: skyhook.DetectionType}},
 		Requirements: func(node skyhook.Runnable) map[string]int {
-			return nil
+			return map[string]int{skyhook.ResourceGPU: 1}
 		},
 		GetTasks: func(node skyhook.Runnable, rawItems map[string][][]skyhook.Item) ([]skyhook.ExecTask, error) {
 			// we want to use only images for SimpleTasks, not model
@@ -247,8 +247,7 @@ backup=%s
 		ext := filepath.Ext(fname)
 		key := fname[0:len(fname)-len(ext)]
 		ext = ext[1:]
-		fileMetadata := skyhook.FileMetadata{Filename: fname}
-		_, err := exec_ops.AddItem(e.url, e.dataset, key, ext, "", string(skyhook.JsonMarshal(fileMetadata)))
+		err := exec_ops.AddFileItem(e.url, e.dataset, key, ext, filepath.Join(trainPath, fname))
 		if err != nil {
 			return err
 		}
@@ -272,7 +271,7 @@ func init() {
 		},
 		Outputs: []skyhook.ExecOutput{{Name: "model", DataType: skyhook.FileType}},
 		Requirements: func(node skyhook.Runnable) map[string]int {
-			return nil
+			return map[string]int{skyhook.ResourceGPU: 1}
 		},
 		GetTasks: exec_ops.SingleTask("model"),
 		Prepare: func(url string, node skyhook.Runnable) (skyhook.ExecOp, error) {
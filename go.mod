@@ -11,10 +11,10 @@ require (
 	github.com/gorilla/mux v1.8.0
 	github.com/mattn/go-sqlite3 v1.14.6
 	github.com/mitroadmaps/gomapinfer v0.0.0-20200618184748-ce5d64b5a0d4
-	github.com/paulmach/go.geojson v1.4.0 // indirect
+	github.com/paulmach/go.geojson v1.4.0
 	github.com/petermattis/goid v0.0.0-20180202154549-b0b1615b78e5 // indirect
 	github.com/qedus/osmpbf v1.1.0 // indirect
-	github.com/rubenfonseca/fastimage v0.0.0-20170112075114-7e006a27a95b // indirect
+	github.com/rubenfonseca/fastimage v0.0.0-20170112075114-7e006a27a95b
 	github.com/sasha-s/go-deadlock v0.2.0
 	golang.org/x/image v0.0.0-20210220032944-ac19c3e999fb
 )
@@ -1,9 +1,13 @@
 package ops
 
 import (
+	_ "github.com/skyhookml/skyhookml/exec_ops/augment"
+	_ "github.com/skyhookml/skyhookml/exec_ops/classification_eval"
 	_ "github.com/skyhookml/skyhookml/exec_ops/convert"
 	_ "github.com/skyhookml/skyhookml/exec_ops/cropresize"
+	_ "github.com/skyhookml/skyhookml/exec_ops/detection_eval"
 	_ "github.com/skyhookml/skyhookml/exec_ops/detection_filter"
+	_ "github.com/skyhookml/skyhookml/exec_ops/detection_nms"
 	_ "github.com/skyhookml/skyhookml/exec_ops/filter"
 	_ "github.com/skyhookml/skyhookml/exec_ops/geoimage_to_image"
 	_ "github.com/skyhookml/skyhookml/exec_ops/geojson_to_shape"
@@ -13,13 +17,19 @@ import (
 	_ "github.com/skyhookml/skyhookml/exec_ops/pythonv2"
 	_ "github.com/skyhookml/skyhookml/exec_ops/pytorch"
 	_ "github.com/skyhookml/skyhookml/exec_ops/pytorch/archs"
+	_ "github.com/skyhookml/skyhookml/exec_ops/rebalance"
 	_ "github.com/skyhookml/skyhookml/exec_ops/reid_tracker"
 	_ "github.com/skyhookml/skyhookml/exec_ops/render"
 	_ "github.com/skyhookml/skyhookml/exec_ops/resample"
 	_ "github.com/skyhookml/skyhookml/exec_ops/sample"
+	_ "github.com/skyhookml/skyhookml/exec_ops/segmentation_eval"
 	_ "github.com/skyhookml/skyhookml/exec_ops/segmentation_mask"
 	_ "github.com/skyhookml/skyhookml/exec_ops/simple_tracker"
 	_ "github.com/skyhookml/skyhookml/exec_ops/spatialflow_partition"
+	_ "github.com/skyhookml/skyhookml/exec_ops/split"
+	_ "github.com/skyhookml/skyhookml/exec_ops/track_counting"
+	_ "github.com/skyhookml/skyhookml/exec_ops/track_postprocess"
+	_ "github.com/skyhookml/skyhookml/exec_ops/tracking_eval"
 	_ "github.com/skyhookml/skyhookml/exec_ops/union"
 	_ "github.com/skyhookml/skyhookml/exec_ops/unsupervised_reid"
 	_ "github.com/skyhookml/skyhookml/exec_ops/video_sample"
@@ -4,9 +4,11 @@ import math
 import numpy
 import os
 import os.path
+import requests
 import skimage.io
 import struct
 import sys
+import urllib.parse
 
 import skyhook.ffmpeg as ffmpeg
 import skyhook.io
@@ -98,16 +100,53 @@ def data_len(t, data):
 		return len(data['Ints'])
 	return len(data)
 
-# Load data from disk.
+# Returns the filename of the encoded item if it is stored in a local file, or
+# None otherwise (e.g. if it is stored in s3 or packed in a shard).
+def get_item_fname(dataset, item):
+	provider = item.get('Provider')
+	if not provider:
+		return 'data/items/{}/{}.{}'.format(dataset['ID'], item['Key'], item['Ext'])
+	elif provider == 'reference':
+		return item['ProviderInfo']
+	return None
+
+# Returns the filename of the encoded item, or, if it is not in a local file, the
+# URL where the coordinator at url serves it. So items in remote storage can be
+# read without the worker having access to the storage.
+def get_item_path(dataset, item, url=None):
+	fname = get_item_fname(dataset, item)
+	if fname:
+		return fname
+	if not url:
+		raise Exception('item {} is not in a local file, and no coordinator URL was given'.format(item['Key']))
+	return '{}/datasets/{}/items/{}/get?format={}'.format(url, dataset['ID'], urllib.parse.quote(item['Key']), urllib.parse.quote(item['Format']))
+
+# Returns the item with the specified key in a dataset, from the coordinator at url.
+def get_item(url, dataset_id, key):
+	resp = requests.get('{}/datasets/{}/items/{}'.format(url, dataset_id, urllib.parse.quote(key)))
+	resp.raise_for_status()
+	return resp.json()
+
+# Returns the encoded item as bytes.
+def read_item(dataset, item, url=None):
+	path = get_item_path(dataset, item, url)
+	if get_item_fname(dataset, item):
+		with open(path, 'rb') as f:
+			return f.read()
+	resp = requests.get(path)
+	resp.raise_for_status()
+	return resp.content
+
+# Load data from disk, or through the coordinator at url (see get_item_path).
 # The output corresponds to what we would get from input_datas.
 # It can be passed to data_index, data_concat, data_len, etc.
-def load_item(dataset, item):
-	fname = 'data/items/{}/{}.{}'.format(dataset['ID'], item['Key'], item['Ext'])
+def load_item(dataset, item, url=None):
 	t = dataset['DataType']
 	metadata, format = item['Metadata'], item['Format']
 
 	if t == 'image':
-		im = skimage.io.imread(fname)
+		# skimage can read from a URL too
+		im = skimage.io.imread(get_item_path(dataset, item, url))
 		return [im]
 	elif t == 'video':
 		raise Exception('load_item cannot handle video data')
@@ -115,10 +154,10 @@ def load_item(dataset, item):
 		metadata = json.loads(metadata)
 		dt = numpy.dtype(metadata['Type'])
 		dt = dt.newbyteorder('>')
-		return numpy.fromfile(fname, dtype=dt).reshape(-1, metadata['Height'], metadata['Width'], metadata['Channels'])
+		buf = bytearray(read_item(dataset, item, url))
+		return numpy.frombuffer(buf, dtype=dt).reshape(-1, metadata['Height'], metadata['Width'], metadata['Channels'])
 	else:
-		with open(fname, 'r') as f:
-			data = json.load(f)
+		data = json.loads(read_item(dataset, item, url))
 
 		# transform to stream JSON format if needed
 		if t == 'shape':
@@ -141,10 +180,10 @@ def load_item(dataset, item):
 
 		return data
 
-def load_video(dataset, item):
-	fname = 'data/items/{}/{}.{}'.format(dataset['ID'], item['Key'], item['Ext'])
+# Videos that are not in a local file are streamed by ffmpeg from the coordinator.
+def load_video(dataset, item, url=None):
 	metadata = json.loads(item['Metadata'])
-	return ffmpeg.Ffmpeg(fname, metadata['Dims'], metadata['Framerate'])
+	return ffmpeg.Ffmpeg(get_item_path(dataset, item, url), metadata['Dims'], metadata['Framerate'])
 
 def per_frame_decorate(f):
 	def wrap(*args):
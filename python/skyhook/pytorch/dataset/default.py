@@ -13,10 +13,12 @@ class Dataset(torch.utils.data.Dataset):
 	- Batches are Python lists wrapping collated data at each index in the tuple.
 	'''
 
-	def __init__(self, datasets, keys, items):
+	def __init__(self, datasets, keys, items, url=None):
 		self.datasets = datasets
 		self.keys = keys
 		self.items = items
+		# coordinator URL, to read items that are not in local files
+		self.url = url
 
 		# data augmentation steps
 		self.augments = []
@@ -34,7 +36,7 @@ class Dataset(torch.utils.data.Dataset):
 		inputs = []
 		for dataset in self.datasets:
 			item = items[dataset['ID']]
-			data = util.read_input(dataset, item)
+			data = util.read_input(dataset, item, self.url)
 			data = util.prepare_input(dataset['DataType'], data, dataset['Options'])
 			inputs.append(data)
 
@@ -108,7 +110,7 @@ def get_datasets(url, datasets, params):
 	val_keys = keys[0:num_val]
 	train_keys = keys[num_val:]
 
-	train_set = Dataset(dataset_list, train_keys, items)
-	val_set = Dataset(dataset_list, val_keys, items)
+	train_set = Dataset(dataset_list, train_keys, items, url)
+	val_set = Dataset(dataset_list, val_keys, items, url)
 
 	return train_set, val_set
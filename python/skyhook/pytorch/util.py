@@ -7,8 +7,9 @@ import skyhook.common as lib
 
 # Read one input item.
 # Currently we assume the input must be a single element of a sequence type.
-def read_input(dataset, item):
-	data = lib.load_item(dataset, item)
+# url is the coordinator URL, used to read items that are not in local files.
+def read_input(dataset, item, url=None):
+	data = lib.load_item(dataset, item, url)
 	data = lib.data_index(dataset['DataType'], data, 0)
 	return data
 
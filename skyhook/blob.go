@@ -0,0 +1,341 @@
+package skyhook
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+// Optional content-addressed store for item files.
+//
+// If enabled, each file written through DefaultItemProvider.UpdateData,
+// CopyTo, or CopyOrSymlink (without symlink) is stored once in BlobDir under
+// its SHA-256 hash, and the item file is a hard link to the blob. So the
+// item filenames do not change, but byte-identical items across datasets
+// share the same storage.
+//
+// The link count of a blob is its reference count: a blob with only one link
+// is not referenced by any item, and is removed when an item or dataset that
+// referenced it is removed. Since items and blobs are hard links to the same
+// file, removing a blob never loses data that is still referenced.
+//
+// Blobs are also indexed by inode number in blobInodeDir, so that the blob an
+// item file is linked to can be found with a stat instead of hashing the file.
+//
+// Dedup is enabled by setting SKYHOOK_DEDUP=1. Workers pass it on to
+// containers since they write items directly.
+
+const DedupEnvVar = "SKYHOOK_DEDUP"
+
+var Dedup bool = os.Getenv(DedupEnvVar) == "1"
+
+const BlobDir = "data/blobs"
+
+func BlobFname(hash string) string {
+	return filepath.Join(BlobDir, hash[0:2], hash)
+}
+
+// Each entry is a symlink from the inode number of a blob to its hash.
+var blobInodeDir = filepath.Join(BlobDir, "inodes")
+
+func blobInodeFname(ino uint64) string {
+	return filepath.Join(blobInodeDir, strconv.FormatUint(ino, 10))
+}
+
+// Add the blob to the inode index if it is not there yet.
+func indexBlob(blobFname string, hash string) error {
+	fi, err := os.Stat(blobFname)
+	if err != nil {
+		return err
+	}
+	_, id := fileLinks(fi)
+	inodeFname := blobInodeFname(id[1])
+	if cur, err := os.Readlink(inodeFname); err == nil && cur == hash {
+		return nil
+	}
+	if err := os.MkdirAll(blobInodeDir, 0755); err != nil {
+		return err
+	}
+	// the entry may be left over from a removed blob that had the same inode
+	os.Remove(inodeFname)
+	if err := os.Symlink(hash, inodeFname); err != nil && !os.IsExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Returns the number of links to the file and an identifier of the underlying file.
+func fileLinks(fi os.FileInfo) (uint64, [2]uint64) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 1, [2]uint64{}
+	}
+	return uint64(st.Nlink), [2]uint64{uint64(st.Dev), uint64(st.Ino)}
+}
+
+func hashFile(fname string) (string, error) {
+	file, err := os.Open(fname)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Returns the blob that fname is linked to, or "" if it is not a blob.
+func getBlob(fname string) string {
+	fi, err := os.Stat(fname)
+	if err != nil || !fi.Mode().IsRegular() {
+		return ""
+	}
+	nlink, id := fileLinks(fi)
+	if nlink <= 1 {
+		return ""
+	}
+	hash, err := os.Readlink(blobInodeFname(id[1]))
+	if os.IsNotExist(err) {
+		// the blob may have been written before the inode index existed
+		hash, err = hashFile(fname)
+	}
+	if err != nil || len(hash) < 2 {
+		return ""
+	}
+	blobFname := BlobFname(hash)
+	blobFi, err := os.Stat(blobFname)
+	if err != nil || !os.SameFile(fi, blobFi) {
+		return ""
+	}
+	return blobFname
+}
+
+// Remove the blob if it is no longer referenced by any item.
+func releaseBlob(blobFname string) {
+	fi, err := os.Stat(blobFname)
+	if err != nil {
+		return
+	}
+	nlink, id := fileLinks(fi)
+	if nlink > 1 {
+		return
+	}
+	if err := os.Remove(blobFname); err != nil && !os.IsNotExist(err) {
+		log.Printf("[blob] error removing %s: %v", blobFname, err)
+		return
+	}
+	inodeFname := blobInodeFname(id[1])
+	if hash, err := os.Readlink(inodeFname); err == nil && hash == filepath.Base(blobFname) {
+		os.Remove(inodeFname)
+	}
+}
+
+// Remove an item file, and the blob that it is linked to if the blob is no
+// longer referenced.
+func RemoveItemFile(fname string) error {
+	blobFname := getBlob(fname)
+	if err := os.Remove(fname); err != nil {
+		return err
+	}
+	if blobFname != "" {
+		releaseBlob(blobFname)
+	}
+	return nil
+}
+
+// Write an item file with the contents produced by f.
+// If dedup is enabled, the contents are stored in the blob store and fname is
+// linked to the blob.
+// In either case, if fname already exists, it is replaced rather than
+// overwritten, so that other items sharing its blob are unaffected.
+func WriteItemFile(fname string, f func(w io.Writer) error) error {
+	if _, err := os.Lstat(fname); err == nil {
+		if err := RemoveItemFile(fname); err != nil {
+			return err
+		}
+	}
+
+	if !Dedup {
+		file, err := os.Create(fname)
+		if err != nil {
+			return err
+		}
+		if err := f(file); err != nil {
+			file.Close()
+			return err
+		}
+		return file.Close()
+	}
+
+	// write to a temporary file in the blob store while computing the hash
+	tmpDir := filepath.Join(BlobDir, "tmp")
+	if err := os.MkdirAll(tmpDir, 0755); err != nil {
+		return err
+	}
+	file, err := ioutil.TempFile(tmpDir, "")
+	if err != nil {
+		return err
+	}
+	tmpFname := file.Name()
+	defer os.Remove(tmpFname)
+	h := sha256.New()
+	if err := f(io.MultiWriter(file, h)); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	hash := hex.EncodeToString(h.Sum(nil))
+	blobFname := BlobFname(hash)
+	if err := os.MkdirAll(filepath.Dir(blobFname), 0755); err != nil {
+		return err
+	}
+
+	// add the blob if it doesn't exist yet, and then link the item to it
+	// if the blob is concurrently removed, we just store the item without dedup
+	if err := os.Link(tmpFname, blobFname); err != nil && !os.IsExist(err) {
+		return err
+	}
+	if err := indexBlob(blobFname, hash); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Link(blobFname, fname); err == nil {
+		return nil
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	return os.Rename(tmpFname, fname)
+}
+
+// Copy srcFname to the item file at dstFname, linking to the blob if dedup is enabled.
+func CopyItemFile(srcFname string, dstFname string) error {
+	src, err := os.Open(srcFname)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	return WriteItemFile(dstFname, func(w io.Writer) error {
+		_, err := io.Copy(w, src)
+		return err
+	})
+}
+
+// Remove a dataset directory, along with blobs that are no longer referenced.
+func removeItemDir(dirname string) {
+	// find the blobs that files are linked to before removing them
+	blobs := make(map[string]bool)
+	filepath.Walk(dirname, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || !fi.Mode().IsRegular() {
+			return nil
+		}
+		if nlink, _ := fileLinks(fi); nlink <= 1 {
+			return nil
+		}
+		if blobFname := getBlob(path); blobFname != "" {
+			blobs[blobFname] = true
+		}
+		return nil
+	})
+	os.RemoveAll(dirname)
+	for blobFname := range blobs {
+		releaseBlob(blobFname)
+	}
+}
+
+func walkBlobs(f func(path string, fi os.FileInfo)) {
+	tmpDir := filepath.Join(BlobDir, "tmp")
+	filepath.Walk(BlobDir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if fi.IsDir() && (path == tmpDir || path == blobInodeDir) {
+			return filepath.SkipDir
+		}
+		if fi.Mode().IsRegular() {
+			f(path, fi)
+		}
+		return nil
+	})
+}
+
+type StorageStats struct {
+	Dedup bool
+	// Total size of item files, counting shared files once per item.
+	LogicalBytes int64
+	// Total size of distinct files in the item and blob directories.
+	PhysicalBytes int64
+	Items int
+	// Items that are linked to a blob.
+	SharedItems int
+	Blobs int
+	BlobBytes int64
+	// Blobs that are not referenced by any item.
+	OrphanBlobs int
+}
+
+func GetStorageStats() StorageStats {
+	stats := StorageStats{Dedup: Dedup}
+	seen := make(map[[2]uint64]bool)
+	addPhysical := func(fi os.FileInfo) {
+		_, id := fileLinks(fi)
+		if seen[id] {
+			return
+		}
+		seen[id] = true
+		stats.PhysicalBytes += fi.Size()
+	}
+
+	walkBlobs(func(path string, fi os.FileInfo) {
+		stats.Blobs++
+		stats.BlobBytes += fi.Size()
+		if nlink, _ := fileLinks(fi); nlink <= 1 {
+			stats.OrphanBlobs++
+		}
+		addPhysical(fi)
+	})
+	blobIDs := make(map[[2]uint64]bool)
+	for id := range seen {
+		blobIDs[id] = true
+	}
+
+	filepath.Walk("data/items", func(path string, fi os.FileInfo, err error) error {
+		if err != nil || !fi.Mode().IsRegular() || filepath.Base(path) == "db.sqlite3" {
+			return nil
+		}
+		stats.Items++
+		stats.LogicalBytes += fi.Size()
+		if _, id := fileLinks(fi); blobIDs[id] {
+			stats.SharedItems++
+		}
+		addPhysical(fi)
+		return nil
+	})
+	return stats
+}
+
+// Returns the total size of files in the dataset directory, and the size of
+// those that are not shared with other datasets or the blob store, i.e. the
+// space that removing the dataset would free.
+func (ds Dataset) DiskUsage() (int64, int64) {
+	var total, unshared int64
+	filepath.Walk(ds.Dirname(), func(path string, fi os.FileInfo, err error) error {
+		if err != nil || !fi.Mode().IsRegular() {
+			return nil
+		}
+		total += fi.Size()
+		if nlink, _ := fileLinks(fi); nlink <= 1 {
+			unshared += fi.Size()
+		}
+		return nil
+	})
+	return total, unshared
+}
@@ -30,6 +30,36 @@ func (d Detection) CenterDistance(other Detection) float64 {
 	return math.Sqrt(float64(dx*dx+dy*dy))
 }
 
+func (d Detection) Area() int {
+	if d.Right <= d.Left || d.Bottom <= d.Top {
+		return 0
+	}
+	return (d.Right-d.Left)*(d.Bottom-d.Top)
+}
+
+// Returns intersection-over-union of the two boxes.
+func (d Detection) IOU(other Detection) float64 {
+	intersection := d
+	if other.Left > intersection.Left {
+		intersection.Left = other.Left
+	}
+	if other.Top > intersection.Top {
+		intersection.Top = other.Top
+	}
+	if other.Right < intersection.Right {
+		intersection.Right = other.Right
+	}
+	if other.Bottom < intersection.Bottom {
+		intersection.Bottom = other.Bottom
+	}
+	intersectArea := intersection.Area()
+	union := d.Area() + other.Area() - intersectArea
+	if union == 0 {
+		return 0
+	}
+	return float64(intersectArea)/float64(union)
+}
+
 func (d Detection) Rescale(origDims [2]int, newDims [2]int) Detection {
 	copy := d
 	copy.Left = copy.Left * newDims[0] / origDims[0]
@@ -6,7 +6,9 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/http"
 	"os"
+	"strings"
 )
 
 type VideoMetadata struct {
@@ -36,6 +38,19 @@ func (d VideoData) writeBytes(w io.Writer) error {
 		if _, err := w.Write(d.Bytes); err != nil {
 			return err
 		}
+	} else if strings.HasPrefix(d.Fname, "http://") || strings.HasPrefix(d.Fname, "https://") {
+		// e.g. presigned URL of an item in object storage
+		resp, err := http.Get(d.Fname)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != 200 {
+			return fmt.Errorf("error fetching video: %s", resp.Status)
+		}
+		if _, err := io.Copy(w, resp.Body); err != nil {
+			return err
+		}
 	} else {
 		file, err := os.Open(d.Fname)
 		if err != nil {
@@ -3,6 +3,8 @@ package skyhook
 import (
 	"crypto/sha256"
 	"fmt"
+	"io"
+	"log"
 	"os"
 )
 
@@ -68,15 +70,82 @@ func (item Item) LoadData() (Data, error) {
 }
 
 func (ds Dataset) Remove() {
-	os.RemoveAll(fmt.Sprintf("data/items/%d", ds.ID))
+	removeItemDir(ds.Dirname())
 }
 
 func (item Item) Remove() {
+	if provider := item.GetProvider(); provider.Remove != nil {
+		if err := provider.Remove(item); err != nil {
+			log.Printf("[item %s] error removing item: %v", item.Key, err)
+		}
+		return
+	}
 	fname := item.Fname()
 	if fname == "" {
 		panic(fmt.Errorf("Remove not supported in dataset %s", item.Dataset.Name))
 	}
-	os.Remove(fname)
+	RemoveItemFile(fname)
+}
+
+// Write the encoded item with the contents produced by f.
+// Unlike writing to Fname, this also works for items in remote storage.
+func (item Item) Write(f func(w io.Writer) error) error {
+	write := item.GetProvider().Write
+	if write == nil {
+		return fmt.Errorf("writing items is not supported in dataset %s", item.Dataset.Name)
+	}
+	return write(item, f)
+}
+
+// Copy the file at srcFname into the item.
+// If symlink is true, we try to symlink when the item is stored in a local file.
+func (item Item) CopyFrom(srcFname string, symlink bool) error {
+	if item.Provider == nil {
+		return CopyOrSymlink(srcFname, item.Fname(), symlink)
+	}
+	src, err := os.Open(srcFname)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	return item.Write(func(w io.Writer) error {
+		_, err := io.Copy(w, src)
+		return err
+	})
+}
+
+// Returns a function that writes the item encoded in the specified format.
+func (item Item) encodeTo(format string) func(w io.Writer) error {
+	return func(w io.Writer) error {
+		if format == item.Format {
+			// if the item is available in the right format, just copy it
+			if srcFname := item.Fname(); srcFname != "" {
+				src, err := os.Open(srcFname)
+				if err != nil {
+					return err
+				}
+				defer src.Close()
+				_, err = io.Copy(w, src)
+				return err
+			}
+			if open := item.GetProvider().Open; open != nil {
+				rd, err := open(item)
+				if err != nil {
+					return err
+				}
+				defer rd.Close()
+				_, err = io.Copy(w, rd)
+				return err
+			}
+		}
+
+		// otherwise, we need to load the data and re-encode it
+		data, err := item.LoadData()
+		if err != nil {
+			return err
+		}
+		return data.Encode(format, w)
+	}
 }
 
 // Copy the data to the specified filename with specified output format.
@@ -87,19 +156,17 @@ func (item Item) CopyTo(fname string, format string, symlink bool) error {
 	if srcFname != "" && format == item.Format {
 		return CopyOrSymlink(srcFname, fname, symlink)
 	}
+	return WriteItemFile(fname, item.encodeTo(format))
+}
 
-	// so either the file is not directly available, or the format doesn't match
-	// either way, we need to load the data and re-encode it
-	data, err := item.LoadData()
-	if err != nil {
-		return err
-	}
-	file, err := os.Create(fname)
-	if err != nil {
-		return err
+// Copy the data into dst with specified output format.
+// dst may be stored in any provider that supports Write, e.g. if its dataset
+// is stored in S3, while symlink only applies to items in local files.
+func (item Item) CopyToItem(dst Item, format string, symlink bool) error {
+	if dst.Provider == nil {
+		return item.CopyTo(dst.Fname(), format, symlink)
 	}
-	defer file.Close()
-	return data.Encode(format, file)
+	return dst.Write(item.encodeTo(format))
 }
 
 func (ds Dataset) DBFname() string {
@@ -119,6 +186,13 @@ type ItemProvider struct {
 	// optional: we return empty string if Fname is called without being supported
 	// caller then needs to fallback to loading the data
 	Fname func(item Item) string
+	// optional: returns a reader over the encoded item, for providers that do
+	// not store items in local files
+	Open func(item Item) (io.ReadCloser, error)
+	// optional: if set, called by Item.Remove instead of removing Fname
+	Remove func(item Item) error
+	// optional: writes the encoded item with the contents produced by f
+	Write func(item Item, f func(w io.Writer) error) error
 }
 
 var ItemProviders = make(map[string]ItemProvider)
@@ -163,14 +237,13 @@ func init() {
 		},
 		UpdateData: func(item Item, data Data) error {
 			item.Dataset.Mkdir()
-			file, err := os.Create(item.Fname())
-			if err != nil {
-				return err
-			}
-			if err := data.Encode(item.Format, file); err != nil {
-				return err
-			}
-			return nil
+			return WriteItemFile(item.Fname(), func(w io.Writer) error {
+				return data.Encode(item.Format, w)
+			})
+		},
+		Write: func(item Item, f func(w io.Writer) error) error {
+			item.Dataset.Mkdir()
+			return WriteItemFile(item.Fname(), f)
 		},
 		Fname: func(item Item) string {
 			return fmt.Sprintf("data/items/%d/%s.%s", item.Dataset.ID, item.Key, item.Ext)
@@ -51,6 +51,7 @@ type ExecOpProvider interface {
 	// Returns config for front-end.
 	Config() ExecOpConfig
 	// Returns resource requirements.
+	// Containers only get access to the GPUs that they declare here.
 	Requirements(node Runnable) map[string]int
 	// Returns list of tasks.
 	// items: is a map: input name -> input dataset index -> items in that dataset
@@ -74,6 +75,10 @@ type ExecOpProvider interface {
 	// Docker image name
 	GetImageName(node Runnable) (string, error)
 
+	// Whether the op is cheap enough that the coordinator may run it in-process
+	// instead of in a container, if in-process execution is enabled.
+	IsInProcess() bool
+
 	// Optional system to provide customized state to store in ExecNode jobs.
 	// For example, when training a model, we may want to store the loss history.
 	// Can return nil to use defaults.
@@ -105,6 +110,8 @@ type ExecOpImpl struct {
 	// only one should be set (static/dynamic)
 	ImageName string
 	GetImageName func(node Runnable) (string, error)
+	// optional; set for small CPU-only ops that can run in the coordinator
+	InProcess bool
 
 	// static specification of inputs/outputs
 	// one of dynamic/static should be set
@@ -172,6 +179,9 @@ func (p ExecOpImplProvider) GetImageName(node Runnable) (string, error) {
 		return p.Impl.GetImageName(node)
 	}
 }
+func (p ExecOpImplProvider) IsInProcess() bool {
+	return p.Impl.InProcess
+}
 func (p ExecOpImplProvider) GetJobOp(node Runnable) (JobOp, string) {
 	if p.Impl.GetJobOp == nil {
 		return nil, ""
@@ -0,0 +1,319 @@
+package skyhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	urllib "net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Connection settings for an S3-compatible object store.
+// They are read from the environment so that the coordinator, workers, and
+// containers all see the same settings; see S3EnvVars.
+type S3Config struct {
+	// e.g. "http://127.0.0.1:9000" for a local MinIO server.
+	// Defaults to AWS S3 in Region. Buckets are always addressed path-style.
+	Endpoint string
+	Region string
+	AccessKey string
+	SecretKey string
+}
+
+// Environment variables that configure S3, which workers pass on to containers.
+var S3EnvVars = []string{"SKYHOOK_S3_ENDPOINT", "SKYHOOK_S3_REGION", "SKYHOOK_S3_ACCESS_KEY", "SKYHOOK_S3_SECRET_KEY"}
+
+var S3 S3Config
+
+func S3ConfigFromEnv() S3Config {
+	getenv := func(names ...string) string {
+		for _, name := range names {
+			if v := os.Getenv(name); v != "" {
+				return v
+			}
+		}
+		return ""
+	}
+	cfg := S3Config{
+		Endpoint: getenv("SKYHOOK_S3_ENDPOINT"),
+		Region: getenv("SKYHOOK_S3_REGION", "AWS_REGION"),
+		AccessKey: getenv("SKYHOOK_S3_ACCESS_KEY", "AWS_ACCESS_KEY_ID"),
+		SecretKey: getenv("SKYHOOK_S3_SECRET_KEY", "AWS_SECRET_ACCESS_KEY"),
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	if cfg.Endpoint == "" {
+		cfg.Endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", cfg.Region)
+	}
+	cfg.Endpoint = strings.TrimSuffix(cfg.Endpoint, "/")
+	return cfg
+}
+
+// Location of an object, stored as JSON in ProviderInfo of items in the s3 provider.
+type S3Location struct {
+	Bucket string
+	Key string
+	// ID of the dataset that the object was written for.
+	// Other datasets may reference the object, but only this one deletes it.
+	Owner int
+}
+
+// Escape a string as required in AWS signatures.
+func awsEscape(s string, encodeSlash bool) string {
+	var sb strings.Builder
+	for _, b := range []byte(s) {
+		if (b >= 'A' && b <= 'Z') || (b >= 'a' && b <= 'z') || (b >= '0' && b <= '9') || b == '-' || b == '_' || b == '.' || b == '~' || (b == '/' && !encodeSlash) {
+			sb.WriteByte(b)
+		} else {
+			fmt.Fprintf(&sb, "%%%02X", b)
+		}
+	}
+	return sb.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func (cfg S3Config) objectPath(loc S3Location) string {
+	return "/" + awsEscape(loc.Bucket, true) + "/" + awsEscape(loc.Key, false)
+}
+
+// Compute AWS signature version 4 of the request.
+// query must contain all query parameters of the request, and headers must
+// contain all headers that should be signed (with lowercase names).
+func (cfg S3Config) signature(method string, path string, query urllib.Values, headers map[string]string, payloadHash string, t time.Time) (string, string) {
+	date := t.Format("20060102")
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", date, cfg.Region)
+
+	var queryParts []string
+	for k, vlist := range query {
+		for _, v := range vlist {
+			queryParts = append(queryParts, awsEscape(k, true)+"="+awsEscape(v, true))
+		}
+	}
+	sort.Strings(queryParts)
+
+	var headerNames []string
+	for name := range headers {
+		headerNames = append(headerNames, name)
+	}
+	sort.Strings(headerNames)
+	var canonicalHeaders string
+	for _, name := range headerNames {
+		canonicalHeaders += name + ":" + strings.TrimSpace(headers[name]) + "\n"
+	}
+	signedHeaders := strings.Join(headerNames, ";")
+
+	canonicalRequest := strings.Join([]string{
+		method,
+		path,
+		strings.Join(queryParts, "&"),
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		t.Format("20060102T150405Z"),
+		scope,
+		hex.EncodeToString(requestHash[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+cfg.SecretKey), date)
+	key = hmacSHA256(key, cfg.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, stringToSign)), signedHeaders
+}
+
+// Make a signed request on an object.
+// The payload is not signed, so the body can be streamed.
+// extraHeaders are additional headers to sign and send, with lowercase names.
+func (cfg S3Config) do(method string, loc S3Location, body io.Reader, size int64, extraHeaders map[string]string) (*http.Response, error) {
+	endpoint, err := urllib.Parse(cfg.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid S3 endpoint %s: %v", cfg.Endpoint, err)
+	}
+	path := cfg.objectPath(loc)
+	req, err := http.NewRequest(method, cfg.Endpoint+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+
+	t := time.Now().UTC()
+	headers := map[string]string{
+		"host": endpoint.Host,
+		"x-amz-content-sha256": "UNSIGNED-PAYLOAD",
+		"x-amz-date": t.Format("20060102T150405Z"),
+	}
+	for name, value := range extraHeaders {
+		headers[name] = value
+	}
+	signature, signedHeaders := cfg.signature(method, path, nil, headers, "UNSIGNED-PAYLOAD", t)
+	for name, value := range headers {
+		if name != "host" {
+			req.Header.Set(name, value)
+		}
+	}
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s/%s/s3/aws4_request, SignedHeaders=%s, Signature=%s",
+		cfg.AccessKey, t.Format("20060102"), cfg.Region, signedHeaders, signature,
+	))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		bytes, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		resp.Body.Close()
+		return nil, fmt.Errorf("S3 %s %s/%s failed: %v", method, loc.Bucket, loc.Key, HttpError{resp.StatusCode, string(bytes)})
+	}
+	return resp, nil
+}
+
+func (cfg S3Config) PutObject(loc S3Location, r io.Reader, size int64) error {
+	resp, err := cfg.do("PUT", loc, r, size, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Upload an object with the contents produced by f.
+// The contents are staged in a temporary file first since we need the size.
+func (cfg S3Config) PutObjectFunc(loc S3Location, f func(w io.Writer) error) error {
+	file, err := ioutil.TempFile("", "skyhook-s3-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+	if err := f(file); err != nil {
+		return err
+	}
+	size, err := file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return cfg.PutObject(loc, file, size)
+}
+
+// Returns a reader over the object. The caller must close it.
+func (cfg S3Config) GetObject(loc S3Location) (io.ReadCloser, error) {
+	resp, err := cfg.do("GET", loc, nil, 0, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (cfg S3Config) DeleteObject(loc S3Location) error {
+	resp, err := cfg.do("DELETE", loc, nil, 0, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Copy an object within the object store, without downloading it.
+func (cfg S3Config) CopyObject(src S3Location, dst S3Location) error {
+	resp, err := cfg.do("PUT", dst, nil, 0, map[string]string{
+		"x-amz-copy-source": cfg.objectPath(src),
+	})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Returns a URL that can be used to GET the object without credentials until
+// it expires. This lets e.g. ffmpeg stream a video directly from the bucket.
+func (cfg S3Config) PresignGet(loc S3Location, expires time.Duration) string {
+	endpoint, _ := urllib.Parse(cfg.Endpoint)
+	path := cfg.objectPath(loc)
+	t := time.Now().UTC()
+	query := urllib.Values{
+		"X-Amz-Algorithm": {"AWS4-HMAC-SHA256"},
+		"X-Amz-Credential": {fmt.Sprintf("%s/%s/%s/s3/aws4_request", cfg.AccessKey, t.Format("20060102"), cfg.Region)},
+		"X-Amz-Date": {t.Format("20060102T150405Z")},
+		"X-Amz-Expires": {fmt.Sprintf("%d", int(expires.Seconds()))},
+		"X-Amz-SignedHeaders": {"host"},
+	}
+	signature, _ := cfg.signature("GET", path, query, map[string]string{"host": endpoint.Host}, "UNSIGNED-PAYLOAD", t)
+	query.Set("X-Amz-Signature", signature)
+	var parts []string
+	for k, vlist := range query {
+		parts = append(parts, awsEscape(k, true)+"="+awsEscape(vlist[0], true))
+	}
+	sort.Strings(parts)
+	return cfg.Endpoint + path + "?" + strings.Join(parts, "&")
+}
+
+func getS3Location(item Item) S3Location {
+	var loc S3Location
+	JsonUnmarshal([]byte(*item.ProviderInfo), &loc)
+	return loc
+}
+
+func init() {
+	S3 = S3ConfigFromEnv()
+
+	// Items stored in an S3-compatible bucket.
+	// ProviderInfo is the JSON-encoded S3Location.
+	ItemProviders["s3"] = ItemProvider{
+		LoadData: func(item Item) (Data, error) {
+			loc := getS3Location(item)
+			// ffmpeg can stream videos from a presigned URL, so we don't need to
+			// download the entire video
+			if item.Dataset.DataType == VideoType {
+				return DecodeFile(item.Dataset.DataType, item.Format, item.Metadata, S3.PresignGet(loc, 24*time.Hour))
+			}
+			rd, err := S3.GetObject(loc)
+			if err != nil {
+				return nil, fmt.Errorf("error reading item %s: %v", item.Key, err)
+			}
+			defer rd.Close()
+			return DecodeData(item.Dataset.DataType, item.Format, item.Metadata, rd)
+		},
+		UpdateData: func(item Item, data Data) error {
+			return S3.PutObjectFunc(getS3Location(item), func(w io.Writer) error {
+				return data.Encode(item.Format, w)
+			})
+		},
+		Write: func(item Item, f func(w io.Writer) error) error {
+			return S3.PutObjectFunc(getS3Location(item), f)
+		},
+		Open: func(item Item) (io.ReadCloser, error) {
+			return S3.GetObject(getS3Location(item))
+		},
+		Remove: func(item Item) error {
+			loc := getS3Location(item)
+			if loc.Owner != item.Dataset.ID {
+				return nil
+			}
+			return S3.DeleteObject(loc)
+		},
+	}
+}
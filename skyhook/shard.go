@@ -0,0 +1,175 @@
+package skyhook
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Shard files pack many small items into a few large files, which are faster
+// to copy, export, and list than one file per item.
+// Each shard is an append-only tar archive in the dataset directory, named
+// like shard-000000.tar, and the offset of each item in its shard is stored
+// in the item's ProviderInfo (so in the items table of the dataset db).
+
+// Location of an item in a shard, stored as JSON in ProviderInfo of items in the shard provider.
+type ShardLocation struct {
+	// ID of the dataset whose directory contains the shard.
+	// This may differ from the item's dataset if the item is a reference.
+	Dataset int
+	Shard string
+	// Offset and length of the item's data in the shard.
+	Offset int64
+	Length int64
+}
+
+func (loc ShardLocation) Fname() string {
+	return filepath.Join(Dataset{ID: loc.Dataset}.Dirname(), loc.Shard)
+}
+
+func ShardName(idx int) string {
+	return fmt.Sprintf("shard-%06d.tar", idx)
+}
+
+// Returns the shard files in the dataset directory.
+func (ds Dataset) ListShards() ([]string, error) {
+	fnames, err := filepath.Glob(filepath.Join(ds.Dirname(), "shard-*.tar"))
+	if err != nil {
+		return nil, err
+	}
+	var shards []string
+	for _, fname := range fnames {
+		shards = append(shards, filepath.Base(fname))
+	}
+	return shards, nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+// Writes items into a new shard.
+type ShardWriter struct {
+	Dataset Dataset
+	Name string
+	file *os.File
+	counter *countingWriter
+	tw *tar.Writer
+}
+
+func CreateShard(ds Dataset, name string) (*ShardWriter, error) {
+	ds.Mkdir()
+	file, err := os.OpenFile(filepath.Join(ds.Dirname(), name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, err
+	}
+	counter := &countingWriter{w: file}
+	return &ShardWriter{
+		Dataset: ds,
+		Name: name,
+		file: file,
+		counter: counter,
+		tw: tar.NewWriter(counter),
+	}, nil
+}
+
+// Append size bytes from r to the shard as a file with the given name.
+func (w *ShardWriter) Add(name string, r io.Reader, size int64) (ShardLocation, error) {
+	err := w.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name: name,
+		Size: size,
+		Mode: 0644,
+		ModTime: time.Now(),
+	})
+	if err != nil {
+		return ShardLocation{}, err
+	}
+	// the tar writer writes the header directly, so the data starts here
+	loc := ShardLocation{
+		Dataset: w.Dataset.ID,
+		Shard: w.Name,
+		Offset: w.counter.n,
+		Length: size,
+	}
+	if _, err := io.Copy(w.tw, r); err != nil {
+		return ShardLocation{}, err
+	}
+	return loc, nil
+}
+
+// Returns the number of bytes written to the shard so far.
+func (w *ShardWriter) Size() int64 {
+	return w.counter.n
+}
+
+func (w *ShardWriter) Close() error {
+	if err := w.tw.Close(); err != nil {
+		w.file.Close()
+		return err
+	}
+	if err := w.file.Sync(); err != nil {
+		w.file.Close()
+		return err
+	}
+	return w.file.Close()
+}
+
+type shardReader struct {
+	*io.SectionReader
+	file *os.File
+}
+
+func (rd shardReader) Close() error {
+	return rd.file.Close()
+}
+
+func OpenShardItem(loc ShardLocation) (io.ReadCloser, error) {
+	file, err := os.Open(loc.Fname())
+	if err != nil {
+		return nil, err
+	}
+	return shardReader{io.NewSectionReader(file, loc.Offset, loc.Length), file}, nil
+}
+
+func getShardLocation(item Item) ShardLocation {
+	var loc ShardLocation
+	JsonUnmarshal([]byte(*item.ProviderInfo), &loc)
+	return loc
+}
+
+func init() {
+	// Items packed in a shard file; ProviderInfo is the JSON-encoded ShardLocation.
+	// Shards are append-only, so items cannot be updated in place (the app
+	// moves updated items out into local files), and removing an item only
+	// removes it from the index. Shards are removed with the dataset.
+	ItemProviders["shard"] = ItemProvider{
+		LoadData: func(item Item) (Data, error) {
+			rd, err := OpenShardItem(getShardLocation(item))
+			if err != nil {
+				return nil, fmt.Errorf("error reading item %s: %v", item.Key, err)
+			}
+			defer rd.Close()
+			return DecodeData(item.Dataset.DataType, item.Format, item.Metadata, rd)
+		},
+		Open: func(item Item) (io.ReadCloser, error) {
+			return OpenShardItem(getShardLocation(item))
+		},
+		UpdateData: func(item Item, data Data) error {
+			return fmt.Errorf("item %s is packed in a shard and cannot be updated", item.Key)
+		},
+		Remove: func(item Item) error {
+			return nil
+		},
+	}
+}
@@ -78,12 +78,26 @@ func ParseJsonRequest(w http.ResponseWriter, r *http.Request, x interface{}) err
 	return nil
 }
 
+// Error returned by ParseJsonResponse when the server responds with a status
+// code indicating failure.
+type HttpError struct {
+	StatusCode int
+	Message string
+}
+
+func (e HttpError) Error() string {
+	return fmt.Sprintf("HTTP error %d: %s", e.StatusCode, e.Message)
+}
+
 func ParseJsonResponse(resp *http.Response, response interface{}) error {
 	bytes, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		return fmt.Errorf("error performing HTTP request: %v", err)
 	} else if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return fmt.Errorf("HTTP error %d: %s", resp.StatusCode, string(bytes))
+		return HttpError{
+			StatusCode: resp.StatusCode,
+			Message: string(bytes),
+		}
 	}
 	if response != nil {
 		JsonUnmarshal(bytes, response)
@@ -98,7 +112,7 @@ func JsonGet(baseURL string, path string, response interface{}) error {
 	}
 	err = ParseJsonResponse(resp, response)
 	if err != nil {
-		return fmt.Errorf("[GET %s] %v", baseURL+path, err)
+		return fmt.Errorf("[GET %s] %w", baseURL+path, err)
 	}
 	return nil
 }
@@ -114,7 +128,7 @@ func JsonPost(baseURL string, path string, request interface{}, response interfa
 	}
 	err = ParseJsonResponse(resp, response)
 	if err != nil {
-		return fmt.Errorf("[POST %s] %v", baseURL+path, err)
+		return fmt.Errorf("[POST %s] %w", baseURL+path, err)
 	}
 	return nil
 }
@@ -126,7 +140,7 @@ func JsonPostForm(baseURL string, path string, request urllib.Values, response i
 	}
 	err = ParseJsonResponse(resp, response)
 	if err != nil {
-		return fmt.Errorf("[POST %s] %v", baseURL+path, err)
+		return fmt.Errorf("[POST %s] %w", baseURL+path, err)
 	}
 	return nil
 }
@@ -352,7 +366,7 @@ func CopyOrSymlink(srcFname string, dstFname string, symlink bool) error {
 		}
 		return os.Symlink(srcFname, dstFname)
 	} else {
-		return CopyFile(srcFname, dstFname)
+		return CopyItemFile(srcFname, dstFname)
 	}
 }
 
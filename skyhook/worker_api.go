@@ -1,5 +1,35 @@
 package skyhook
 
+import (
+	"time"
+)
+
+// Resources that may be specified in ExecOpProvider.Requirements and in
+// WorkerCapacity.
+const (
+	// Number of CPU cores.
+	ResourceCPU string = "cpu"
+	// Memory in megabytes.
+	ResourceMemory string = "memory"
+	// Number of GPU devices.
+	ResourceGPU string = "gpu"
+)
+
+// Returns the resources that a container with the specified requirements
+// should be allocated.
+// Every container gets at least one CPU core, even if the op doesn't declare
+// any requirements.
+func NormalizeRequirements(requirements map[string]int) map[string]int {
+	normalized := make(map[string]int)
+	for name, amount := range requirements {
+		normalized[name] = amount
+	}
+	if normalized[ResourceCPU] < 1 {
+		normalized[ResourceCPU] = 1
+	}
+	return normalized
+}
+
 // coordinator->worker
 // request creation of a new container
 type ContainerRequest struct {
@@ -7,7 +37,20 @@ type ContainerRequest struct {
 	JobID *int
 	CoordinatorURL string
 	InstanceID string
+	// Resources needed by the container, from ExecOpProvider.Requirements.
+	Requirements map[string]int
+	// Requests with higher priority are allocated first, e.g. PriorityInteractive.
+	Priority int
 }
+
+// Priorities for ContainerRequest.
+const (
+	// Long-running jobs that nobody is waiting on, e.g. overnight training.
+	PriorityBatch int = -10
+	PriorityNormal int = 0
+	// Jobs that a user is actively waiting for.
+	PriorityInteractive int = 10
+)
 type ContainerResponse struct {
 	// request/container UUID
 	UUID string
@@ -53,3 +96,48 @@ type EndRequest struct {
 type ExecTaskRequest struct {
 	Task ExecTask
 }
+
+// pool->worker
+// resources that a worker can provide to its containers
+type WorkerCapacity struct {
+	// Maps from resource name (e.g. ResourceCPU) to the total amount.
+	Resources map[string]int
+	// Maximum number of containers that the worker can run at once.
+	Containers int
+}
+
+// Returns whether a container with the specified requirements can be placed on
+// a worker with this capacity, given the resources used by other containers.
+func (c WorkerCapacity) Fits(used map[string]int, numContainers int, requirements map[string]int) bool {
+	if numContainers >= c.Containers {
+		return false
+	}
+	for name, amount := range requirements {
+		if used[name] + amount > c.Resources[name] {
+			return false
+		}
+	}
+	return true
+}
+
+// worker->pool
+// sent when a worker starts so that the pool can allocate containers on it
+type WorkerRegisterRequest struct {
+	// base URL where the pool can reach the worker
+	URL string
+	Capacity WorkerCapacity
+}
+
+// worker->pool
+// sent periodically after registering so the pool knows the worker is alive
+// the pool responds with 404 if it doesn't know the worker, in which case the
+// worker should register again
+type WorkerHeartbeatRequest struct {
+	URL string
+}
+
+// How often workers send heartbeats to the pool.
+const WorkerHeartbeatInterval = 10*time.Second
+
+// The pool considers a worker dead if it hasn't heard from it in this long.
+const WorkerHeartbeatTimeout = 3*WorkerHeartbeatInterval
@@ -8,23 +8,110 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 )
 
+// Resources reserved on a worker for one container.
+type Allocation struct {
+	// UUID of the container on the worker, empty while it is being created
+	ContainerUUID string
+	Requirements map[string]int
+	// Owner of the request that the container was allocated for.
+	Owner string
+}
+
 type Worker struct {
 	URL string
-	// UUID of currently allocated container, if any (otherwise empty)
-	// currently we only allocate one container at a time per worker
-	ContainerUUID string
-	// UUID that we returned to coordinator
-	AllocationUUID string
+	// Resources advertised by the worker, nil until we have fetched them.
+	Capacity *skyhook.WorkerCapacity
+	// Map from UUID that we returned to coordinator to the allocation.
+	// A worker may run several containers as long as their requirements fit.
+	Allocations map[string]*Allocation
+
+	// Whether the worker was listed on the command line, in which case we probe
+	// it ourselves instead of expecting it to send heartbeats.
+	Static bool
+	// Workers are marked dead if we don't hear from them for
+	// skyhook.WorkerHeartbeatTimeout. Dead workers get no new allocations.
+	Alive bool
+	LastHeartbeat time.Time
+}
+
+// Returns the total resources reserved by allocations on this worker.
+func (w *Worker) GetUsed() map[string]int {
+	used := make(map[string]int)
+	for _, allocation := range w.Allocations {
+		for name, amount := range allocation.Requirements {
+			used[name] += amount
+		}
+	}
+	return used
+}
+
+// Returns whether a container with the specified requirements fits on this
+// worker now, given its current allocations.
+func (w *Worker) Fits(requirements map[string]int) bool {
+	if w.Capacity == nil || !w.Alive {
+		return false
+	}
+	return w.Capacity.Fits(w.GetUsed(), len(w.Allocations), requirements)
+}
+
+// Returns the amount of the resource that would be left over on this worker
+// if a container with the specified requirements is placed on it.
+func (w *Worker) GetRemaining(name string, requirements map[string]int) int {
+	return w.Capacity.Resources[name] - w.GetUsed()[name] - requirements[name]
 }
 
 type Request struct {
 	skyhook.ContainerRequest
 	UUID string
+	// Normalized requirements of the container.
+	Requirements map[string]int
+	// Set once we have picked a worker and are creating the container there.
+	Allocating bool
+	// Coordinator instance that sent the request.
+	// Containers are shared fairly between owners at the same priority.
+	Owner string
+	QueuedAt time.Time
+}
+
+// Returns the owner of a request, which is the coordinator's instance ID if
+// it has one.
+func GetOwner(request skyhook.ContainerRequest) string {
+	if request.InstanceID != "" {
+		return request.InstanceID
+	}
+	return request.CoordinatorURL
+}
+
+// Response to GET /queue.
+type QueueEntry struct {
+	UUID string
+	// Position in the order that we will try to allocate requests.
+	Position int
+	Priority int
+	Owner string
+	Op string
+	NodeName string
+	JobID *int
+	Requirements map[string]int
+	QueuedAt time.Time
+}
+
+// Response to GET /workers.
+type WorkerInfo struct {
+	URL string
+	Capacity *skyhook.WorkerCapacity
+	Allocations map[string]*Allocation
+	Used map[string]int
+	Static bool
+	// "alive" or "dead"
+	State string
+	LastHeartbeat time.Time
 }
 
 // Store result of allocation after a request exits the queue.
@@ -36,18 +123,30 @@ type AllocationResult struct {
 }
 
 func main() {
-	if len(os.Args) < 3 {
-		fmt.Println("usage: ./worker_pool [port] [worker list]")
+	if len(os.Args) < 2 {
+		fmt.Println("usage: ./worker_pool [port] [optional worker list]")
 		fmt.Println("example: ./worker_pool 8081 http://1.2.3.4:8081,http://5.6.7.8:8081")
+		fmt.Println("workers can also join at runtime by registering with the pool")
 		return
 	}
 	myPort := skyhook.ParseInt(os.Args[1])
-	workerURLs := strings.Split(os.Args[2], ",")
+	var workerURLs []string
+	if len(os.Args) >= 3 && os.Args[2] != "" {
+		workerURLs = strings.Split(os.Args[2], ",")
+	}
 
 	// maintain state of the workers
-	workers := make([]*Worker, len(workerURLs))
-	for i, url := range workerURLs {
-		workers[i] = &Worker{URL: url}
+	// workers listed on the command line start out alive, and are marked dead
+	// if we can't reach them
+	var workers []*Worker
+	for _, url := range workerURLs {
+		workers = append(workers, &Worker{
+			URL: url,
+			Allocations: make(map[string]*Allocation),
+			Static: true,
+			Alive: true,
+			LastHeartbeat: time.Now(),
+		})
 	}
 	// maintain queue of container requests
 	var q []*Request
@@ -65,83 +164,271 @@ func main() {
 		}
 	}()
 
-	// process requests
-	go func() {
-		// helper function checking if there's an available worker
-		// caller must have the lock
-		getAvailableWorker := func() *Worker {
-			for _, worker := range workers {
-				if worker.ContainerUUID != "" {
-					continue
+	// probe workers listed on the command line, which don't send heartbeats
+	// the probe also fetches the capacity advertised by the worker
+	for _, worker := range workers {
+		go func(worker *Worker) {
+			for {
+				var capacity skyhook.WorkerCapacity
+				err := skyhook.JsonGet(worker.URL, "/worker/capacity", &capacity)
+				mu.Lock()
+				if err == nil {
+					if worker.Capacity == nil {
+						log.Printf("[pool] worker %s has capacity %v, up to %d containers", worker.URL, capacity.Resources, capacity.Containers)
+					}
+					if !worker.Alive {
+						log.Printf("[pool] worker %s is reachable again", worker.URL)
+					}
+					worker.Capacity = &capacity
+					worker.Alive = true
+					worker.LastHeartbeat = time.Now()
+					cond.Broadcast()
+				} else {
+					log.Printf("[pool] error probing worker %s: %v", worker.URL, err)
 				}
-				return worker
+				mu.Unlock()
+				time.Sleep(skyhook.WorkerHeartbeatInterval)
+			}
+		}(worker)
+	}
+
+	// remove a request from the queue and save its result
+	// this has no effect if the request already has a result
+	// caller must have the lock
+	finishRequest := func(req *Request, result *AllocationResult) {
+		if results[req.UUID] != nil {
+			return
+		}
+		for i := range q {
+			if q[i] != req {
+				continue
 			}
-			return nil
+			n := copy(q[i:], q[i+1:])
+			q = q[0:i+n]
+			break
 		}
+		results[req.UUID] = result
+		cond.Broadcast()
+	}
 
-		for {
-			// wait for a request
-			mu.Lock()
-			for len(q) == 0 {
-				cond.Wait()
+	// mark a worker dead and fail all of its allocations
+	// requests still waiting on the worker get the error right away, while
+	// coordinators using existing containers see it on /container/status
+	// caller must have the lock
+	markDead := func(worker *Worker) {
+		log.Printf("[pool] worker %s missed heartbeats since %v, marking it dead", worker.URL, worker.LastHeartbeat)
+		worker.Alive = false
+		err := fmt.Errorf("worker %s stopped responding (last heartbeat at %s)", worker.URL, worker.LastHeartbeat.Format(time.RFC3339))
+		for uuid := range worker.Allocations {
+			var req *Request
+			for _, r := range q {
+				if r.UUID == uuid {
+					req = r
+				}
 			}
-			req := q[0]
-			log.Printf("[queue] got request %s, waiting for a worker", req.UUID)
+			if req != nil {
+				finishRequest(req, &AllocationResult{Error: err})
+			} else {
+				results[uuid] = &AllocationResult{Error: err}
+			}
+		}
+		worker.Allocations = make(map[string]*Allocation)
+		cond.Broadcast()
+	}
 
-			// wait for a worker
-			for getAvailableWorker() == nil {
-				cond.Wait()
+	// check for workers that missed heartbeats
+	go func() {
+		for {
+			time.Sleep(skyhook.WorkerHeartbeatInterval)
+			mu.Lock()
+			for _, worker := range workers {
+				if worker.Alive && time.Now().Sub(worker.LastHeartbeat) > skyhook.WorkerHeartbeatTimeout {
+					markDead(worker)
+				}
 			}
-			worker := getAvailableWorker()
-			log.Printf("[req %s] got candidate worker at %s", req.UUID, worker.URL)
 			mu.Unlock()
+		}
+	}()
 
-			setError := func(err error) {
-				log.Printf("[req %s] error allocating on worker %s: %v", req.UUID, worker.URL, err)
-				mu.Lock()
-				n := copy(q[0:], q[1:])
-				q = q[0:n]
-				results[req.UUID] = &AllocationResult{Error: err}
-				mu.Unlock()
+	// pick the worker where a container with these requirements should be placed
+	// we prefer the worker that would have the fewest spare GPUs and then CPUs
+	// left over, so that large requests can still be placed on other workers
+	// returns nil if no worker has enough free resources right now
+	// caller must have the lock
+	pickWorker := func(requirements map[string]int) *Worker {
+		var best *Worker
+		for _, worker := range workers {
+			if !worker.Fits(requirements) {
+				continue
 			}
-
-			// forward the ContainerRequest
-			var containerResponse skyhook.ContainerResponse
-			err := skyhook.JsonPost(worker.URL, "/container/request", req.ContainerRequest, &containerResponse)
-			if err != nil {
-				setError(err)
+			if best == nil {
+				best = worker
 				continue
 			}
+			gpus := worker.GetRemaining(skyhook.ResourceGPU, requirements)
+			bestGPUs := best.GetRemaining(skyhook.ResourceGPU, requirements)
+			cpus := worker.GetRemaining(skyhook.ResourceCPU, requirements)
+			bestCPUs := best.GetRemaining(skyhook.ResourceCPU, requirements)
+			if gpus < bestGPUs || (gpus == bestGPUs && cpus < bestCPUs) {
+				best = worker
+			}
+		}
+		return best
+	}
 
-			// Call /container/request.
-			// This should always respond with a final status, i.e., either
-			// ready=true or Error is non-nil.
-			// Only pool (us) responds with pending update.
-			statusRequest := skyhook.StatusRequest{UUID: containerResponse.UUID}
-			var statusResponse skyhook.StatusResponse
-			err = skyhook.JsonPost(worker.URL, "/container/status", statusRequest, &statusResponse)
-			if err != nil {
-				setError(err)
+	// returns whether a container with these requirements could ever be placed
+	// on one of the workers whose capacity we know
+	// caller must have the lock
+	canEverFit := func(requirements map[string]int) bool {
+		known := false
+		for _, worker := range workers {
+			if worker.Capacity == nil || !worker.Alive {
 				continue
 			}
-
-			if !statusResponse.Ready {
-				panic(fmt.Errorf("got status response from worker with ready=false"))
+			known = true
+			if worker.Capacity.Fits(nil, 0, requirements) {
+				return true
 			}
+		}
+		// if we don't know any capacities yet, then wait for them
+		return !known
+	}
 
-			log.Printf("[req %s] successfully allocated on worker %s at %s", req.UUID, worker.URL, statusResponse.BaseURL)
+	// allocate a container for the request on the worker
+	// the resources should already be reserved in worker.Allocations
+	allocate := func(req *Request, worker *Worker) {
+		setError := func(err error) {
+			log.Printf("[req %s] error allocating on worker %s: %v", req.UUID, worker.URL, err)
 			mu.Lock()
-			n := copy(q[0:], q[1:])
-			q = q[0:n]
-			results[req.UUID] = &AllocationResult{
-				ExecBeginResponse: statusResponse.ExecBeginResponse,
-				BaseURL: statusResponse.BaseURL,
-			}
-			worker.ContainerUUID = containerResponse.UUID
-			worker.AllocationUUID = req.UUID
-			cond.Broadcast()
+			delete(worker.Allocations, req.UUID)
+			finishRequest(req, &AllocationResult{Error: err})
 			mu.Unlock()
+		}
+
+		// forward the ContainerRequest
+		var containerResponse skyhook.ContainerResponse
+		err := skyhook.JsonPost(worker.URL, "/container/request", req.ContainerRequest, &containerResponse)
+		if err != nil {
+			setError(err)
+			return
+		}
+
+		// Call /container/request.
+		// This should always respond with a final status, i.e., either
+		// ready=true or Error is non-nil.
+		// Only pool (us) responds with pending update.
+		statusRequest := skyhook.StatusRequest{UUID: containerResponse.UUID}
+		var statusResponse skyhook.StatusResponse
+		err = skyhook.JsonPost(worker.URL, "/container/status", statusRequest, &statusResponse)
+		if err != nil {
+			setError(err)
+			return
+		}
+
+		if !statusResponse.Ready {
+			panic(fmt.Errorf("got status response from worker with ready=false"))
+		}
+
+		mu.Lock()
+		allocation := worker.Allocations[req.UUID]
+		if allocation == nil {
+			// The worker was marked dead while we were waiting for it, so the
+			// request already failed.
+			mu.Unlock()
+			log.Printf("[req %s] worker %s responded after it was marked dead, ending container", req.UUID, worker.URL)
+			skyhook.JsonPost(worker.URL, "/container/end", skyhook.EndRequest{UUID: containerResponse.UUID}, nil)
+			return
+		}
+		log.Printf("[req %s] successfully allocated on worker %s at %s", req.UUID, worker.URL, statusResponse.BaseURL)
+		allocation.ContainerUUID = containerResponse.UUID
+		finishRequest(req, &AllocationResult{
+			ExecBeginResponse: statusResponse.ExecBeginResponse,
+			BaseURL: statusResponse.BaseURL,
+		})
+		mu.Unlock()
+	}
 
+	// returns the waiting requests in the order that we should try to allocate them
+	// requests with higher priority come first, and among requests with the
+	// same priority we prefer owners who have fewer containers, so that one
+	// coordinator cannot starve the others
+	// ties are broken by the time that the request was queued
+	// caller must have the lock
+	getOrderedQueue := func() []*Request {
+		ownerCounts := make(map[string]int)
+		for _, worker := range workers {
+			for _, allocation := range worker.Allocations {
+				ownerCounts[allocation.Owner]++
+			}
+		}
+		var ordered []*Request
+		for _, req := range q {
+			if req.Allocating {
+				continue
+			}
+			ordered = append(ordered, req)
+		}
+		sort.SliceStable(ordered, func(i, j int) bool {
+			a, b := ordered[i], ordered[j]
+			if a.Priority != b.Priority {
+				return a.Priority > b.Priority
+			}
+			if ownerCounts[a.Owner] != ownerCounts[b.Owner] {
+				return ownerCounts[a.Owner] < ownerCounts[b.Owner]
+			}
+			return a.QueuedAt.Before(b.QueuedAt)
+		})
+		return ordered
+	}
+
+	// process requests
+	// we go through the queue in order and start the first request that fits
+	// on some worker
+	// requests at the same priority can skip ahead of ones that don't fit yet,
+	// so small requests don't have to wait behind large ones, but they never
+	// skip ahead of requests with higher priority
+	go func() {
+		mu.Lock()
+		for {
+			started := false
+			blockedPriority := 0
+			blocked := false
+			for _, req := range getOrderedQueue() {
+				if blocked && req.Priority < blockedPriority {
+					break
+				}
+				if !canEverFit(req.Requirements) {
+					log.Printf("[req %s] requirements %v exceed the capacity of every worker", req.UUID, req.Requirements)
+					finishRequest(req, &AllocationResult{
+						Error: fmt.Errorf("requirements %v exceed the capacity of every worker", req.Requirements),
+					})
+					started = true
+					break
+				}
+				worker := pickWorker(req.Requirements)
+				if worker == nil {
+					if !blocked {
+						blocked = true
+						blockedPriority = req.Priority
+					}
+					continue
+				}
+				log.Printf("[req %s] placing on worker %s with requirements %v (priority %d, owner %s)", req.UUID, worker.URL, req.Requirements, req.Priority, req.Owner)
+				req.Allocating = true
+				worker.Allocations[req.UUID] = &Allocation{
+					Requirements: req.Requirements,
+					Owner: req.Owner,
+				}
+				go allocate(req, worker)
+				// the owner's share changed, so we need to re-order the queue
+				started = true
+				break
+			}
+			// if we didn't start anything, wait for a new request or for
+			// resources to be released
+			if !started {
+				cond.Wait()
+			}
 		}
 	}()
 
@@ -155,11 +442,14 @@ func main() {
 			return
 		}
 		uuid := gouuid.New().String()
-		log.Printf("[req %s] append new request to the queue, node_op=%s coordinator=%s", uuid, request.Node.Op, request.CoordinatorURL)
+		log.Printf("[req %s] append new request to the queue, node_op=%s coordinator=%s priority=%d", uuid, request.Node.Op, request.CoordinatorURL, request.Priority)
 		mu.Lock()
 		q = append(q, &Request{
 			ContainerRequest: request,
 			UUID: uuid,
+			Requirements: skyhook.NormalizeRequirements(request.Requirements),
+			Owner: GetOwner(request),
+			QueuedAt: time.Now(),
 		})
 		cond.Broadcast()
 		mu.Unlock()
@@ -197,7 +487,13 @@ func main() {
 				}
 
 				// is it in the queue?
-				for i, req := range q {
+				// requests that we're already allocating are at position 0
+				for _, req := range q {
+					if req.UUID == request.UUID && req.Allocating {
+						return nil, nil, 0
+					}
+				}
+				for i, req := range getOrderedQueue() {
 					if req.UUID != request.UUID {
 						continue
 					}
@@ -246,14 +542,14 @@ func main() {
 		var containerUUID string
 		mu.Lock()
 		for _, w := range workers {
-			if w.AllocationUUID == uuid {
+			if w.Allocations[uuid] != nil {
 				worker = w
-				containerUUID = worker.ContainerUUID
+				containerUUID = w.Allocations[uuid].ContainerUUID
 				break
 			}
 		}
 		mu.Unlock()
-		if worker == nil {
+		if worker == nil || containerUUID == "" {
 			return
 		}
 
@@ -267,11 +563,125 @@ func main() {
 			return
 		}
 
-		log.Printf("[req %s] stopped successfully, marking worker %s available", uuid, worker.URL)
+		log.Printf("[req %s] stopped successfully, releasing its resources on worker %s", uuid, worker.URL)
+		mu.Lock()
+		delete(worker.Allocations, uuid)
+		cond.Broadcast()
+		mu.Unlock()
+	})
+
+	http.HandleFunc("/workers/register", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.WriteHeader(404)
+			return
+		}
+		var request skyhook.WorkerRegisterRequest
+		if err := skyhook.ParseJsonRequest(w, r, &request); err != nil {
+			return
+		}
+		if request.URL == "" {
+			http.Error(w, "worker URL must be specified", 400)
+			return
+		}
+		log.Printf("[pool] registering worker %s with capacity %v, up to %d containers", request.URL, request.Capacity.Resources, request.Capacity.Containers)
+
+		mu.Lock()
+		defer mu.Unlock()
+		// if the worker registered before, it may have restarted, so we discard
+		// its old allocations
+		var worker *Worker
+		for _, other := range workers {
+			if other.URL == request.URL {
+				worker = other
+			}
+		}
+		if worker == nil {
+			worker = &Worker{URL: request.URL}
+			workers = append(workers, worker)
+		} else if worker.Alive && len(worker.Allocations) > 0 {
+			markDead(worker)
+		}
+		worker.Capacity = &request.Capacity
+		worker.Allocations = make(map[string]*Allocation)
+		worker.Alive = true
+		worker.LastHeartbeat = time.Now()
+		cond.Broadcast()
+	})
+
+	http.HandleFunc("/workers/heartbeat", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.WriteHeader(404)
+			return
+		}
+		var request skyhook.WorkerHeartbeatRequest
+		if err := skyhook.ParseJsonRequest(w, r, &request); err != nil {
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		for _, worker := range workers {
+			if worker.URL != request.URL || !worker.Alive {
+				continue
+			}
+			worker.LastHeartbeat = time.Now()
+			return
+		}
+		// tell the worker to register again
+		http.Error(w, "unknown worker, please register", 404)
+	})
+
+	http.HandleFunc("/queue", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.WriteHeader(404)
+			return
+		}
 		mu.Lock()
-		worker.AllocationUUID = ""
-		worker.ContainerUUID = ""
+		entries := []QueueEntry{}
+		for i, req := range getOrderedQueue() {
+			entries = append(entries, QueueEntry{
+				UUID: req.UUID,
+				Position: i,
+				Priority: req.Priority,
+				Owner: req.Owner,
+				Op: req.Node.Op,
+				NodeName: req.Node.Name,
+				JobID: req.JobID,
+				Requirements: req.Requirements,
+				QueuedAt: req.QueuedAt,
+			})
+		}
+		mu.Unlock()
+		skyhook.JsonResponse(w, entries)
+	})
+
+	http.HandleFunc("/workers", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.WriteHeader(404)
+			return
+		}
+		mu.Lock()
+		infos := []WorkerInfo{}
+		for _, worker := range workers {
+			info := WorkerInfo{
+				URL: worker.URL,
+				Capacity: worker.Capacity,
+				Allocations: make(map[string]*Allocation),
+				Used: worker.GetUsed(),
+				Static: worker.Static,
+				State: "alive",
+				LastHeartbeat: worker.LastHeartbeat,
+			}
+			for uuid, allocation := range worker.Allocations {
+				allocationCopy := *allocation
+				info.Allocations[uuid] = &allocationCopy
+			}
+			if !worker.Alive {
+				info.State = "dead"
+			}
+			infos = append(infos, info)
+		}
 		mu.Unlock()
+		skyhook.JsonResponse(w, infos)
 	})
 
 	log.Printf("starting on :%d", myPort)